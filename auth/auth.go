@@ -0,0 +1,139 @@
+// Package auth checks API keys and their scopes,
+// and limits how fast clients can call the server.
+package auth
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Scope is what a key allows. Each scope includes the ones before it:
+// a train key can predict and an admin key can do everything.
+type Scope int
+
+const (
+	ScopeNone Scope = iota
+	ScopePredict
+	ScopeTrain
+	ScopeAdmin
+)
+
+var scopeNames = []string{"none", "predict", "train", "admin"}
+
+func (s Scope) String() string {
+	if s < 0 || int(s) >= len(scopeNames) {
+		return fmt.Sprintf("scope(%d)", int(s))
+	}
+	return scopeNames[s]
+}
+
+// Allows reports whether the scope includes another one
+func (s Scope) Allows(required Scope) bool {
+	return s >= required
+}
+
+func ParseScope(name string) (Scope, error) {
+	for i, n := range scopeNames {
+		if strings.EqualFold(name, n) {
+			return Scope(i), nil
+		}
+	}
+	return ScopeNone, fmt.Errorf("unknown scope %q, expected predict, train or admin", name)
+}
+
+// ParseScopes returns the widest of a list of scopes
+func ParseScopes(names []string) (Scope, error) {
+	widest := ScopeNone
+	for _, name := range names {
+		s, err := ParseScope(name)
+		if err != nil {
+			return ScopeNone, err
+		}
+		if s > widest {
+			widest = s
+		}
+	}
+	return widest, nil
+}
+
+// Key is an API key, known only by the SHA-256 of its value
+type Key struct {
+	Name  string
+	Hash  string
+	Scope Scope
+}
+
+// Hash returns the hex SHA-256 of a key, as the keys file stores it
+func Hash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Keyring finds the keys by the hash of their value
+type Keyring struct {
+	keys map[string]Key
+}
+
+func NewKeyring(keys []Key) (*Keyring, error) {
+	k := &Keyring{keys: make(map[string]Key, len(keys))}
+	names := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		hash := strings.ToLower(key.Hash)
+		if _, ok := k.keys[hash]; ok {
+			return nil, fmt.Errorf("key %s is the same as another key", key.Name)
+		}
+		if names[key.Name] {
+			return nil, fmt.Errorf("two keys are named %s", key.Name)
+		}
+		names[key.Name] = true
+		key.Hash = hash
+		k.keys[hash] = key
+	}
+	return k, nil
+}
+
+// Lookup returns the key with the given value
+func (k *Keyring) Lookup(value string) (Key, bool) {
+	key, ok := k.keys[Hash(value)]
+	return key, ok
+}
+
+func (k *Keyring) Len() int {
+	return len(k.keys)
+}
+
+// ReadKeysFile reads a file of hashed keys. Every line is the name of a
+// key, its comma separated scopes and the hex SHA-256 of its value,
+// separated by spaces. Empty lines and lines starting with # are skipped.
+func ReadKeysFile(path string) ([]Key, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the keys file: %w", err)
+	}
+	defer f.Close()
+	var keys []Key
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: expected a name, scopes and a hash", path, n)
+		}
+		scope, err := ParseScopes(strings.Split(fields[1], ","))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		if _, err := hex.DecodeString(fields[2]); err != nil || len(fields[2]) != sha256.Size*2 {
+			return nil, fmt.Errorf("%s:%d: the hash must be a hex SHA-256", path, n)
+		}
+		keys = append(keys, Key{Name: fields[0], Hash: fields[2], Scope: scope})
+	}
+	return keys, scanner.Err()
+}
@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeKeys(t *testing.T, lines ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadKeysFile(t *testing.T) {
+	ci, ops := Hash("ci"), strings.ToUpper(Hash("ops"))
+	path := writeKeys(t,
+		"# name scopes hash",
+		"",
+		"ci predict,train "+ci,
+		"  ops   admin   "+ops+"  ",
+	)
+	keys, err := ReadKeysFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Key{{Name: "ci", Hash: ci, Scope: ScopeTrain}, {Name: "ops", Hash: ops, Scope: ScopeAdmin}}
+	if !reflect.DeepEqual(keys, want) {
+		t.Fatalf("got %+v, want %+v", keys, want)
+	}
+	ring, err := NewKeyring(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key, ok := ring.Lookup("ops"); !ok || key.Name != "ops" {
+		t.Errorf("the uppercase hash of ops is not found: %+v", key)
+	}
+}
+
+func TestReadKeysFileRejectsInvalidLines(t *testing.T) {
+	hash := Hash("key")
+	for _, tc := range []struct {
+		line, err string
+	}{
+		{"ci predict", ":2: expected a name, scopes and a hash"},
+		{"ci predict " + hash + " extra", ":2: expected a name, scopes and a hash"},
+		{"ci root " + hash, `:2: unknown scope "root"`},
+		{"ci predict " + hash[:10], ":2: the hash must be a hex SHA-256"},
+		{"ci predict " + strings.Repeat("z", 64), ":2: the hash must be a hex SHA-256"},
+	} {
+		path := writeKeys(t, "# keys", tc.line)
+		_, err := ReadKeysFile(path)
+		if err == nil || !strings.Contains(err.Error(), path+tc.err) {
+			t.Errorf("%q: got error %v, want %s%s", tc.line, err, path, tc.err)
+		}
+	}
+	if _, err := ReadKeysFile(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("a missing file was read")
+	}
+}
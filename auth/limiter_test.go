@@ -0,0 +1,58 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	l := NewLimiter(2, 3)
+	now := time.Unix(1000, 0)
+	l.now = func() time.Time { return now }
+
+	// the burst goes through at once, then a token every half second
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.Allow("a"); !ok {
+			t.Fatalf("request %d of the burst was limited", i+1)
+		}
+	}
+	ok, wait := l.Allow("a")
+	if ok || wait != 500*time.Millisecond {
+		t.Fatalf("after the burst: allowed %v, wait %v, want false and 500ms", ok, wait)
+	}
+	if ok, _ := l.Allow("b"); !ok {
+		t.Fatal("another client was limited")
+	}
+
+	now = now.Add(200 * time.Millisecond)
+	if ok, wait := l.Allow("a"); ok || wait != 300*time.Millisecond {
+		t.Fatalf("200ms later: allowed %v, wait %v, want false and 300ms", ok, wait)
+	}
+	now = now.Add(300 * time.Millisecond)
+	if ok, _ := l.Allow("a"); !ok {
+		t.Fatal("a refilled token was limited")
+	}
+
+	// the bucket never holds more than the burst
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		l.Allow("a")
+	}
+	if ok, _ := l.Allow("a"); ok {
+		t.Fatal("more than the burst after a long wait")
+	}
+	// a full bucket is swept, and a new one is the same
+	if _, kept := l.buckets["b"]; kept {
+		t.Error("the full bucket of b was not swept")
+	}
+}
+
+func TestNoLimiter(t *testing.T) {
+	l := NewLimiter(0, 10)
+	if l != nil {
+		t.Fatal("a rate of 0 has a limiter")
+	}
+	if ok, _ := l.Allow("a"); !ok {
+		t.Fatal("a nil limiter limited a request")
+	}
+}
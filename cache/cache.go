@@ -1,9 +1,24 @@
 package cache
 
+import (
+	"errors"
+	"fmt"
+	"neural-network/config"
+	"neural-network/metrics"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+)
+
+var lookups = metrics.NewCounterVec("nn_cache_lookups_total",
+	"Cache lookups by backend and result: hit, miss or error.", "backend", "result")
+
 type Cache interface {
 	Get(key string) (string, error)
 	Put(key string, value string) error
 	Delete(key string) error
+	// Ping checks that the cache can be reached
+	Ping() error
 }
 
 var impl Cache
@@ -13,7 +28,27 @@ func SetCacheRepository(repository Cache) {
 }
 
 func Get(key string) (string, error) {
-	return impl.Get(key)
+	val, err := impl.Get(key)
+	result := "hit"
+	switch {
+	case err == redis.Nil || (err == nil && val == ""):
+		result = "miss"
+	case err != nil:
+		result = "error"
+	}
+	lookups.Inc(backend(impl), result)
+	return val, err
+}
+
+// backend names the kind of cache in metrics
+func backend(c Cache) string {
+	switch c.(type) {
+	case *RedisCache:
+		return "redis"
+	case *InMemoryCache:
+		return "memory"
+	}
+	return "other"
 }
 
 func Put(key string, value string) error {
@@ -24,11 +59,38 @@ func Delete(key string) error {
 	return impl.Delete(key)
 }
 
-func GetRepositoryInstance() Cache {
-	var cache Cache
-	cache = NewRedisCacheRepository()
-	if err := cache.(*RedisCache).redis.Ping(ctx).Err(); err != nil {
-		cache = NewInMemoryCacheRepository()
+// Ping checks that the cache in use can be reached
+func Ping() error {
+	if impl == nil {
+		return errors.New("no cache is configured")
+	}
+	return impl.Ping()
+}
+
+// Backend names the kind of cache in use
+func Backend() string {
+	if impl == nil {
+		return "none"
+	}
+	return backend(impl)
+}
+
+// Open connects to the configured backend. In auto mode, the in-memory
+// cache is used when Redis does not answer, while a Redis backend must.
+func Open(c config.Cache) (Cache, error) {
+	if c.Backend == config.CacheMemory {
+		return NewInMemoryCacheRepository(), nil
+	}
+	redisCache := NewRedisCacheRepository(c.Redis)
+	err := redisCache.Ping()
+	switch {
+	case err == nil:
+		return redisCache, nil
+	case c.Backend == config.CacheRedis:
+		redisCache.redis.Close()
+		return nil, fmt.Errorf("cannot reach redis at %s: %v", c.Redis.Addr, err)
 	}
-	return cache
+	logrus.Warnf("cannot reach redis at %s, caching in memory: %v", c.Redis.Addr, err)
+	redisCache.redis.Close()
+	return NewInMemoryCacheRepository(), nil
 }
@@ -1,6 +1,9 @@
 package cache
 
+import "sync"
+
 type InMemoryCache struct {
+	mu    sync.RWMutex
 	store map[string]string
 }
 
@@ -11,6 +14,8 @@ func NewInMemoryCacheRepository() *InMemoryCache {
 }
 
 func (c *InMemoryCache) Get(key string) (string, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	val, exists := c.store[key]
 	if !exists {
 		return "", nil
@@ -19,11 +24,20 @@ func (c *InMemoryCache) Get(key string) (string, error) {
 }
 
 func (c *InMemoryCache) Put(key string, val string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	c.store[key] = val
 	return nil
 }
 
+// Ping always succeeds, the cache lives in the process
+func (c *InMemoryCache) Ping() error {
+	return nil
+}
+
 func (c *InMemoryCache) Delete(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	delete(c.store, key)
 	return nil
 }
@@ -2,6 +2,8 @@ package cache
 
 import (
 	"context"
+	"neural-network/config"
+	"time"
 
 	"github.com/redis/go-redis/v9"
 	"github.com/sirupsen/logrus"
@@ -9,17 +11,20 @@ import (
 
 type RedisCache struct {
 	redis *redis.Client
+	ttl   time.Duration
 }
 
 var ctx = context.Background()
 
-func NewRedisCacheRepository() *RedisCache {
+func NewRedisCacheRepository(c config.Redis) *RedisCache {
 	return &RedisCache{
 		redis: redis.NewClient(&redis.Options{
-			Addr:     "redis:6379",
-			Password: "",
-			DB:       0,
+			Addr:        c.Addr,
+			Password:    c.Password,
+			DB:          c.DB,
+			DialTimeout: c.DialTimeout,
 		}),
+		ttl: c.TTL,
 	}
 }
 
@@ -35,9 +40,13 @@ func (r *RedisCache) Get(key string) (string, error) {
 
 func (r *RedisCache) Put(key string, val string) error {
 	logrus.Infof("Saving %v into key %v", val, key)
-	return r.redis.Set(ctx, key, val, 0).Err()
+	return r.redis.Set(ctx, key, val, r.ttl).Err()
 }
 
 func (r *RedisCache) Delete(key string) error {
 	return r.redis.Del(ctx, key).Err()
 }
+
+func (r *RedisCache) Ping() error {
+	return r.redis.Ping(ctx).Err()
+}
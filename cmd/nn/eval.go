@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+type evalResult struct {
+	Model    string  `json:"model"`
+	Dataset  string  `json:"dataset"`
+	Data     string  `json:"data"`
+	Samples  int     `json:"samples"`
+	Correct  int     `json:"correct"`
+	Accuracy float64 `json:"accuracy"`
+}
+
+func runEval(args []string) error {
+	fs, asJSON := newFlagSet("eval", "")
+	var mf modelFlags
+	mf.register(fs)
+	data := fs.String("data", "", "test file, the test set of the dataset by default")
+	if err := parse(fs, args); err != nil {
+		return err
+	}
+	m, err := mf.load()
+	if err != nil {
+		return err
+	}
+	file := *data
+	if file == "" {
+		file = defaultTestFile(m.meta.Dataset)
+	}
+	correct, total, err := score(m.meta.Dataset, m.net, file)
+	if err != nil {
+		return err
+	}
+	if total == 0 {
+		return fmt.Errorf("%s has no samples", file)
+	}
+	result := evalResult{
+		Model:    m.id(),
+		Dataset:  m.meta.Dataset,
+		Data:     file,
+		Samples:  total,
+		Correct:  correct,
+		Accuracy: float64(correct) / float64(total) * 100,
+	}
+	return output(*asJSON, result, func(w io.Writer) {
+		fmt.Fprintf(w, "model:\t%s\n", result.Model)
+		fmt.Fprintf(w, "data:\t%s\n", result.Data)
+		fmt.Fprintf(w, "samples:\t%d\n", result.Samples)
+		fmt.Fprintf(w, "correct:\t%d\n", result.Correct)
+		fmt.Fprintf(w, "accuracy:\t%s\n", percent(&result.Accuracy))
+	})
+}
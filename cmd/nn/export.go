@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"neural-network/registry"
+	"os"
+)
+
+type exportResult struct {
+	Model  string `json:"model"`
+	Format string `json:"format"`
+	Output string `json:"output"`
+}
+
+func runExport(args []string) error {
+	fs, asJSON := newFlagSet("export", "")
+	var mf modelFlags
+	mf.register(fs)
+	out := fs.String("o", "", "file to write the zip archive to, - for stdout, or directory for -format weights")
+	format := fs.String("format", "zip", "zip for an archive nn inspect and the server import, weights for the weight files")
+	if err := parse(fs, args); err != nil {
+		return err
+	}
+	if *out == "" {
+		fs.Usage()
+		return errUsage
+	}
+	if *format != "zip" && *format != "weights" {
+		return fmt.Errorf("unknown format %q, expected zip or weights", *format)
+	}
+	reg, err := registry.New(mf.registry)
+	if err != nil {
+		return err
+	}
+	name, version, err := parseModelRef(mf.model, mf.dataset)
+	if err != nil {
+		return err
+	}
+	if version == 0 {
+		active, err := reg.Active(name)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		version = active.Version
+	}
+	result := exportResult{Model: fmt.Sprintf("%s@%d", name, version), Format: *format, Output: *out}
+
+	if *format == "weights" {
+		m, err := loadFromRegistry(reg, name, version)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(*out, 0o755); err != nil {
+			return err
+		}
+		if err := m.net.SaveTo(*out); err != nil {
+			return err
+		}
+	} else if *out == "-" {
+		// the archive is the output, there is nothing else to print
+		return reg.Export(name, version, stdout)
+	} else {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		if err := reg.Export(name, version, f); err != nil {
+			f.Close()
+			os.Remove(*out)
+			return fmt.Errorf("%s: %w", result.Model, err)
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+
+	return output(*asJSON, result, func(w io.Writer) {
+		fmt.Fprintf(w, "%s exported to %s\n", result.Model, result.Output)
+	})
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"neural-network/config"
+	"neural-network/models"
+	"neural-network/registry"
+	"os"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// weightStats summarizes a weight matrix
+type weightStats struct {
+	Rows int     `json:"rows"`
+	Cols int     `json:"cols"`
+	Mean float64 `json:"mean"`
+	Std  float64 `json:"std"`
+	Min  float64 `json:"min"`
+	Max  float64 `json:"max"`
+}
+
+type inspectResult struct {
+	Source  string                `json:"source"`
+	Model   models.ModelVersion   `json:"model"`
+	Hidden  weightStats           `json:"hidden_weights"`
+	Output  weightStats           `json:"output_weights"`
+	Active  int                   `json:"active_version,omitempty"`
+	History []models.ModelVersion `json:"versions,omitempty"`
+}
+
+func runInspect(args []string) error {
+	fs, asJSON := newFlagSet("inspect", "<model>")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: nn inspect [flags] <model>\n\n"+
+			"The model is name[@version] in the registry, a zip archive\n"+
+			"written by nn export, or a directory of saved weights.\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	defaults := config.Default().Network
+	mf := modelFlags{}
+	fs.StringVar(&mf.registry, "registry", defaults.Registry, "directory of the model registry")
+	fs.StringVar(&mf.dataset, "dataset", defaults.Dataset, "dataset of an archive or weights without metadata")
+	if err := parse(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errUsage
+	}
+	ref := fs.Arg(0)
+
+	result := inspectResult{Source: "registry"}
+	var m *loadedModel
+	info, err := os.Stat(ref)
+	switch {
+	case err == nil && info.IsDir():
+		result.Source = "weights"
+		mf.weights = ref
+		if m, err = mf.load(); err != nil {
+			return err
+		}
+	case err == nil:
+		result.Source = "archive"
+		if m, err = loadArchive(ref, mf.dataset); err != nil {
+			return err
+		}
+	default:
+		if m, result.Active, result.History, err = inspectRegistry(&mf, ref); err != nil {
+			return err
+		}
+	}
+	result.Model = m.meta
+	result.Hidden = statsOf(m.net.HiddenWeights)
+	result.Output = statsOf(m.net.OutputWeights)
+
+	return output(*asJSON, result, func(w io.Writer) {
+		meta := result.Model
+		fmt.Fprintf(w, "model:\t%s (%s)\n", m.id(), result.Source)
+		fmt.Fprintf(w, "dataset:\t%s\n", meta.Dataset)
+		fmt.Fprintf(w, "preprocess:\t%s\n", meta.Preprocess)
+		fmt.Fprintf(w, "layers:\t%d inputs, %d hidden, %d outputs\n", meta.Inputs, meta.Hiddens, meta.Outputs)
+		fmt.Fprintf(w, "learning rate:\t%g\n", meta.LearningRate)
+		fmt.Fprintf(w, "labels:\t%v\n", meta.Labels)
+		fmt.Fprintf(w, "accuracy:\t%s\n", percent(meta.Accuracy))
+		if meta.Description != "" {
+			fmt.Fprintf(w, "description:\t%s\n", meta.Description)
+		}
+		if !meta.CreatedAt.IsZero() {
+			fmt.Fprintf(w, "created:\t%s\n", meta.CreatedAt.Format("2006-01-02 15:04:05"))
+		}
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "WEIGHTS\tSHAPE\tMEAN\tSTD\tMIN\tMAX")
+		for _, s := range []struct {
+			name string
+			weightStats
+		}{{"hidden", result.Hidden}, {"output", result.Output}} {
+			fmt.Fprintf(w, "%s\t%dx%d\t%.5f\t%.5f\t%.5f\t%.5f\n", s.name, s.Rows, s.Cols, s.Mean, s.Std, s.Min, s.Max)
+		}
+		if len(result.History) > 0 {
+			fmt.Fprintln(w)
+			fmt.Fprintln(w, "VERSION\tACTIVE\tACCURACY\tCREATED\tDESCRIPTION")
+			for _, v := range result.History {
+				active := ""
+				if v.Active {
+					active = "*"
+				}
+				fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", v.Version, active, percent(v.Accuracy),
+					v.CreatedAt.Format("2006-01-02 15:04"), v.Description)
+			}
+		}
+	})
+}
+
+// inspectRegistry loads a model of the registry with all its versions
+func inspectRegistry(mf *modelFlags, ref string) (*loadedModel, int, []models.ModelVersion, error) {
+	reg, err := registry.New(mf.registry)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	name, version, err := parseModelRef(ref, mf.dataset)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	model, err := reg.Get(name)
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("%s: %w", name, err)
+	}
+	m, err := loadFromRegistry(reg, name, version)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	return m, model.ActiveVersion, model.Versions, nil
+}
+
+// loadArchive reads a zip archive written by nn export or the server
+func loadArchive(file, dataset string) (*loadedModel, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	net, meta, err := registry.ReadArchive(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	meta.Name = file
+	if meta.Dataset == "" {
+		meta.Dataset = dataset
+	}
+	return newLoadedModel(net, meta), nil
+}
+
+func statsOf(m *mat.Dense) weightStats {
+	rows, cols := m.Dims()
+	s := weightStats{Rows: rows, Cols: cols, Min: math.Inf(1), Max: math.Inf(-1)}
+	n := float64(rows * cols)
+	if n == 0 {
+		return weightStats{}
+	}
+	var sum, squares float64
+	for i := 0; i < rows; i++ {
+		for j := 0; j < cols; j++ {
+			v := m.At(i, j)
+			sum += v
+			squares += v * v
+			s.Min = math.Min(s.Min, v)
+			s.Max = math.Max(s.Max, v)
+		}
+	}
+	s.Mean = sum / n
+	s.Std = math.Sqrt(math.Max(squares/n-s.Mean*s.Mean, 0))
+	return s
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"neural-network/models"
+	"neural-network/network"
+	"neural-network/registry"
+	"testing"
+)
+
+// capture runs a command and returns what it printed
+func capture(t *testing.T, run func([]string) error, args ...string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	defer func(w io.Writer) { stdout = w }(stdout)
+	stdout = &buf
+	if err := run(args); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestInspectJSON(t *testing.T) {
+	dir := t.TempDir()
+	reg, err := registry.New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		v, err := reg.Create(models.ModelVersion{Name: "digits", Dataset: "mnist"}, network.NewNetwork(784, 20, 10, 0.1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			if err := reg.Activate("digits", v.Version); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	weights := t.TempDir()
+	if err := network.NewNetwork(784, 30, 10, 0.1).SaveTo(weights); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		args     []string
+		source   string
+		version  int
+		active   int
+		hiddens  int
+		versions int
+	}{
+		{[]string{"digits"}, "registry", 1, 1, 20, 2},
+		{[]string{"digits@2"}, "registry", 2, 1, 20, 2},
+		{[]string{weights}, "weights", 0, 0, 30, 0},
+	}
+	for _, tt := range tests {
+		args := append([]string{"--json", "-registry", dir}, tt.args...)
+		var result inspectResult
+		if err := json.Unmarshal(capture(t, runInspect, args...), &result); err != nil {
+			t.Fatalf("%v: %v", tt.args, err)
+		}
+		if result.Source != tt.source || result.Model.Version != tt.version || result.Active != tt.active || len(result.History) != tt.versions {
+			t.Errorf("%v: got %s version %d, active %d, with %d versions", tt.args, result.Source, result.Model.Version, result.Active, len(result.History))
+		}
+		if result.Model.Dataset != "mnist" || result.Model.Inputs != 784 || result.Model.Hiddens != tt.hiddens || len(result.Model.Labels) != 10 {
+			t.Errorf("%v: unexpected model %+v", tt.args, result.Model)
+		}
+		if result.Hidden.Rows != tt.hiddens || result.Hidden.Cols != 784 || result.Output.Rows != 10 || result.Output.Cols != tt.hiddens {
+			t.Errorf("%v: weight shapes %+v, %+v", tt.args, result.Hidden, result.Output)
+		}
+		if result.Hidden.Min > result.Hidden.Mean || result.Hidden.Mean > result.Hidden.Max || result.Hidden.Std <= 0 {
+			t.Errorf("%v: hidden weight stats %+v", tt.args, result.Hidden)
+		}
+	}
+
+	if result := capture(t, runInspect, "-registry", dir, "digits"); bytes.HasPrefix(result, []byte("{")) {
+		t.Errorf("inspect without --json printed JSON: %s", result)
+	}
+}
@@ -0,0 +1,107 @@
+// Command nn trains, evaluates and runs the networks of the server
+// without going through HTTP, and starts the server itself.
+//
+// Usage:
+//
+//	nn <command> [flags] [arguments]
+//
+// Every command takes -json to print its result as JSON instead of text.
+// Run nn <command> -h for the flags of a command.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"neural-network/server"
+	"os"
+)
+
+type command struct {
+	name    string
+	args    string
+	summary string
+	run     func(args []string) error
+}
+
+var commands = []command{
+	{"train", "", "train a network and save it to the registry or a directory", runTrain},
+	{"eval", "", "measure the accuracy of a model on a test set", runEval},
+	{"predict", "<files...>", "predict the label of images", runPredict},
+	{"serve", "", "start the HTTP server, see nn serve -h", runServe},
+	{"inspect", "<model>", "describe a model of the registry, an archive or a weights directory", runInspect},
+	{"export", "", "write a model of the registry as a zip archive or weight files", runExport},
+}
+
+// errUsage is returned after the flag package printed the usage
+var errUsage = errors.New("usage")
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	name := os.Args[1]
+	if name == "help" || name == "-h" || name == "--help" {
+		usage()
+		return
+	}
+	for _, c := range commands {
+		if c.name != name {
+			continue
+		}
+		err := c.run(os.Args[2:])
+		if err == flag.ErrHelp {
+			return
+		}
+		if err == errUsage {
+			os.Exit(2)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "nn %s: %v\n", name, err)
+			os.Exit(1)
+		}
+		return
+	}
+	fmt.Fprintf(os.Stderr, "nn: unknown command %q\n", name)
+	usage()
+	os.Exit(2)
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: nn <command> [flags] [arguments]")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Commands:")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-8s %-12s %s\n", c.name, c.args, c.summary)
+	}
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Run nn <command> -h for the flags of a command.")
+}
+
+// newFlagSet returns the flags of a command, with -json
+func newFlagSet(name, args string) (*flag.FlagSet, *bool) {
+	fs := flag.NewFlagSet("nn "+name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: nn %s [flags] %s\n\nFlags:\n", name, args)
+		fs.PrintDefaults()
+	}
+	asJSON := fs.Bool("json", false, "print the result as JSON")
+	return fs, asJSON
+}
+
+// parse parses the flags, turning their errors into errUsage
+// since the flag package already printed them
+func parse(fs *flag.FlagSet, args []string) error {
+	err := fs.Parse(args)
+	if err != nil && err != flag.ErrHelp {
+		return errUsage
+	}
+	return err
+}
+
+// runServe starts the server with the flags of the server,
+// the same as running the server binary
+func runServe(args []string) error {
+	return server.StartServer(args)
+}
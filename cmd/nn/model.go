@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"neural-network/config"
+	"neural-network/models"
+	"neural-network/network"
+	"neural-network/registry"
+	"neural-network/server"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// modelFlags pick the model a command runs: a model of the
+// registry, or the weights saved in a directory
+type modelFlags struct {
+	registry string
+	model    string
+	weights  string
+	dataset  string
+}
+
+func (m *modelFlags) register(fs *flag.FlagSet) {
+	defaults := config.Default().Network
+	fs.StringVar(&m.registry, "registry", defaults.Registry, "directory of the model registry")
+	fs.StringVar(&m.model, "model", "", "registry model as name or name@version, the dataset by default")
+	fs.StringVar(&m.weights, "weights", "", "directory of saved weights, instead of a registry model")
+	fs.StringVar(&m.dataset, "dataset", defaults.Dataset, "dataset of the model, mnist or cifar10")
+}
+
+// loadedModel is a network with the metadata that says
+// how to read its inputs and name its outputs
+type loadedModel struct {
+	net  *network.Network
+	meta models.ModelVersion
+}
+
+// id names the model as the server does
+func (m *loadedModel) id() string {
+	if m.meta.Version == 0 {
+		return m.meta.Name
+	}
+	return fmt.Sprintf("%s@%d", m.meta.Name, m.meta.Version)
+}
+
+func (m *loadedModel) label(class int) string {
+	if class < len(m.meta.Labels) {
+		return m.meta.Labels[class]
+	}
+	return strconv.Itoa(class)
+}
+
+func (m *modelFlags) load() (*loadedModel, error) {
+	if m.weights != "" {
+		net, err := network.OpenNetwork(m.weights, config.Default().Network.LearningRate)
+		if err != nil {
+			return nil, err
+		}
+		return newLoadedModel(net, models.ModelVersion{Name: m.weights, Dataset: m.dataset}), nil
+	}
+	reg, err := registry.New(m.registry)
+	if err != nil {
+		return nil, err
+	}
+	name, version, err := parseModelRef(m.model, m.dataset)
+	if err != nil {
+		return nil, err
+	}
+	return loadFromRegistry(reg, name, version)
+}
+
+// loadFromRegistry loads a version of a model, the active one when version is 0
+func loadFromRegistry(reg *registry.Registry, name string, version int) (*loadedModel, error) {
+	if version == 0 {
+		active, err := reg.Active(name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		version = active.Version
+	}
+	net, v, err := reg.Load(name, version)
+	if err != nil {
+		return nil, fmt.Errorf("%s@%d: %w", name, version, err)
+	}
+	return newLoadedModel(net, *v), nil
+}
+
+// newLoadedModel fills what the metadata leaves out as the server does
+func newLoadedModel(net *network.Network, meta models.ModelVersion) *loadedModel {
+	if meta.Preprocess == "" {
+		meta.Preprocess = server.DefaultPreprocess(meta.Dataset, net)
+	}
+	if len(meta.Labels) == 0 {
+		meta.Labels = server.DefaultLabels(meta.Dataset, net)
+	}
+	meta.Inputs, meta.Hiddens, meta.Outputs = net.Inputs, net.Hiddens, net.Outputs
+	meta.LearningRate = net.LearningRate
+	return &loadedModel{net: net, meta: meta}
+}
+
+// parseModelRef splits name@version, the version being 0 when
+// there is none. An empty reference is the model of the dataset.
+func parseModelRef(ref, dataset string) (string, int, error) {
+	if ref == "" {
+		return dataset, 0, nil
+	}
+	name, v, ok := strings.Cut(ref, "@")
+	if !registry.ValidName(name) {
+		return "", 0, fmt.Errorf("%s: %w", name, registry.ErrInvalidName)
+	}
+	if !ok {
+		return name, 0, nil
+	}
+	version, err := strconv.Atoi(v)
+	if err != nil || version < 1 {
+		return "", 0, fmt.Errorf("invalid version %q, versions start at 1", v)
+	}
+	return name, version, nil
+}
+
+// defaultTestFile is the test set of a dataset
+func defaultTestFile(dataset string) string {
+	if dataset == config.DatasetCIFAR10 {
+		return network.CifarTestFile
+	}
+	return network.MnistTestFile
+}
+
+// score checks the network against a test file of the dataset
+func score(dataset string, net *network.Network, file string) (int, int, error) {
+	if dataset == config.DatasetCIFAR10 {
+		return net.CifarScore(file)
+	}
+	return net.MnistScore(file)
+}
+
+// stdout is where the commands print their results
+var stdout io.Writer = os.Stdout
+
+// output writes v as indented JSON with -json,
+// otherwise text writes it for people
+func output(asJSON bool, v interface{}, text func(w io.Writer)) error {
+	if asJSON {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	tw := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	text(tw)
+	return tw.Flush()
+}
+
+// percent formats an accuracy that may be unknown
+func percent(v *float64) string {
+	if v == nil {
+		return "-"
+	}
+	return fmt.Sprintf("%.2f%%", *v)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"neural-network/registry"
+	"testing"
+)
+
+func TestParseModelRef(t *testing.T) {
+	tests := []struct {
+		ref     string
+		name    string
+		version int
+		err     bool
+	}{
+		{"", "mnist", 0, false},
+		{"digits", "digits", 0, false},
+		{"digits@3", "digits", 3, false},
+		{"digits@0", "", 0, true},
+		{"digits@-1", "", 0, true},
+		{"digits@", "", 0, true},
+		{"digits@latest", "", 0, true},
+		{"@2", "", 0, true},
+		{"../digits", "", 0, true},
+	}
+	for _, tt := range tests {
+		name, version, err := parseModelRef(tt.ref, "mnist")
+		if (err != nil) != tt.err {
+			t.Errorf("%q: error %v", tt.ref, err)
+			continue
+		}
+		if name != tt.name || version != tt.version {
+			t.Errorf("%q: got %s, %d, want %s, %d", tt.ref, name, version, tt.name, tt.version)
+		}
+	}
+	if _, _, err := parseModelRef("../digits", "mnist"); !errors.Is(err, registry.ErrInvalidName) {
+		t.Errorf("an invalid name gives %v", err)
+	}
+}
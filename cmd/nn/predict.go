@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"neural-network/images"
+	"neural-network/server"
+	"neural-network/utils"
+	"strconv"
+	"strings"
+)
+
+// prediction is the result for one file. Results are the
+// confidence of every label, in percent, like the server's.
+type prediction struct {
+	File       string             `json:"file"`
+	Label      string             `json:"label,omitempty"`
+	Class      int                `json:"class"`
+	Confidence float64            `json:"confidence"`
+	Results    map[string]float64 `json:"results,omitempty"`
+	Error      string             `json:"error,omitempty"`
+}
+
+type predictResult struct {
+	Model       string       `json:"model"`
+	Predictions []prediction `json:"predictions"`
+}
+
+func runPredict(args []string) error {
+	fs, asJSON := newFlagSet("predict", "<files...>")
+	var mf modelFlags
+	mf.register(fs)
+	invert := fs.String("invert", "auto", "true for light digits on a dark background, false for dark ones, auto to detect")
+	binarize := fs.Bool("binarize", false, "threshold the digits to black and white")
+	deskew := fs.Bool("deskew", false, "straighten slanted digits")
+	if err := parse(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errUsage
+	}
+	var light *bool
+	if !strings.EqualFold(*invert, "auto") {
+		v, err := strconv.ParseBool(*invert)
+		if err != nil {
+			return fmt.Errorf("invert must be auto, true or false: %v", err)
+		}
+		light = &v
+	}
+	m, err := mf.load()
+	if err != nil {
+		return err
+	}
+
+	result := predictResult{Model: m.id(), Predictions: []prediction{}}
+	failed := 0
+	for _, file := range fs.Args() {
+		p := prediction{File: file}
+		img, _, err := utils.Open(file)
+		if err != nil {
+			p.Error = err.Error()
+			failed++
+			result.Predictions = append(result.Predictions, p)
+			continue
+		}
+		opts := images.DefaultMNISTOptions
+		opts.Binarize, opts.Deskew = *binarize, *deskew
+		if light != nil {
+			opts.InkIsDark = !*light
+		} else {
+			opts.InkIsDark = images.DetectPolarity(img) == images.DarkInk
+		}
+		output := m.net.Predict(server.InputData(m.meta.Preprocess, m.net, img, opts))
+		rows, _ := output.Dims()
+		p.Results = make(map[string]float64, rows)
+		for i := 0; i < rows; i++ {
+			v := output.At(i, 0) * 100
+			p.Results[m.label(i)] = v
+			if i == 0 || v > p.Confidence {
+				p.Class, p.Confidence = i, v
+			}
+		}
+		p.Label = m.label(p.Class)
+		result.Predictions = append(result.Predictions, p)
+	}
+
+	err = output(*asJSON, result, func(w io.Writer) {
+		fmt.Fprintln(w, "FILE\tLABEL\tCONFIDENCE")
+		for _, p := range result.Predictions {
+			if p.Error != "" {
+				fmt.Fprintf(w, "%s\terror: %s\t\n", p.File, p.Error)
+				continue
+			}
+			fmt.Fprintf(w, "%s\t%s\t%.2f%%\n", p.File, p.Label, p.Confidence)
+		}
+	})
+	if err == nil && failed > 0 {
+		err = fmt.Errorf("%d of %d files could not be read", failed, len(result.Predictions))
+	}
+	return err
+}
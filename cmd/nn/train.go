@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"neural-network/config"
+	"neural-network/models"
+	"neural-network/network"
+	"neural-network/registry"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+)
+
+// trainResult is what nn train prints. Model is set when
+// the network was saved to the registry, Weights when it was saved to
+// a directory.
+type trainResult struct {
+	Model   string                `json:"model,omitempty"`
+	Weights string                `json:"weights,omitempty"`
+	Active  bool                  `json:"active"`
+	Metrics models.TrainMetrics   `json:"metrics"`
+	History []models.EpochMetrics `json:"history"`
+}
+
+func runTrain(args []string) error {
+	fs, asJSON := newFlagSet("train", "")
+	defaults := config.Default().Network
+	dataset := fs.String("dataset", defaults.Dataset, "dataset to train on, mnist or cifar10")
+	data := fs.String("data", "", "training files, comma separated for cifar10, the dataset ones by default")
+	test := fs.String("test", "", "test file checked after every epoch, the dataset one by default, none to skip")
+	epochs := fs.Int("epochs", defaults.Epochs, "number of passes over the training files")
+	hiddens := fs.Int("hiddens", defaults.Hiddens, "hidden nodes of a new network")
+	rate := fs.Float64("rate", defaults.LearningRate, "learning rate of a new network")
+	reg := fs.String("registry", defaults.Registry, "directory of the model registry")
+	model := fs.String("model", "", "registry model to save the network as, the dataset by default")
+	resume := fs.Bool("resume", false, "train the active version of the model further instead of a new network")
+	activate := fs.Bool("activate", true, "make the trained version the active one")
+	out := fs.String("out", "", "save the weights to this directory instead of the registry")
+	quiet := fs.Bool("quiet", false, "do not report progress")
+	if err := parse(fs, args); err != nil {
+		return err
+	}
+	if *dataset != config.DatasetMNIST && *dataset != config.DatasetCIFAR10 {
+		return fmt.Errorf("unknown dataset %q, expected %s or %s", *dataset, config.DatasetMNIST, config.DatasetCIFAR10)
+	}
+	if *epochs < 1 {
+		return fmt.Errorf("epochs must be at least 1, got %d", *epochs)
+	}
+	files := trainFiles(*dataset, *data)
+	if *dataset == config.DatasetMNIST && len(files) > 1 {
+		return fmt.Errorf("%s trains on a single CSV file, got %d files", config.DatasetMNIST, len(files))
+	}
+	testFile := *test
+	if testFile == "" {
+		testFile = defaultTestFile(*dataset)
+	}
+	name, _, err := parseModelRef(*model, *dataset)
+	if err != nil {
+		return err
+	}
+
+	var r *registry.Registry
+	if *out == "" {
+		if r, err = registry.New(*reg); err != nil {
+			return err
+		}
+	}
+	var m *loadedModel
+	if *resume {
+		if r == nil {
+			return fmt.Errorf("-resume trains a registry model, it cannot be used with -out")
+		}
+		if m, err = loadFromRegistry(r, name, 0); err != nil {
+			return err
+		}
+		if m.meta.Dataset != *dataset {
+			return fmt.Errorf("%s was trained on %s, not %s", m.id(), m.meta.Dataset, *dataset)
+		}
+	} else {
+		m = newLoadedModel(newNetwork(*dataset, *hiddens, *rate), models.ModelVersion{Name: name, Dataset: *dataset})
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	result := trainResult{History: []models.EpochMetrics{}}
+	start, epochStart := time.Now(), time.Now()
+	samples := 0
+	progress := func(p network.Progress) {
+		samples = (p.Epoch-1)*p.EpochSize + p.Samples
+		if !p.EpochDone {
+			if !*quiet && !*asJSON {
+				fmt.Fprintf(os.Stderr, "\repoch %d/%d  %5.1f%%  loss %.5f", p.Epoch, p.Epochs, p.Done()*100, p.Loss)
+			}
+			return
+		}
+		em := models.EpochMetrics{Epoch: p.Epoch, Loss: p.Loss, Duration: time.Since(epochStart).String()}
+		if testFile != "none" {
+			if correct, total, err := score(*dataset, m.net, testFile); err == nil && total > 0 {
+				accuracy := float64(correct) / float64(total) * 100
+				em.ValidationSamples = total
+				em.ValidationAccuracy = &accuracy
+			}
+		}
+		result.History = append(result.History, em)
+		if !*quiet && !*asJSON {
+			fmt.Fprintf(os.Stderr, "\repoch %d/%d  loss %.5f  accuracy %s  %s\n",
+				p.Epoch, p.Epochs, em.Loss, percent(em.ValidationAccuracy), em.Duration)
+		}
+		epochStart = time.Now()
+	}
+	if *dataset == config.DatasetCIFAR10 {
+		err = m.net.CifarTrainContext(ctx, files, *epochs, progress)
+	} else {
+		err = m.net.MnistTrainContext(ctx, files[0], *epochs, progress)
+	}
+	if err != nil {
+		return err
+	}
+
+	result.Metrics = models.TrainMetrics{Epochs: *epochs, Samples: samples, Duration: time.Since(start).String()}
+	if n := len(result.History); n > 0 && result.History[n-1].ValidationAccuracy != nil {
+		result.Metrics.TestSamples = result.History[n-1].ValidationSamples
+		result.Metrics.TestAccuracy = result.History[n-1].ValidationAccuracy
+	}
+	if r == nil {
+		if err := os.MkdirAll(*out, 0o755); err != nil {
+			return err
+		}
+		if err := m.net.SaveTo(*out); err != nil {
+			return err
+		}
+		result.Weights = *out
+	} else {
+		description := fmt.Sprintf("trained for %d epochs by nn train", *epochs)
+		if *resume {
+			description = fmt.Sprintf("%s trained for %d more epochs by nn train", m.id(), *epochs)
+		}
+		v, err := r.Create(models.ModelVersion{
+			Name:        name,
+			Dataset:     *dataset,
+			Preprocess:  m.meta.Preprocess,
+			Labels:      m.meta.Labels,
+			Description: description,
+			Accuracy:    result.Metrics.TestAccuracy,
+		}, m.net)
+		if err != nil {
+			return err
+		}
+		if *activate {
+			if err := r.Activate(name, v.Version); err != nil {
+				return err
+			}
+		}
+		result.Model = fmt.Sprintf("%s@%d", name, v.Version)
+		result.Metrics.Version = v.Version
+		result.Active = *activate
+	}
+
+	return output(*asJSON, result, func(w io.Writer) {
+		if result.Model != "" {
+			state := "saved"
+			if result.Active {
+				state = "saved and activated"
+			}
+			fmt.Fprintf(w, "%s %s\n", result.Model, state)
+		} else {
+			fmt.Fprintf(w, "weights saved to %s\n", result.Weights)
+		}
+		fmt.Fprintf(w, "epochs:\t%d\n", result.Metrics.Epochs)
+		fmt.Fprintf(w, "samples:\t%d\n", result.Metrics.Samples)
+		fmt.Fprintf(w, "duration:\t%s\n", result.Metrics.Duration)
+		fmt.Fprintf(w, "test accuracy:\t%s\n", percent(result.Metrics.TestAccuracy))
+	})
+}
+
+// trainFiles are the files given with -data, or the ones of the dataset
+func trainFiles(dataset, data string) []string {
+	if data != "" {
+		return strings.Split(data, ",")
+	}
+	if dataset == config.DatasetCIFAR10 {
+		return network.CifarTrainFiles
+	}
+	return []string{network.MnistTrainFile}
+}
+
+// newNetwork creates an untrained network in the shape of the dataset
+func newNetwork(dataset string, hiddens int, rate float64) *network.Network {
+	if dataset == config.DatasetCIFAR10 {
+		return network.NewNetwork(network.CifarInputs, hiddens, len(network.CifarLabels), rate)
+	}
+	return network.NewNetwork(network.MnistInputs, hiddens, 10, rate)
+}
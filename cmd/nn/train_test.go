@@ -0,0 +1,34 @@
+package main
+
+import (
+	"neural-network/network"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTrainFiles(t *testing.T) {
+	tests := []struct {
+		dataset string
+		data    string
+		want    []string
+	}{
+		{"mnist", "", []string{network.MnistTrainFile}},
+		{"cifar10", "", network.CifarTrainFiles},
+		{"mnist", "digits.csv", []string{"digits.csv"}},
+		{"cifar10", "a.bin,b.bin", []string{"a.bin", "b.bin"}},
+	}
+	for _, tt := range tests {
+		if got := trainFiles(tt.dataset, tt.data); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s %q: got %v, want %v", tt.dataset, tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestTrainRejectsSeveralMnistFiles(t *testing.T) {
+	dir := t.TempDir()
+	err := runTrain([]string{"-dataset", "mnist", "-data", "a.csv,b.csv", "-registry", dir, "-quiet"})
+	if err == nil || !strings.Contains(err.Error(), "single CSV file") {
+		t.Fatalf("got %v", err)
+	}
+}
@@ -0,0 +1,449 @@
+// Package config reads the configuration of the server in layers: the
+// defaults, then a YAML file, then environment variables, then command
+// line flags, each one overriding the ones before.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"neural-network/auth"
+	"neural-network/registry"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// datasets the server knows how to train and predict on
+const (
+	DatasetMNIST   = "mnist"
+	DatasetCIFAR10 = "cifar10"
+)
+
+// cache backends
+const (
+	// CacheAuto uses Redis when it answers at startup, memory otherwise
+	CacheAuto   = "auto"
+	CacheRedis  = "redis"
+	CacheMemory = "memory"
+)
+
+// FileEnv is the environment variable naming the configuration file,
+// when the -config flag does not
+const FileEnv = "NN_CONFIG"
+
+type Config struct {
+	Server  Server  `yaml:"server"`
+	Network Network `yaml:"network"`
+	Cache   Cache   `yaml:"cache"`
+	Auth    Auth    `yaml:"auth"`
+	Log     Log     `yaml:"log"`
+}
+
+type Server struct {
+	Addr string `yaml:"addr"`
+	// ShutdownTimeout is how long requests in flight get to finish
+	ShutdownTimeout   time.Duration `yaml:"shutdown_timeout"`
+	ReadTimeout       time.Duration `yaml:"read_timeout"`
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	// WriteTimeout is off by default, it would cut the
+	// event streams of long training jobs
+	WriteTimeout time.Duration `yaml:"write_timeout"`
+	IdleTimeout  time.Duration `yaml:"idle_timeout"`
+	CORS         CORS          `yaml:"cors"`
+}
+
+type CORS struct {
+	AllowedOrigins []string `yaml:"allowed_origins"`
+	AllowedMethods []string `yaml:"allowed_methods"`
+	AllowedHeaders []string `yaml:"allowed_headers"`
+}
+
+type Network struct {
+	Dataset string `yaml:"dataset"`
+	// Model is the name of the registry model the routes without a name
+	// predict with, Registry the directory of the registry and DataDir
+	// where the weights saved before there was a registry are
+	Model    string `yaml:"model"`
+	Registry string `yaml:"registry"`
+	DataDir  string `yaml:"data_dir"`
+	// Hiddens and LearningRate shape the networks trained from scratch,
+	// Epochs is how long a training job runs when it does not say
+	Hiddens      int     `yaml:"hiddens"`
+	LearningRate float64 `yaml:"learning_rate"`
+	Epochs       int     `yaml:"epochs"`
+}
+
+type Cache struct {
+	Backend string `yaml:"backend"`
+	Redis   Redis  `yaml:"redis"`
+}
+
+type Redis struct {
+	Addr        string        `yaml:"addr"`
+	Password    string        `yaml:"password"`
+	DB          int           `yaml:"db"`
+	DialTimeout time.Duration `yaml:"dial_timeout"`
+	// TTL is how long predictions stay cached, forever when 0
+	TTL time.Duration `yaml:"ttl"`
+}
+
+// Auth lists the API keys and the limits of the clients. Keys are given
+// here or by their hash in KeysFile, see auth.ReadKeysFile. Requests
+// without a key get the Anonymous scopes.
+type Auth struct {
+	Keys      []Key     `yaml:"keys"`
+	KeysFile  string    `yaml:"keys_file"`
+	Anonymous []string  `yaml:"anonymous"`
+	RateLimit RateLimit `yaml:"rate_limit"`
+	// TrustProxy takes the client IP from X-Forwarded-For,
+	// only safe behind a proxy that sets it
+	TrustProxy bool `yaml:"trust_proxy"`
+	// ProxyHops is how many trusted proxies, 1 when not set, append
+	// to X-Forwarded-For in front of the server
+	ProxyHops int `yaml:"proxy_hops"`
+}
+
+type Key struct {
+	Name   string   `yaml:"name"`
+	Key    string   `yaml:"key"`
+	Scopes []string `yaml:"scopes"`
+}
+
+// RateLimit limits the requests with a key by key, and the others by IP
+type RateLimit struct {
+	PerKey Rate `yaml:"per_key"`
+	PerIP  Rate `yaml:"per_ip"`
+}
+
+// Rate allows Burst requests at once, then Rate requests
+// per second. A Rate of 0 means no limit.
+type Rate struct {
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+}
+
+// minimum length of the keys given in the configuration
+const minKeyLength = 16
+
+type Log struct {
+	Level  string `yaml:"level"`
+	Format string `yaml:"format"`
+}
+
+// Default returns the configuration used when nothing overrides it
+func Default() *Config {
+	return &Config{
+		Server: Server{
+			Addr:              ":8080",
+			ShutdownTimeout:   30 * time.Second,
+			ReadTimeout:       time.Minute,
+			ReadHeaderTimeout: 10 * time.Second,
+			IdleTimeout:       2 * time.Minute,
+			CORS: CORS{
+				AllowedOrigins: []string{"*"},
+				AllowedMethods: []string{"POST", "GET", "OPTIONS", "PUT", "DELETE"},
+				AllowedHeaders: []string{"Content-Type", "Authorization", "X-API-Key", "X-Request-ID"},
+			},
+		},
+		Network: Network{
+			Dataset:      DatasetMNIST,
+			Registry:     "./data/registry",
+			DataDir:      "./data",
+			Hiddens:      200,
+			LearningRate: 0.1,
+			Epochs:       5,
+		},
+		Cache: Cache{
+			Backend: CacheAuto,
+			Redis: Redis{
+				Addr:        "redis:6379",
+				DialTimeout: 5 * time.Second,
+			},
+		},
+		Auth: Auth{
+			Anonymous: []string{"predict"},
+			RateLimit: RateLimit{
+				PerKey: Rate{Rate: 50, Burst: 100},
+				PerIP:  Rate{Rate: 10, Burst: 20},
+			},
+		},
+		Log: Log{
+			Level:  "info",
+			Format: "text",
+		},
+	}
+}
+
+// setting is a value that can be set from the
+// environment, the command line or both
+type setting struct {
+	env   string
+	flag  string
+	usage string
+	set   func(c *Config, v string) error
+}
+
+var settings = []setting{
+	{"SERVER_ADDR", "addr", "address to listen on", func(c *Config, v string) error {
+		c.Server.Addr = v
+		return nil
+	}},
+	{"SERVER_TIMEOUT", "shutdown-timeout", "time requests get to finish on shutdown, plain numbers are milliseconds", func(c *Config, v string) error {
+		return parseDuration(&c.Server.ShutdownTimeout, v)
+	}},
+	{"SERVER_READ_TIMEOUT", "read-timeout", "time to read a whole request", func(c *Config, v string) error {
+		return parseDuration(&c.Server.ReadTimeout, v)
+	}},
+	{"SERVER_WRITE_TIMEOUT", "write-timeout", "time to write a response, 0 for none", func(c *Config, v string) error {
+		return parseDuration(&c.Server.WriteTimeout, v)
+	}},
+	{"SERVER_IDLE_TIMEOUT", "idle-timeout", "time a keep-alive connection waits for the next request", func(c *Config, v string) error {
+		return parseDuration(&c.Server.IdleTimeout, v)
+	}},
+	{"CORS_ALLOWED_ORIGINS", "cors-origins", "comma separated origins allowed to call the API", func(c *Config, v string) error {
+		c.Server.CORS.AllowedOrigins = splitList(v)
+		return nil
+	}},
+	{"NETWORK_DATASET", "dataset", "dataset of the default model: mnist or cifar10", func(c *Config, v string) error {
+		c.Network.Dataset = v
+		return nil
+	}},
+	{"NETWORK_MODEL", "model", "registry model the routes without a name use, the dataset by default", func(c *Config, v string) error {
+		c.Network.Model = v
+		return nil
+	}},
+	{"MODEL_REGISTRY", "registry", "directory of the model registry", func(c *Config, v string) error {
+		c.Network.Registry = v
+		return nil
+	}},
+	{"NETWORK_DATA_DIR", "data-dir", "directory of the weights saved before the registry", func(c *Config, v string) error {
+		c.Network.DataDir = v
+		return nil
+	}},
+	{"NETWORK_HIDDENS", "hiddens", "neurons of the hidden layer of new networks", func(c *Config, v string) error {
+		return parseInt(&c.Network.Hiddens, v)
+	}},
+	{"NETWORK_LEARNING_RATE", "learning-rate", "learning rate of new networks", func(c *Config, v string) error {
+		return parseFloat(&c.Network.LearningRate, v)
+	}},
+	{"NETWORK_EPOCHS", "epochs", "epochs of the training jobs that do not say", func(c *Config, v string) error {
+		return parseInt(&c.Network.Epochs, v)
+	}},
+	{"CACHE_BACKEND", "cache", "cache backend: auto, redis or memory", func(c *Config, v string) error {
+		c.Cache.Backend = v
+		return nil
+	}},
+	{"REDIS_ADDR", "redis-addr", "address of the Redis cache", func(c *Config, v string) error {
+		c.Cache.Redis.Addr = v
+		return nil
+	}},
+	{"REDIS_PASSWORD", "", "", func(c *Config, v string) error {
+		c.Cache.Redis.Password = v
+		return nil
+	}},
+	{"REDIS_DB", "redis-db", "Redis database number", func(c *Config, v string) error {
+		return parseInt(&c.Cache.Redis.DB, v)
+	}},
+	{"REDIS_TTL", "redis-ttl", "how long predictions stay in Redis, 0 for ever", func(c *Config, v string) error {
+		return parseDuration(&c.Cache.Redis.TTL, v)
+	}},
+	{"API_KEYS_FILE", "keys-file", "file of hashed API keys", func(c *Config, v string) error {
+		c.Auth.KeysFile = v
+		return nil
+	}},
+	{"AUTH_ANONYMOUS", "anonymous", "comma separated scopes of requests without a key, none for no scope", func(c *Config, v string) error {
+		c.Auth.Anonymous = splitList(v)
+		if len(c.Auth.Anonymous) == 1 && c.Auth.Anonymous[0] == "none" {
+			c.Auth.Anonymous = nil
+		}
+		return nil
+	}},
+	{"LOG_LEVEL", "log-level", "log level: debug, info, warn or error", func(c *Config, v string) error {
+		c.Log.Level = v
+		return nil
+	}},
+	{"LOG_FORMAT", "log-format", "log format: text or json", func(c *Config, v string) error {
+		c.Log.Format = v
+		return nil
+	}},
+}
+
+// Load builds the configuration from the defaults, the YAML file named
+// by -config or NN_CONFIG, the environment and the command line
+// arguments, and validates the result.
+func Load(args []string) (*Config, error) {
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	file := fs.String("config", "", "YAML configuration file, $"+FileEnv+" by default")
+	for _, s := range settings {
+		if s.flag != "" {
+			fs.String(s.flag, "", s.usage+" ($"+s.env+")")
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	c := Default()
+	path := *file
+	if path == "" {
+		path = os.Getenv(FileEnv)
+	}
+	if path != "" {
+		if err := c.ReadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	var errs []error
+	for _, s := range settings {
+		if v, ok := os.LookupEnv(s.env); ok && v != "" {
+			if err := s.set(c, v); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", s.env, err))
+			}
+		}
+	}
+	fs.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if s.flag == f.Name {
+				if err := s.set(c, f.Value.String()); err != nil {
+					errs = append(errs, fmt.Errorf("-%s: %w", s.flag, err))
+				}
+			}
+		}
+	})
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return c, c.Validate()
+}
+
+// ReadFile reads a YAML file over the configuration. Keys the
+// configuration does not have are an error, to catch typos.
+func (c *Config) ReadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("cannot read the configuration file: %w", err)
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && err != io.EOF {
+		return fmt.Errorf("invalid configuration file %s: %w", path, err)
+	}
+	return nil
+}
+
+// Validate checks every value, and fills the
+// ones that default to another value
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	s := c.Server
+	check(s.Addr != "", "server.addr is required")
+	check(s.ShutdownTimeout > 0, "server.shutdown_timeout must be positive")
+	check(s.ReadTimeout >= 0 && s.ReadHeaderTimeout >= 0 && s.WriteTimeout >= 0 && s.IdleTimeout >= 0,
+		"server timeouts cannot be negative")
+	check(len(s.CORS.AllowedMethods) > 0, "server.cors.allowed_methods cannot be empty")
+
+	n := &c.Network
+	check(n.Dataset == DatasetMNIST || n.Dataset == DatasetCIFAR10,
+		"network.dataset must be %s or %s, got %q", DatasetMNIST, DatasetCIFAR10, n.Dataset)
+	if n.Model == "" {
+		n.Model = n.Dataset
+	}
+	check(registry.ValidName(n.Model), "network.model %q: %v", n.Model, registry.ErrInvalidName)
+	check(n.Registry != "", "network.registry is required")
+	check(n.DataDir != "", "network.data_dir is required")
+	check(n.Hiddens > 0, "network.hiddens must be positive, got %d", n.Hiddens)
+	check(n.LearningRate > 0 && n.LearningRate <= 1, "network.learning_rate must be in (0, 1], got %g", n.LearningRate)
+	check(n.Epochs > 0, "network.epochs must be positive, got %d", n.Epochs)
+
+	cache := c.Cache
+	check(cache.Backend == CacheAuto || cache.Backend == CacheRedis || cache.Backend == CacheMemory,
+		"cache.backend must be %s, %s or %s, got %q", CacheAuto, CacheRedis, CacheMemory, cache.Backend)
+	if cache.Backend != CacheMemory {
+		check(cache.Redis.Addr != "", "cache.redis.addr is required")
+		check(cache.Redis.DB >= 0, "cache.redis.db cannot be negative")
+		check(cache.Redis.DialTimeout > 0, "cache.redis.dial_timeout must be positive")
+		check(cache.Redis.TTL >= 0, "cache.redis.ttl cannot be negative")
+	}
+
+	a := c.Auth
+	_, err := auth.ParseScopes(a.Anonymous)
+	check(err == nil, "auth.anonymous: %v", err)
+	names := make(map[string]bool, len(a.Keys))
+	for i, k := range a.Keys {
+		check(k.Name != "", "auth.keys[%d] needs a name", i)
+		check(!names[k.Name], "auth.keys: two keys are named %s", k.Name)
+		names[k.Name] = true
+		check(len(k.Key) >= minKeyLength, "auth.keys: key %s must be at least %d characters", k.Name, minKeyLength)
+		scope, err := auth.ParseScopes(k.Scopes)
+		check(err == nil, "auth.keys: key %s: %v", k.Name, err)
+		check(err != nil || scope != auth.ScopeNone, "auth.keys: key %s has no scope", k.Name)
+	}
+	check(a.ProxyHops >= 0, "auth.proxy_hops cannot be negative, got %d", a.ProxyHops)
+	for _, r := range []struct {
+		name string
+		Rate
+	}{{"per_key", a.RateLimit.PerKey}, {"per_ip", a.RateLimit.PerIP}} {
+		check(r.Rate.Rate >= 0, "auth.rate_limit.%s.rate cannot be negative", r.name)
+		check(r.Rate.Rate == 0 || r.Burst >= 1, "auth.rate_limit.%s.burst must be at least 1", r.name)
+	}
+
+	_, err = logrus.ParseLevel(c.Log.Level)
+	check(err == nil, "log.level must be debug, info, warn or error, got %q", c.Log.Level)
+	check(c.Log.Format == "text" || c.Log.Format == "json", "log.format must be text or json, got %q", c.Log.Format)
+	return errors.Join(errs...)
+}
+
+// parseDuration reads a duration such as "30s", or a number of
+// milliseconds, as SERVER_TIMEOUT always was
+func parseDuration(d *time.Duration, v string) error {
+	if ms, err := strconv.Atoi(v); err == nil {
+		*d = time.Duration(ms) * time.Millisecond
+		return nil
+	}
+	parsed, err := time.ParseDuration(v)
+	if err != nil {
+		return err
+	}
+	*d = parsed
+	return nil
+}
+
+func parseInt(n *int, v string) error {
+	parsed, err := strconv.Atoi(v)
+	if err != nil {
+		return err
+	}
+	*n = parsed
+	return nil
+}
+
+func parseFloat(f *float64, v string) error {
+	parsed, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return err
+	}
+	*f = parsed
+	return nil
+}
+
+func splitList(v string) []string {
+	var list []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -0,0 +1,157 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoad(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		yaml string
+		env  map[string]string
+		args []string
+		// check looks at the loaded configuration, err is part of the
+		// error expected instead
+		check func(t *testing.T, c *Config)
+		err   string
+	}{
+		{
+			name: "defaults",
+			check: func(t *testing.T, c *Config) {
+				if c.Server.Addr != ":8080" || c.Server.ShutdownTimeout != 30*time.Second || c.Network.Hiddens != 200 {
+					t.Errorf("addr %q, shutdown timeout %v, hiddens %d, want :8080, 30s, 200",
+						c.Server.Addr, c.Server.ShutdownTimeout, c.Network.Hiddens)
+				}
+				// the model defaults to the dataset
+				if c.Network.Model != DatasetMNIST {
+					t.Errorf("model %q, want %s", c.Network.Model, DatasetMNIST)
+				}
+			},
+		},
+		{
+			name: "file over the defaults",
+			yaml: "server:\n  addr: \":9000\"\nnetwork:\n  hiddens: 50\n  dataset: cifar10\n",
+			check: func(t *testing.T, c *Config) {
+				if c.Server.Addr != ":9000" || c.Network.Hiddens != 50 || c.Network.Model != DatasetCIFAR10 {
+					t.Errorf("addr %q, hiddens %d, model %q, want :9000, 50, cifar10", c.Server.Addr, c.Network.Hiddens, c.Network.Model)
+				}
+				// what the file does not set keeps its default
+				if c.Network.Epochs != 5 || c.Log.Level != "info" {
+					t.Errorf("epochs %d, log level %q, want the defaults 5 and info", c.Network.Epochs, c.Log.Level)
+				}
+			},
+		},
+		{
+			name: "environment over the file",
+			yaml: "server:\n  addr: \":9000\"\nnetwork:\n  hiddens: 50\n",
+			env:  map[string]string{"SERVER_ADDR": ":9001", "AUTH_ANONYMOUS": "none"},
+			check: func(t *testing.T, c *Config) {
+				if c.Server.Addr != ":9001" || c.Network.Hiddens != 50 {
+					t.Errorf("addr %q, hiddens %d, want :9001, 50", c.Server.Addr, c.Network.Hiddens)
+				}
+				if c.Auth.Anonymous != nil {
+					t.Errorf("anonymous scopes %v, want none", c.Auth.Anonymous)
+				}
+			},
+		},
+		{
+			name: "flags over the environment",
+			yaml: "server:\n  addr: \":9000\"\n",
+			env:  map[string]string{"SERVER_ADDR": ":9001", "NETWORK_EPOCHS": "7"},
+			args: []string{"-addr", ":9002"},
+			check: func(t *testing.T, c *Config) {
+				if c.Server.Addr != ":9002" || c.Network.Epochs != 7 {
+					t.Errorf("addr %q, epochs %d, want :9002, 7", c.Server.Addr, c.Network.Epochs)
+				}
+			},
+		},
+		{
+			name: "file named by the environment",
+			env:  map[string]string{FileEnv: "from-env"},
+			yaml: "log:\n  format: json\n",
+			check: func(t *testing.T, c *Config) {
+				if c.Log.Format != "json" {
+					t.Errorf("log format %q, want json", c.Log.Format)
+				}
+			},
+		},
+		{
+			name: "plain SERVER_TIMEOUT is milliseconds",
+			env:  map[string]string{"SERVER_TIMEOUT": "1500"},
+			check: func(t *testing.T, c *Config) {
+				if c.Server.ShutdownTimeout != 1500*time.Millisecond {
+					t.Errorf("shutdown timeout %v, want 1.5s", c.Server.ShutdownTimeout)
+				}
+			},
+		},
+		{
+			name: "SERVER_TIMEOUT with a unit",
+			env:  map[string]string{"SERVER_TIMEOUT": "2m"},
+			check: func(t *testing.T, c *Config) {
+				if c.Server.ShutdownTimeout != 2*time.Minute {
+					t.Errorf("shutdown timeout %v, want 2m", c.Server.ShutdownTimeout)
+				}
+			},
+		},
+		{
+			name: "typo in the file",
+			yaml: "server:\n  adress: \":9000\"\n",
+			err:  "field adress not found",
+		},
+		{
+			name: "invalid environment value",
+			env:  map[string]string{"NETWORK_HIDDENS": "many"},
+			err:  "NETWORK_HIDDENS",
+		},
+		{
+			name: "invalid flag value",
+			args: []string{"-shutdown-timeout", "soon"},
+			err:  "-shutdown-timeout",
+		},
+		{
+			name: "invalid result",
+			args: []string{"-dataset", "imagenet"},
+			err:  `network.dataset must be mnist or cifar10, got "imagenet"`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// settings of the environment running the test are ignored,
+			// Load skips the empty ones
+			t.Setenv(FileEnv, "")
+			for _, s := range settings {
+				t.Setenv(s.env, "")
+			}
+			args := tc.args
+			if tc.yaml != "" {
+				path := filepath.Join(t.TempDir(), "config.yml")
+				if err := os.WriteFile(path, []byte(tc.yaml), 0o600); err != nil {
+					t.Fatal(err)
+				}
+				if tc.env[FileEnv] != "" {
+					tc.env[FileEnv] = path
+				} else {
+					args = append([]string{"-config", path}, args...)
+				}
+			}
+			for k, v := range tc.env {
+				t.Setenv(k, v)
+			}
+
+			c, err := Load(args)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("got error %v, want one with %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			tc.check(t, c)
+		})
+	}
+}
@@ -4,6 +4,7 @@ go 1.20
 
 require (
 	github.com/fehernandez12/sonate v0.0.0-20230816171504-3f64a49fb69f
+	github.com/felixge/httpsnoop v1.0.3
 	github.com/google/uuid v1.3.1
 	github.com/gorilla/handlers v1.5.2
 	github.com/redis/go-redis/v9 v9.1.0
@@ -16,7 +17,6 @@ require (
 require (
 	github.com/cespare/xxhash/v2 v2.2.0 // indirect
 	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
-	github.com/felixge/httpsnoop v1.0.3 // indirect
 	golang.org/x/exp v0.0.0-20230321023759-10a507213a29 // indirect
 	golang.org/x/sys v0.5.0 // indirect
 )
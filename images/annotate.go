@@ -0,0 +1,68 @@
+package images
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// Label is a box drawn over an image, with its text above it
+type Label struct {
+	Box  image.Rectangle
+	Text string
+}
+
+// annotation style
+var (
+	boxColor  = color.NRGBA{R: 0xe5, G: 0x39, B: 0x35, A: 0xff}
+	textColor = color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}
+)
+
+const boxWidth = 2
+
+// Annotate returns a copy of the image with every label drawn over it
+func Annotate(img image.Image, labels []Label) *image.NRGBA {
+	b := img.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Src)
+	face := basicfont.Face7x13
+	for _, label := range labels {
+		box := label.Box.Sub(b.Min)
+		for i := 0; i < boxWidth; i++ {
+			r := box.Inset(-i)
+			fill(dst, image.Rect(r.Min.X, r.Min.Y, r.Max.X, r.Min.Y+1), boxColor)
+			fill(dst, image.Rect(r.Min.X, r.Max.Y-1, r.Max.X, r.Max.Y), boxColor)
+			fill(dst, image.Rect(r.Min.X, r.Min.Y, r.Min.X+1, r.Max.Y), boxColor)
+			fill(dst, image.Rect(r.Max.X-1, r.Min.Y, r.Max.X, r.Max.Y), boxColor)
+		}
+		if label.Text == "" {
+			continue
+		}
+		// the text sits on a tag above the box, or inside
+		// it when the box touches the top of the image
+		width := font.MeasureString(face, label.Text).Ceil() + 4
+		height := face.Height + 2
+		top := box.Min.Y - boxWidth + 1 - height
+		if top < 0 {
+			top = box.Min.Y
+		}
+		tag := image.Rect(box.Min.X-boxWidth+1, top, box.Min.X-boxWidth+1+width, top+height)
+		fill(dst, tag, boxColor)
+		d := font.Drawer{
+			Dst:  dst,
+			Src:  image.NewUniform(textColor),
+			Face: face,
+			Dot:  fixed.P(tag.Min.X+2, tag.Min.Y+face.Ascent+1),
+		}
+		d.DrawString(label.Text)
+	}
+	return dst
+}
+
+func fill(dst draw.Image, r image.Rectangle, c color.Color) {
+	draw.Draw(dst, r.Intersect(dst.Bounds()), image.NewUniform(c), image.Point{}, draw.Src)
+}
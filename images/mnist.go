@@ -0,0 +1,288 @@
+package images
+
+import (
+	"image"
+	"math"
+)
+
+// The MNIST digits were size normalized to fit a 20 x 20 box, keeping
+// their aspect ratio, and then centered by center of mass in a 28 x 28
+// image.
+const (
+	MNISTSize    = 28
+	MNISTBoxSize = 20
+)
+
+// MNISTOptions controls how an arbitrary image is turned into an
+// MNIST-like digit.
+type MNISTOptions struct {
+	// InkIsDark is set when the digit is darker than the background,
+	// as with ink on paper. MNIST digits are light ink on black.
+	InkIsDark bool
+	// Binarize thresholds the image to pure black and white instead of
+	// keeping the anti-aliased gray levels of the strokes.
+	Binarize bool
+	// Threshold separates ink from background. Zero picks it
+	// automatically with Otsu's method.
+	Threshold uint8
+	// Deskew straightens slanted digits using the image moments.
+	Deskew bool
+}
+
+// DefaultMNISTOptions is used for dark digits on a light background,
+// which is what most scans and photos look like.
+var DefaultMNISTOptions = MNISTOptions{
+	InkIsDark: true,
+}
+
+// Grayscale converts the image to 8-bit luminance.
+// Transparent pixels are treated as white.
+func Grayscale(img image.Image) *image.Gray {
+	src := NewScanner(img)
+	dst := image.NewGray(image.Rect(0, 0, src.W(), src.H()))
+	Parallel(0, src.H(), func(ys <-chan int) {
+		row := make([]uint8, src.W()*4)
+		for y := range ys {
+			src.Scan(0, y, src.W(), y+1, row)
+			for x := 0; x < src.W(); x++ {
+				p := row[x*4 : x*4+4 : x*4+4]
+				a := float64(p[3]) / 255
+				lum := 0.299*float64(p[0]) + 0.587*float64(p[1]) + 0.114*float64(p[2])
+				dst.Pix[y*dst.Stride+x] = clamp(lum*a + 255*(1-a))
+			}
+		}
+	})
+	return dst
+}
+
+// PrepareMNIST turns an image of a single digit into a 28 x 28 gray
+// image with light ink on a black background, following the steps
+// used to build the MNIST dataset.
+func PrepareMNIST(img image.Image, opts MNISTOptions) *image.Gray {
+	return FitMNIST(CleanInk(img, opts), opts.Deskew)
+}
+
+// CleanInk turns an image into clean light ink on a black background
+func CleanInk(img image.Image, opts MNISTOptions) *image.Gray {
+	gray := Grayscale(img)
+	if opts.InkIsDark {
+		for i := range gray.Pix {
+			gray.Pix[i] = 255 - gray.Pix[i]
+		}
+	}
+	Clean(gray, opts.Threshold, opts.Binarize)
+	return gray
+}
+
+// Clean stretches the contrast of a light-ink image to the full range
+// and clears the background below the threshold. With binarize the ink
+// is set to pure white as well.
+func Clean(gray *image.Gray, threshold uint8, binarize bool) {
+	lo, hi := uint8(255), uint8(0)
+	for _, v := range gray.Pix {
+		if v < lo {
+			lo = v
+		}
+		if v > hi {
+			hi = v
+		}
+	}
+	if hi == lo {
+		for i := range gray.Pix {
+			gray.Pix[i] = 0
+		}
+		return
+	}
+	span := float64(hi - lo)
+	for i, v := range gray.Pix {
+		gray.Pix[i] = clamp(float64(v-lo) * 255 / span)
+	}
+	if threshold == 0 {
+		threshold = OtsuThreshold(gray)
+	}
+	for i, v := range gray.Pix {
+		switch {
+		case v <= threshold:
+			gray.Pix[i] = 0
+		case binarize:
+			gray.Pix[i] = 255
+		}
+	}
+}
+
+// FitMNIST crops a clean light-ink image to its ink, scales it to fit
+// the 20 x 20 box and centers it by center of mass in a 28 x 28 image.
+func FitMNIST(gray *image.Gray, deskew bool) *image.Gray {
+	dst := image.NewGray(image.Rect(0, 0, MNISTSize, MNISTSize))
+	box, ok := InkBounds(gray)
+	if !ok {
+		return dst
+	}
+	w, h := box.Dx(), box.Dy()
+	scale := float64(MNISTBoxSize) / math.Max(float64(w), float64(h))
+	sw := maxInt(1, int(math.Round(float64(w)*scale)))
+	sh := maxInt(1, int(math.Round(float64(h)*scale)))
+	digit := Grayscale(Resize(gray.SubImage(box), sw, sh))
+
+	cx, cy := centerOfMass(digit)
+	ox := int(math.Round(float64(MNISTSize)/2 - cx))
+	oy := int(math.Round(float64(MNISTSize)/2 - cy))
+	for y := 0; y < sh; y++ {
+		for x := 0; x < sw; x++ {
+			dx, dy := x+ox, y+oy
+			if dx < 0 || dy < 0 || dx >= MNISTSize || dy >= MNISTSize {
+				continue
+			}
+			dst.Pix[dy*dst.Stride+dx] = digit.Pix[y*digit.Stride+x]
+		}
+	}
+	if deskew {
+		return Deskew(dst)
+	}
+	return dst
+}
+
+// InkBounds returns the bounding box of the non-black pixels
+func InkBounds(gray *image.Gray) (image.Rectangle, bool) {
+	b := gray.Bounds()
+	minX, minY, maxX, maxY := b.Max.X, b.Max.Y, b.Min.X-1, b.Min.Y-1
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if gray.GrayAt(x, y).Y == 0 {
+				continue
+			}
+			if x < minX {
+				minX = x
+			}
+			if x > maxX {
+				maxX = x
+			}
+			if y < minY {
+				minY = y
+			}
+			if y > maxY {
+				maxY = y
+			}
+		}
+	}
+	if maxX < minX {
+		return image.Rectangle{}, false
+	}
+	return image.Rect(minX, minY, maxX+1, maxY+1), true
+}
+
+// Deskew removes the slant of a digit with an affine shear computed
+// from its second order moments, keeping the center of mass in place.
+func Deskew(gray *image.Gray) *image.Gray {
+	b := gray.Bounds()
+	cx, cy := centerOfMass(gray)
+	var mu11, mu02 float64
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			v := float64(gray.GrayAt(x, y).Y)
+			dy := float64(y-b.Min.Y) - cy
+			mu11 += (float64(x-b.Min.X) - cx) * dy * v
+			mu02 += dy * dy * v
+		}
+	}
+	dst := image.NewGray(image.Rect(0, 0, b.Dx(), b.Dy()))
+	if mu02 < 1e-2 {
+		copy(dst.Pix, gray.Pix)
+		return dst
+	}
+	skew := mu11 / mu02
+	for y := 0; y < b.Dy(); y++ {
+		shift := skew * (float64(y) - cy)
+		for x := 0; x < b.Dx(); x++ {
+			dst.Pix[y*dst.Stride+x] = sampleRow(gray, y, float64(x)+shift)
+		}
+	}
+	return dst
+}
+
+// OtsuThreshold picks the threshold that best separates the
+// histogram of the image into two classes
+func OtsuThreshold(gray *image.Gray) uint8 {
+	hist := Histogram(gray)
+	total := 0
+	sum := 0.0
+	for i, n := range hist {
+		total += n
+		sum += float64(i * n)
+	}
+	var sumB, best float64
+	var wB int
+	threshold := uint8(0)
+	for i, n := range hist {
+		wB += n
+		if wB == 0 {
+			continue
+		}
+		wF := total - wB
+		if wF == 0 {
+			break
+		}
+		sumB += float64(i * n)
+		mB := sumB / float64(wB)
+		mF := (sum - sumB) / float64(wF)
+		between := float64(wB) * float64(wF) * (mB - mF) * (mB - mF)
+		if between > best {
+			best = between
+			threshold = uint8(i)
+		}
+	}
+	return threshold
+}
+
+// Histogram counts the pixels of each gray level
+func Histogram(gray *image.Gray) [256]int {
+	var hist [256]int
+	b := gray.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			hist[gray.GrayAt(x, y).Y]++
+		}
+	}
+	return hist
+}
+
+// centerOfMass returns the intensity weighted centroid relative
+// to the top left corner of the image
+func centerOfMass(gray *image.Gray) (float64, float64) {
+	b := gray.Bounds()
+	var sx, sy, total float64
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			v := float64(gray.GrayAt(x, y).Y)
+			sx += float64(x-b.Min.X) * v
+			sy += float64(y-b.Min.Y) * v
+			total += v
+		}
+	}
+	if total == 0 {
+		return float64(b.Dx()) / 2, float64(b.Dy()) / 2
+	}
+	return sx / total, sy / total
+}
+
+// sampleRow linearly interpolates a row at a fractional x,
+// treating everything outside the image as black
+func sampleRow(gray *image.Gray, y int, x float64) uint8 {
+	b := gray.Bounds()
+	x0 := int(math.Floor(x))
+	f := x - float64(x0)
+	at := func(x int) float64 {
+		if x < 0 || x >= b.Dx() {
+			return 0
+		}
+		return float64(gray.Pix[y*gray.Stride+x])
+	}
+	return clamp(at(x0)*(1-f) + at(x0+1)*f)
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,166 @@
+package images
+
+import (
+	"image"
+	"math"
+	"testing"
+)
+
+// seven draws a 7: a bar on top and a stroke down its right end
+func seven(img *image.Gray, r image.Rectangle) {
+	bar(img, image.Rect(r.Min.X, r.Min.Y, r.Max.X, r.Min.Y+4))
+	bar(img, image.Rect(r.Max.X-4, r.Min.Y, r.Max.X, r.Max.Y))
+}
+
+// skew is the slant of the ink, in pixels of x per pixel of y
+func skew(gray *image.Gray) float64 {
+	cx, cy := centerOfMass(gray)
+	var mu11, mu02 float64
+	for y := 0; y < gray.Rect.Dy(); y++ {
+		for x := 0; x < gray.Rect.Dx(); x++ {
+			v := float64(gray.Pix[y*gray.Stride+x])
+			mu11 += (float64(x) - cx) * (float64(y) - cy) * v
+			mu02 += (float64(y) - cy) * (float64(y) - cy) * v
+		}
+	}
+	return mu11 / mu02
+}
+
+func TestPrepareMNIST(t *testing.T) {
+	// every digit is twice as long as it is wide
+	tests := []struct {
+		name string
+		box  image.Rectangle
+	}{
+		{"top left", image.Rect(2, 2, 22, 42)},
+		{"bottom right", image.Rect(70, 15, 90, 55)},
+		{"large", image.Rect(10, 0, 40, 60)},
+		{"wide zero", image.Rect(20, 10, 80, 40)},
+	}
+	var first *image.Gray
+	for _, tc := range tests {
+		img := page(100, 60)
+		if tc.name == "wide zero" {
+			ring(img, tc.box)
+		} else {
+			seven(img, tc.box)
+		}
+		got := PrepareMNIST(img, DefaultMNISTOptions)
+		if got.Rect != image.Rect(0, 0, MNISTSize, MNISTSize) {
+			t.Fatalf("%s: got a %v image, want 28x28", tc.name, got.Rect)
+		}
+		// the longest side fills the 20 x 20 box, keeping the aspect ratio
+		ink, ok := InkBounds(got)
+		if !ok {
+			t.Fatalf("%s: no ink left", tc.name)
+		}
+		long, short := ink.Dy(), ink.Dx()
+		if tc.box.Dx() > tc.box.Dy() {
+			long, short = short, long
+		}
+		if long != MNISTBoxSize || short != MNISTBoxSize/2 {
+			t.Errorf("%s: ink of %dx%d, want %d on the long side and %d on the other",
+				tc.name, ink.Dx(), ink.Dy(), MNISTBoxSize, MNISTBoxSize/2)
+		}
+		if cx, cy := centerOfMass(got); math.Abs(cx-14) > 0.5 || math.Abs(cy-14) > 0.5 {
+			t.Errorf("%s: center of mass at (%.2f, %.2f), want (14, 14)", tc.name, cx, cy)
+		}
+		// where a digit is in the photo makes no difference
+		if tc.box.Size() == tests[0].box.Size() {
+			if first == nil {
+				first = got
+			} else if string(got.Pix) != string(first.Pix) {
+				t.Errorf("%s: the same digit elsewhere gives another image", tc.name)
+			}
+		}
+	}
+
+	if got := PrepareMNIST(page(40, 40), DefaultMNISTOptions); got.Rect.Dx() != MNISTSize {
+		t.Errorf("a blank page gives a %v image", got.Rect)
+	} else if _, ok := InkBounds(got); ok {
+		t.Error("a blank page gives some ink")
+	}
+}
+
+func TestDeskew(t *testing.T) {
+	// a 1 leaning right by half a pixel per row
+	img := image.NewGray(image.Rect(0, 0, MNISTSize, MNISTSize))
+	for y := 4; y < 24; y++ {
+		left := 12 - int(math.Round(float64(y-14)/2))
+		for x := left; x < left+4; x++ {
+			img.Pix[y*img.Stride+x] = 255
+		}
+	}
+	if s := skew(img); math.Abs(s+0.5) > 0.05 {
+		t.Fatalf("the test digit has a skew of %.3f, want -0.5", s)
+	}
+	cx, cy := centerOfMass(img)
+
+	got := Deskew(img)
+	if s := skew(got); math.Abs(s) > 0.05 {
+		t.Errorf("skew of %.3f after Deskew, want 0", s)
+	}
+	if gx, gy := centerOfMass(got); math.Abs(gx-cx) > 0.25 || math.Abs(gy-cy) > 0.25 {
+		t.Errorf("center of mass moved from (%.2f, %.2f) to (%.2f, %.2f)", cx, cy, gx, gy)
+	}
+	// every row of the straightened stroke is centered on the same column
+	for y := 4; y < 24; y++ {
+		var sx, total float64
+		for x := 0; x < MNISTSize; x++ {
+			v := float64(got.Pix[y*got.Stride+x])
+			sx += float64(x) * v
+			total += v
+		}
+		if row := sx / total; math.Abs(row-cx) > 0.5 {
+			t.Errorf("row %d is centered on %.2f, want %.2f", y, row, cx)
+		}
+	}
+
+	// with the option the prepared digit is straight and still centered
+	slanted := page(60, 60)
+	for y := 10; y < 50; y++ {
+		left := 26 + (y-30)/2
+		bar(slanted, image.Rect(left, y, left+6, y+1))
+	}
+	opts := DefaultMNISTOptions
+	opts.Deskew = true
+	prepared := PrepareMNIST(slanted, opts)
+	if s := skew(prepared); math.Abs(s) > 0.05 {
+		t.Errorf("skew of %.3f after PrepareMNIST with Deskew, want 0", s)
+	}
+	if cx, cy := centerOfMass(prepared); math.Abs(cx-14) > 0.5 || math.Abs(cy-14) > 0.5 {
+		t.Errorf("deskewed digit centered at (%.2f, %.2f), want (14, 14)", cx, cy)
+	}
+}
+
+func TestOtsuThreshold(t *testing.T) {
+	tests := []struct {
+		name       string
+		levels     []uint8
+		low, below uint8
+	}{
+		// any threshold from the dark level to below the light one splits them
+		{"two levels", []uint8{60, 200}, 60, 200},
+		{"noisy levels", []uint8{45, 50, 55, 190, 200, 210}, 55, 190},
+		{"mostly background", []uint8{0, 0, 0, 0, 0, 0, 0, 255}, 0, 255},
+	}
+	for _, tc := range tests {
+		img := image.NewGray(image.Rect(0, 0, len(tc.levels), 10))
+		for y := 0; y < 10; y++ {
+			copy(img.Pix[y*img.Stride:], tc.levels)
+		}
+		got := OtsuThreshold(img)
+		if got < tc.low || got >= tc.below {
+			t.Errorf("%s: threshold %d, want at least %d and below %d", tc.name, got, tc.low, tc.below)
+		}
+		// only the light levels are above the threshold
+		for _, v := range tc.levels {
+			if (v > got) != (v >= tc.below) {
+				t.Errorf("%s: threshold %d puts level %d on the wrong side", tc.name, got, v)
+			}
+		}
+	}
+	if got := OtsuThreshold(image.NewGray(image.Rect(0, 0, 4, 4))); got != 0 {
+		t.Errorf("a uniform image has a threshold of %d, want 0", got)
+	}
+}
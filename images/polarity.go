@@ -0,0 +1,95 @@
+package images
+
+import (
+	"image"
+	"math"
+)
+
+// Polarity tells whether the ink of an image is darker or lighter
+// than its background.
+type Polarity int
+
+const (
+	// DarkInk is a dark digit on a light background, like ink on paper
+	DarkInk Polarity = iota
+	// LightInk is a light digit on a dark background, like MNIST
+	LightInk
+)
+
+func (p Polarity) String() string {
+	if p == LightInk {
+		return "light_on_dark"
+	}
+	return "dark_on_light"
+}
+
+// a border whose gray levels spread less than this is
+// considered plain background
+const uniformBorder = 32.0
+
+// DetectPolarity guesses the polarity of an image from two clues: the
+// border pixels, which are almost always background, and the gray level
+// histogram, where the background is the larger of the two classes
+// separated by Otsu's threshold. When they disagree the border wins if it
+// is uniform, otherwise the histogram does.
+func DetectPolarity(img image.Image) Polarity {
+	gray := Grayscale(img)
+	b := gray.Bounds()
+	if b.Empty() {
+		return DarkInk
+	}
+	threshold := float64(OtsuThreshold(gray))
+
+	hist := Histogram(gray)
+	var light, dark int
+	for i, n := range hist {
+		if float64(i) > threshold {
+			light += n
+		} else {
+			dark += n
+		}
+	}
+	histogram := DarkInk
+	if dark > light {
+		histogram = LightInk
+	}
+
+	mean, stddev := borderStats(gray)
+	border := DarkInk
+	if mean <= threshold {
+		border = LightInk
+	}
+
+	if border == histogram || stddev < uniformBorder {
+		return border
+	}
+	return histogram
+}
+
+// borderStats returns the mean and standard deviation of a frame
+// one tenth of the image wide around its edges
+func borderStats(gray *image.Gray) (float64, float64) {
+	b := gray.Bounds()
+	width := maxInt(1, minInt(b.Dx(), b.Dy())/10)
+	var sum, sq, n float64
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if x >= b.Min.X+width && x < b.Max.X-width && y >= b.Min.Y+width && y < b.Max.Y-width {
+				continue
+			}
+			v := float64(gray.GrayAt(x, y).Y)
+			sum += v
+			sq += v * v
+			n++
+		}
+	}
+	mean := sum / n
+	return mean, math.Sqrt(math.Max(0, sq/n-mean*mean))
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,67 @@
+package images
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+// negative swaps the ink and the background of an image
+func negative(img *image.Gray) *image.Gray {
+	out := image.NewGray(img.Bounds())
+	for i, v := range img.Pix {
+		out.Pix[i] = 255 - v
+	}
+	return out
+}
+
+func TestDetectPolarity(t *testing.T) {
+	zero := page(28, 28)
+	ring(zero, image.Rect(8, 4, 20, 24))
+	// a zero from the top to the bottom edge, and a one across the
+	// whole image, so ink lies on the border
+	tall := page(28, 28)
+	ring(tall, image.Rect(6, 0, 22, 28))
+	one := page(28, 28)
+	bar(one, image.Rect(10, 0, 18, 28))
+	// a bold digit with more ink than paper,
+	// only the plain border tells the background
+	bold := page(28, 28)
+	bar(bold, image.Rect(3, 3, 25, 25))
+	draw.Draw(bold, image.Rect(12, 8, 16, 20), image.White, image.Point{}, draw.Src)
+	uniform := func(c color.Color) *image.Gray {
+		img := image.NewGray(image.Rect(0, 0, 28, 28))
+		draw.Draw(img, img.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+		return img
+	}
+	paper := image.NewNRGBA(image.Rect(0, 0, 28, 28))
+	draw.Draw(paper, paper.Bounds(), image.NewUniform(color.NRGBA{250, 240, 200, 255}), image.Point{}, draw.Src)
+	draw.Draw(paper, image.Rect(10, 4, 18, 24), image.NewUniform(color.NRGBA{20, 30, 120, 255}), image.Point{}, draw.Src)
+
+	tests := []struct {
+		name string
+		img  image.Image
+		want Polarity
+	}{
+		{"dark on light", zero, DarkInk},
+		{"light on dark", negative(zero), LightInk},
+		{"dark digit touching the border", tall, DarkInk},
+		{"light digit touching the border", negative(tall), LightInk},
+		{"dark one across the image", one, DarkInk},
+		{"light one across the image", negative(one), LightInk},
+		{"bold dark digit", bold, DarkInk},
+		{"bold light digit", negative(bold), LightInk},
+		{"blue ink on yellow paper", paper, DarkInk},
+		{"uniform white", uniform(color.White), DarkInk},
+		{"uniform black", uniform(color.Black), LightInk},
+		{"empty", image.NewGray(image.Rectangle{}), DarkInk},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DetectPolarity(tt.img); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package images
+
+import (
+	"image"
+	"math"
+)
+
+// Resize scales the image to width x height using area averaging.
+// Every destination pixel is the alpha-weighted mean of the source
+// pixels it covers, which keeps thin strokes visible when shrinking.
+func Resize(img image.Image, width, height int) *image.NRGBA {
+	if width <= 0 || height <= 0 {
+		return &image.NRGBA{}
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	src := NewScanner(img)
+	if src.W() == 0 || src.H() == 0 {
+		return dst
+	}
+	pix := make([]uint8, src.W()*src.H()*4)
+	src.Scan(0, 0, src.W(), src.H(), pix)
+
+	sx := float64(src.W()) / float64(width)
+	sy := float64(src.H()) / float64(height)
+	Parallel(0, height, func(ys <-chan int) {
+		for y := range ys {
+			y0 := float64(y) * sy
+			y1 := y0 + sy
+			for x := 0; x < width; x++ {
+				x0 := float64(x) * sx
+				x1 := x0 + sx
+				var r, g, b, a, area float64
+				for iy := int(y0); iy < src.H() && float64(iy) < y1; iy++ {
+					wy := math.Min(y1, float64(iy+1)) - math.Max(y0, float64(iy))
+					for ix := int(x0); ix < src.W() && float64(ix) < x1; ix++ {
+						wx := math.Min(x1, float64(ix+1)) - math.Max(x0, float64(ix))
+						w := wx * wy
+						i := (iy*src.W() + ix) * 4
+						pa := float64(pix[i+3]) * w
+						r += float64(pix[i]) * pa
+						g += float64(pix[i+1]) * pa
+						b += float64(pix[i+2]) * pa
+						a += pa
+						area += w
+					}
+				}
+				i := y*dst.Stride + x*4
+				d := dst.Pix[i : i+4 : i+4]
+				if a > 0 {
+					d[0] = clamp(r / a)
+					d[1] = clamp(g / a)
+					d[2] = clamp(b / a)
+				}
+				if area > 0 {
+					d[3] = clamp(a / area)
+				}
+			}
+		}
+	})
+	return dst
+}
+
+func clamp(v float64) uint8 {
+	v = math.Round(v)
+	if v < 0 {
+		return 0
+	}
+	if v > 255 {
+		return 255
+	}
+	return uint8(v)
+}
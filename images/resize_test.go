@@ -0,0 +1,49 @@
+package images
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestResize(t *testing.T) {
+	// 4 x 2 gray levels, every destination pixel averages a 2 x 2 block
+	src := image.NewGray(image.Rect(0, 0, 4, 2))
+	copy(src.Pix, []uint8{
+		0, 100, 200, 200,
+		100, 200, 40, 60,
+	})
+	got := Resize(src, 2, 1)
+	if want := []uint8{100, 100, 100, 255, 125, 125, 125, 255}; string(got.Pix) != string(want) {
+		t.Errorf("shrunk to %v, want %v", got.Pix, want)
+	}
+
+	// growing repeats every pixel
+	got = Resize(src, 8, 4)
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 8; x++ {
+			if v, want := got.NRGBAAt(x, y).R, src.GrayAt(x/2, y/2).Y; v != want {
+				t.Errorf("grown pixel (%d, %d) is %d, want %d", x, y, v, want)
+			}
+		}
+	}
+
+	// shrinking 3 pixels to 1 averages all of them
+	src = image.NewGray(image.Rect(0, 0, 3, 1))
+	copy(src.Pix, []uint8{30, 90, 90})
+	if got := Resize(src, 1, 1).Pix[0]; got != 70 {
+		t.Errorf("a 3 to 1 shrink gives %d, want 70", got)
+	}
+
+	// transparent pixels do not bleed their color into the average
+	rgba := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	rgba.SetNRGBA(0, 0, color.NRGBA{200, 0, 0, 255})
+	rgba.SetNRGBA(1, 0, color.NRGBA{0, 200, 0, 0})
+	if got := Resize(rgba, 1, 1).NRGBAAt(0, 0); got != (color.NRGBA{200, 0, 0, 128}) {
+		t.Errorf("half transparent average %v, want {200 0 0 128}", got)
+	}
+
+	if got := Resize(src, 0, 4); got.Rect.Dx() != 0 {
+		t.Errorf("a zero width gives a %v image", got.Rect)
+	}
+}
@@ -0,0 +1,273 @@
+package images
+
+import (
+	"image"
+	"sort"
+)
+
+// Segmentation tuning. Handwritten digits are about as wide as they are
+// tall at most, so a blob wider than maxDigitAspect times its height is
+// taken for touching digits and split where the vertical projection is
+// thinnest. With at least medianBlobs blobs to compare with, a blob wider
+// than maxDigitWidth times their median width is split as well, which
+// catches touching pairs of narrow digits without cutting a wide 0.
+const (
+	maxDigitAspect = 1.5
+	maxDigitWidth  = 1.5
+	medianBlobs    = 3
+	// the split is searched in the middle of the blob,
+	// never closer to the edges than this fraction
+	splitMargin = 0.25
+	// blobs overlapping horizontally by this fraction of the
+	// narrower one are parts of the same digit, like a broken 5
+	mergeOverlap = 0.5
+	// blobs smaller than this fraction of the largest one, and
+	// shorter than noiseHeight of the tallest one, are noise
+	noiseArea   = 0.05
+	noiseHeight = 0.25
+)
+
+// Segment is one digit found in an image
+type Segment struct {
+	// Bounds is the box of the digit in the original image
+	Bounds image.Rectangle
+	// Image is the digit prepared like an MNIST sample
+	Image *image.Gray
+}
+
+// blob is a set of connected components, optionally
+// clipped to a range of columns after a split
+type blob struct {
+	labels     map[int]bool
+	minX, maxX int
+	bounds     image.Rectangle
+	area       int
+}
+
+// SegmentDigits splits an image of a number into its digits, ordered
+// from left to right. Digits are found as connected components of ink;
+// components stacked on top of each other are merged, and components
+// too wide to be a single digit are split using the projection profile.
+func SegmentDigits(img image.Image, opts MNISTOptions) []Segment {
+	gray := CleanInk(img, opts)
+	labels, boxes, areas := labelComponents(gray)
+	blobs := make([]*blob, len(boxes))
+	for i := range blobs {
+		blobs[i] = &blob{
+			labels: map[int]bool{i + 1: true},
+			maxX:   gray.Rect.Dx(),
+			bounds: boxes[i],
+			area:   areas[i],
+		}
+	}
+	blobs = dropNoise(blobs)
+	blobs = mergeStacked(blobs)
+
+	width := 0
+	if len(blobs) >= medianBlobs {
+		width = medianWidth(blobs)
+	}
+	var digits []*blob
+	for _, b := range blobs {
+		digits = append(digits, splitTouching(b, gray, labels, width)...)
+	}
+	sort.Slice(digits, func(i, j int) bool {
+		return digits[i].bounds.Min.X < digits[j].bounds.Min.X
+	})
+
+	segments := make([]Segment, 0, len(digits))
+	for _, d := range digits {
+		segments = append(segments, Segment{
+			Bounds: d.bounds.Add(img.Bounds().Min),
+			Image:  FitMNIST(d.mask(gray, labels), opts.Deskew),
+		})
+	}
+	return segments
+}
+
+// labelComponents labels the 8-connected regions of ink, starting at 1,
+// and returns the box and the pixel count of every region. Background
+// pixels are labeled 0.
+func labelComponents(gray *image.Gray) ([]int, []image.Rectangle, []int) {
+	w, h := gray.Rect.Dx(), gray.Rect.Dy()
+	labels := make([]int, w*h)
+	var boxes []image.Rectangle
+	var areas []int
+	var stack []int
+	for start := range labels {
+		if labels[start] != 0 || gray.Pix[(start/w)*gray.Stride+start%w] == 0 {
+			continue
+		}
+		count := len(boxes) + 1
+		box := image.Rect(start%w, start/w, start%w+1, start/w+1)
+		area := 0
+		labels[start] = count
+		stack = append(stack[:0], start)
+		for len(stack) > 0 {
+			p := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			px, py := p%w, p/w
+			area++
+			box = box.Union(image.Rect(px, py, px+1, py+1))
+			for dy := -1; dy <= 1; dy++ {
+				for dx := -1; dx <= 1; dx++ {
+					x, y := px+dx, py+dy
+					if x < 0 || y < 0 || x >= w || y >= h {
+						continue
+					}
+					q := y*w + x
+					if labels[q] == 0 && gray.Pix[y*gray.Stride+x] != 0 {
+						labels[q] = count
+						stack = append(stack, q)
+					}
+				}
+			}
+		}
+		boxes = append(boxes, box)
+		areas = append(areas, area)
+	}
+	return labels, boxes, areas
+}
+
+func (b *blob) contains(labels []int, w, x, y int) bool {
+	return x >= b.minX && x < b.maxX && b.labels[labels[y*w+x]]
+}
+
+// measure computes the bounds and the area of the blob after a split,
+// looking only inside the bounds it had before
+func (b *blob) measure(gray *image.Gray, labels []int) {
+	w := gray.Rect.Dx()
+	region := b.bounds
+	minX, minY, maxX, maxY := region.Max.X, region.Max.Y, -1, -1
+	b.area = 0
+	for y := region.Min.Y; y < region.Max.Y; y++ {
+		for x := maxInt(region.Min.X, b.minX); x < minInt(region.Max.X, b.maxX); x++ {
+			if !b.contains(labels, w, x, y) {
+				continue
+			}
+			b.area++
+			minX, maxX = minInt(minX, x), maxInt(maxX, x)
+			minY, maxY = minInt(minY, y), maxInt(maxY, y)
+		}
+	}
+	if b.area == 0 {
+		b.bounds = image.Rectangle{}
+		return
+	}
+	b.bounds = image.Rect(minX, minY, maxX+1, maxY+1)
+}
+
+// mask copies the ink of the blob, leaving out
+// pieces of other digits that share its box
+func (b *blob) mask(gray *image.Gray, labels []int) *image.Gray {
+	w := gray.Rect.Dx()
+	dst := image.NewGray(image.Rect(0, 0, b.bounds.Dx(), b.bounds.Dy()))
+	for y := b.bounds.Min.Y; y < b.bounds.Max.Y; y++ {
+		for x := b.bounds.Min.X; x < b.bounds.Max.X; x++ {
+			if b.contains(labels, w, x, y) {
+				dst.Pix[(y-b.bounds.Min.Y)*dst.Stride+x-b.bounds.Min.X] = gray.Pix[y*gray.Stride+x]
+			}
+		}
+	}
+	return dst
+}
+
+func dropNoise(blobs []*blob) []*blob {
+	maxArea, maxHeight := 0, 0
+	for _, b := range blobs {
+		maxArea = maxInt(maxArea, b.area)
+		maxHeight = maxInt(maxHeight, b.bounds.Dy())
+	}
+	kept := blobs[:0]
+	for _, b := range blobs {
+		if float64(b.area) < noiseArea*float64(maxArea) && float64(b.bounds.Dy()) < noiseHeight*float64(maxHeight) {
+			continue
+		}
+		kept = append(kept, b)
+	}
+	return kept
+}
+
+// mergeStacked joins blobs that share most of their columns
+func mergeStacked(blobs []*blob) []*blob {
+	for merged := true; merged; {
+		merged = false
+		for i := 0; i < len(blobs) && !merged; i++ {
+			for j := i + 1; j < len(blobs); j++ {
+				a, b := blobs[i], blobs[j]
+				overlap := minInt(a.bounds.Max.X, b.bounds.Max.X) - maxInt(a.bounds.Min.X, b.bounds.Min.X)
+				narrow := minInt(a.bounds.Dx(), b.bounds.Dx())
+				if narrow == 0 || float64(overlap) < mergeOverlap*float64(narrow) {
+					continue
+				}
+				for l := range b.labels {
+					a.labels[l] = true
+				}
+				a.bounds = a.bounds.Union(b.bounds)
+				a.area += b.area
+				blobs = append(blobs[:j], blobs[j+1:]...)
+				merged = true
+				break
+			}
+		}
+	}
+	return blobs
+}
+
+// medianWidth is the median width of the blobs
+func medianWidth(blobs []*blob) int {
+	widths := make([]int, len(blobs))
+	for i, b := range blobs {
+		widths[i] = b.bounds.Dx()
+	}
+	sort.Ints(widths)
+	return widths[len(widths)/2]
+}
+
+// tooWide tells whether a blob is too wide to be a single digit, for
+// its height or next to digits of the given width when it is not zero
+func (b *blob) tooWide(width int) bool {
+	bw, bh := b.bounds.Dx(), b.bounds.Dy()
+	if bh == 0 {
+		return false
+	}
+	return float64(bw) > maxDigitAspect*float64(bh) || (width > 0 && float64(bw) > maxDigitWidth*float64(width))
+}
+
+// splitTouching cuts a blob that is too wide for a single digit at the
+// column with the least ink, and keeps splitting the halves
+func splitTouching(b *blob, gray *image.Gray, labels []int, width int) []*blob {
+	w := gray.Rect.Dx()
+	bw := b.bounds.Dx()
+	if !b.tooWide(width) {
+		return []*blob{b}
+	}
+	from := b.bounds.Min.X + int(splitMargin*float64(bw))
+	to := b.bounds.Max.X - int(splitMargin*float64(bw))
+	cut, least := -1, -1
+	for x := from; x < to; x++ {
+		ink := 0
+		for y := b.bounds.Min.Y; y < b.bounds.Max.Y; y++ {
+			if b.contains(labels, w, x, y) {
+				ink += int(gray.Pix[y*gray.Stride+x])
+			}
+		}
+		if least < 0 || ink < least {
+			cut, least = x, ink
+		}
+	}
+	if cut < 0 {
+		return []*blob{b}
+	}
+	left := &blob{labels: b.labels, minX: b.minX, maxX: cut, bounds: b.bounds}
+	right := &blob{labels: b.labels, minX: cut, maxX: b.maxX, bounds: b.bounds}
+	left.measure(gray, labels)
+	right.measure(gray, labels)
+	var parts []*blob
+	for _, part := range []*blob{left, right} {
+		if part.area > 0 {
+			parts = append(parts, splitTouching(part, gray, labels, width)...)
+		}
+	}
+	return parts
+}
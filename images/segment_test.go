@@ -0,0 +1,103 @@
+package images
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+// page is a white image to draw digits on in black
+func page(w, h int) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+	return img
+}
+
+func bar(img *image.Gray, r image.Rectangle) {
+	draw.Draw(img, r, image.NewUniform(color.Black), image.Point{}, draw.Src)
+}
+
+// ring draws a 0 with strokes 4 pixels thick
+func ring(img *image.Gray, r image.Rectangle) {
+	bar(img, r)
+	draw.Draw(img, r.Inset(4), image.White, image.Point{}, draw.Src)
+}
+
+func TestSegmentDigits(t *testing.T) {
+	tests := []struct {
+		name  string
+		draw  func(img *image.Gray)
+		boxes []image.Rectangle
+	}{
+		{
+			name: "wide zero",
+			draw: func(img *image.Gray) {
+				ring(img, image.Rect(10, 6, 50, 34))
+			},
+			boxes: []image.Rectangle{image.Rect(10, 6, 50, 34)},
+		},
+		{
+			name: "wide zero after a one",
+			draw: func(img *image.Gray) {
+				bar(img, image.Rect(4, 6, 8, 34))
+				ring(img, image.Rect(14, 6, 54, 34))
+			},
+			boxes: []image.Rectangle{image.Rect(4, 6, 8, 34), image.Rect(14, 6, 54, 34)},
+		},
+		{
+			name: "five digits",
+			draw: func(img *image.Gray) {
+				for i := 0; i < 5; i++ {
+					ring(img, image.Rect(4+i*22, 6, 20+i*22, 34))
+				}
+			},
+			boxes: []image.Rectangle{
+				image.Rect(4, 6, 20, 34), image.Rect(26, 6, 42, 34), image.Rect(48, 6, 64, 34),
+				image.Rect(70, 6, 86, 34), image.Rect(92, 6, 108, 34),
+			},
+		},
+		{
+			name: "five digits, two touching",
+			draw: func(img *image.Gray) {
+				for _, x := range []int{4, 26, 48, 66, 88} {
+					ring(img, image.Rect(x, 6, x+16, 34))
+				}
+				bar(img, image.Rect(64, 18, 66, 22))
+			},
+			boxes: []image.Rectangle{
+				image.Rect(4, 6, 20, 34), image.Rect(26, 6, 42, 34), image.Rect(48, 6, 64, 34),
+				image.Rect(64, 6, 82, 34), image.Rect(88, 6, 104, 34),
+			},
+		},
+	}
+	for _, tt := range tests {
+		img := page(120, 40)
+		tt.draw(img)
+		segments := SegmentDigits(img, DefaultMNISTOptions)
+		if len(segments) != len(tt.boxes) {
+			t.Errorf("%s: got %d digits, want %d", tt.name, len(segments), len(tt.boxes))
+			continue
+		}
+		for i, s := range segments {
+			if !near(s.Bounds, tt.boxes[i], 2) {
+				t.Errorf("%s: digit %d is at %v, want %v", tt.name, i, s.Bounds, tt.boxes[i])
+			}
+			if s.Image.Rect.Dx() != 28 || s.Image.Rect.Dy() != 28 {
+				t.Errorf("%s: digit %d is %v, want 28x28", tt.name, i, s.Image.Rect.Size())
+			}
+		}
+	}
+}
+
+// near tells whether the edges of two boxes are at most d pixels apart
+func near(a, b image.Rectangle, d int) bool {
+	abs := func(v int) int {
+		if v < 0 {
+			return -v
+		}
+		return v
+	}
+	return abs(a.Min.X-b.Min.X) <= d && abs(a.Min.Y-b.Min.Y) <= d &&
+		abs(a.Max.X-b.Max.X) <= d && abs(a.Max.Y-b.Max.Y) <= d
+}
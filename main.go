@@ -9,7 +9,7 @@ import (
 
 func main() {
 	fmt.Println("Starting the Neural Network server...")
-	if err := server.StartServer(); err != nil {
+	if err := server.StartServer(os.Args[1:]); err != nil {
 		log.Fatalf("Error starting server: %v", err)
 		os.Exit(1)
 	}
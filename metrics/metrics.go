@@ -0,0 +1,270 @@
+// Package metrics keeps counters, gauges and histograms and writes them
+// in the Prometheus text exposition format, so the server can be scraped
+// without a client library.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContentType is the content type of the text exposition format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefaultBuckets are latency buckets in seconds, from 5ms to 10s
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Default is the registry the package level constructors register with
+var Default = NewRegistry()
+
+// Registry is a set of metrics written together
+type Registry struct {
+	mu       sync.Mutex
+	families []family
+}
+
+type family interface {
+	write(w *bufio.Writer)
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(f family) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.families = append(r.families, f)
+}
+
+// Write writes every metric of the registry, in the order they were created
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	families := append([]family(nil), r.families...)
+	r.mu.Unlock()
+	bw := bufio.NewWriter(w)
+	for _, f := range families {
+		f.write(bw)
+	}
+	return bw.Flush()
+}
+
+// vec holds the series of a metric by their label values
+type vec struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+
+	mu     sync.Mutex
+	series map[string][]string
+}
+
+func newVec(name, help, kind string, labels []string) vec {
+	return vec{name: name, help: help, kind: kind, labels: labels, series: make(map[string][]string)}
+}
+
+// key returns the key of the series with the given label values,
+// and whether it is new. It must be called with the lock held.
+func (v *vec) key(values []string) (string, bool) {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s has %d labels, got %d values", v.name, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	_, ok := v.series[key]
+	if !ok {
+		v.series[key] = append([]string(nil), values...)
+	}
+	return key, !ok
+}
+
+// keys returns the keys of every series, sorted so the output is stable.
+// It must be called with the lock held.
+func (v *vec) keys() []string {
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (v *vec) header(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", v.name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(v.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", v.name, v.kind)
+}
+
+// sample writes one line, with the labels of the series and extra ones
+func (v *vec) sample(w *bufio.Writer, name, key string, extra []string, value float64) {
+	w.WriteString(name)
+	pairs := make([]string, 0, len(v.labels)+len(extra)/2)
+	for i, l := range v.labels {
+		pairs = append(pairs, l+`="`+escape(v.series[key][i])+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+escape(extra[i+1])+`"`)
+	}
+	if len(pairs) > 0 {
+		w.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+	w.WriteString(" " + formatFloat(value) + "\n")
+}
+
+func escape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// CounterVec is a value that only goes up, one per set of label values
+type CounterVec struct {
+	vec
+	values map[string]float64
+}
+
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{vec: newVec(name, help, "counter", labels), values: make(map[string]float64)}
+	r.register(c)
+	return c
+}
+
+// NewCounterVec creates a counter in the default registry
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return Default.NewCounterVec(name, help, labels...)
+}
+
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+func (c *CounterVec) Add(n float64, values ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key, _ := c.key(values)
+	c.values[key] += n
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.header(w)
+	for _, key := range c.keys() {
+		c.sample(w, c.name, key, nil, c.values[key])
+	}
+}
+
+// GaugeVec is a value that can go up and down, one per set of label values
+type GaugeVec struct {
+	vec
+	values map[string]float64
+}
+
+func (r *Registry) NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{vec: newVec(name, help, "gauge", labels), values: make(map[string]float64)}
+	r.register(g)
+	return g
+}
+
+// NewGaugeVec creates a gauge in the default registry
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return Default.NewGaugeVec(name, help, labels...)
+}
+
+func (g *GaugeVec) Set(v float64, values ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	key, _ := g.key(values)
+	g.values[key] = v
+}
+
+func (g *GaugeVec) Add(n float64, values ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	key, _ := g.key(values)
+	g.values[key] += n
+}
+
+func (g *GaugeVec) write(w *bufio.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.header(w)
+	for _, key := range g.keys() {
+		g.sample(w, g.name, key, nil, g.values[key])
+	}
+}
+
+// HistogramVec counts observations in buckets, one histogram per set of
+// label values. Buckets are the upper bounds, in increasing order.
+type HistogramVec struct {
+	vec
+	buckets []float64
+	values  map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{
+		vec:     newVec(name, help, "histogram", labels),
+		buckets: buckets,
+		values:  make(map[string]*histogram),
+	}
+	r.register(h)
+	return h
+}
+
+// NewHistogramVec creates a histogram in the default registry
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return Default.NewHistogramVec(name, help, buckets, labels...)
+}
+
+func (h *HistogramVec) Observe(v float64, values ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key, created := h.key(values)
+	if created {
+		h.values[key] = &histogram{counts: make([]uint64, len(h.buckets))}
+	}
+	hist := h.values[key]
+	// buckets are cumulative, an observation counts in every bucket it fits
+	for i, upper := range h.buckets {
+		if v <= upper {
+			hist.counts[i]++
+		}
+	}
+	hist.count++
+	hist.sum += v
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.header(w)
+	for _, key := range h.keys() {
+		hist := h.values[key]
+		for i, upper := range h.buckets {
+			h.sample(w, h.name+"_bucket", key, []string{"le", formatFloat(upper)}, float64(hist.counts[i]))
+		}
+		h.sample(w, h.name+"_bucket", key, []string{"le", "+Inf"}, float64(hist.count))
+		h.sample(w, h.name+"_sum", key, nil, hist.sum)
+		h.sample(w, h.name+"_count", key, nil, float64(hist.count))
+	}
+}
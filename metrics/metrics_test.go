@@ -0,0 +1,64 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	r := NewRegistry()
+	requests := r.NewCounterVec("nn_requests_total", "Requests by route, \\ and\nnewlines are escaped.", "route", "status")
+	requests.Inc("/predict", "200")
+	requests.Inc("/predict", "200")
+	requests.Add(0.5, "/a\"b\\c\n", "500")
+	jobs := r.NewGaugeVec("nn_jobs_running", "Running jobs.")
+	jobs.Set(3)
+	jobs.Add(-1)
+	latency := r.NewHistogramVec("nn_latency_seconds", "Latency.", []float64{0.125, 0.5, 1}, "model")
+	for _, v := range []float64{0.0625, 0.125, 0.75, 3} {
+		latency.Observe(v, "mnist")
+	}
+	latency.Observe(0.25, "cifar10")
+
+	// families in the order they were created, series sorted by labels,
+	// and every bucket counts the observations up to its bound
+	want := `# HELP nn_requests_total Requests by route, \\ and\nnewlines are escaped.
+# TYPE nn_requests_total counter
+nn_requests_total{route="/a\"b\\c\n",status="500"} 0.5
+nn_requests_total{route="/predict",status="200"} 2
+# HELP nn_jobs_running Running jobs.
+# TYPE nn_jobs_running gauge
+nn_jobs_running 2
+# HELP nn_latency_seconds Latency.
+# TYPE nn_latency_seconds histogram
+nn_latency_seconds_bucket{model="cifar10",le="0.125"} 0
+nn_latency_seconds_bucket{model="cifar10",le="0.5"} 1
+nn_latency_seconds_bucket{model="cifar10",le="1"} 1
+nn_latency_seconds_bucket{model="cifar10",le="+Inf"} 1
+nn_latency_seconds_sum{model="cifar10"} 0.25
+nn_latency_seconds_count{model="cifar10"} 1
+nn_latency_seconds_bucket{model="mnist",le="0.125"} 2
+nn_latency_seconds_bucket{model="mnist",le="0.5"} 2
+nn_latency_seconds_bucket{model="mnist",le="1"} 3
+nn_latency_seconds_bucket{model="mnist",le="+Inf"} 4
+nn_latency_seconds_sum{model="mnist"} 3.9375
+nn_latency_seconds_count{model="mnist"} 4
+`
+	var got strings.Builder
+	if err := r.Write(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", got.String(), want)
+	}
+}
+
+func TestWrongLabelCount(t *testing.T) {
+	c := NewRegistry().NewCounterVec("nn_test_total", "Test.", "a", "b")
+	defer func() {
+		if recover() == nil {
+			t.Error("a missing label value did not panic")
+		}
+	}()
+	c.Inc("only a")
+}
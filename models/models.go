@@ -1,5 +1,11 @@
 package models
 
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
 type Response interface {
 	GetOperation() string
 }
@@ -14,15 +20,52 @@ type OperationResponse struct {
 	Operation string `json:"operation"`
 }
 
+// ErrorResponse is the body of every error. Code is stable and meant
+// for programs, Message for people. Details lists the invalid fields
+// of a request, and RequestID is also sent as the X-Request-ID header.
 type ErrorResponse struct {
-	ApiResponse
-	Status  int    `json:"status"`
+	Success   bool          `json:"success"`
+	Status    int           `json:"status"`
+	Code      string        `json:"code"`
+	Message   string        `json:"message"`
+	Details   []ErrorDetail `json:"details,omitempty"`
+	RequestID string        `json:"request_id,omitempty"`
+}
+
+// ErrorDetail is what is wrong with a field of a request
+type ErrorDetail struct {
+	Field   string `json:"field"`
 	Message string `json:"message"`
 }
 
-func NewErrorResponse(status int, err error) *ErrorResponse {
+// error codes of the API
+const (
+	CodeBadRequest       = "bad_request"
+	CodeInvalidJSON      = "invalid_json"
+	CodeValidation       = "validation_failed"
+	CodeMissingImage     = "missing_image"
+	CodeUnsupportedMedia = "unsupported_media_type"
+	CodeTooLarge         = "payload_too_large"
+	CodeImageTooLarge    = "image_too_large"
+	CodeMissingKey       = "missing_api_key"
+	CodeInvalidKey       = "invalid_api_key"
+	CodeForbidden        = "forbidden"
+	CodeNotFound         = "not_found"
+	CodeMethodNotAllowed = "method_not_allowed"
+	CodeModelNotFound    = "model_not_found"
+	CodeJobNotFound      = "job_not_found"
+	CodeConflict         = "conflict"
+	CodeJobRunning       = "job_running"
+	CodeNoTrainingData   = "no_training_data"
+	CodeRateLimited      = "rate_limited"
+	CodeInternal         = "internal_error"
+	CodeUnavailable      = "unavailable"
+)
+
+func NewErrorResponse(status int, code string, err error) *ErrorResponse {
 	return &ErrorResponse{
 		Status:  status,
+		Code:    code,
 		Message: err.Error(),
 	}
 }
@@ -31,23 +74,488 @@ type PredictResponse struct {
 	OperationResponse
 	Results    map[string]float64 `json:"results"`
 	Prediction int                `json:"prediction"`
+	Label      string             `json:"label"`
 	Accuracy   float64            `json:"accuracy"`
+	// Model is the model that answered, as name@version, and Variant
+	// the side of the traffic split it was picked for, if one is running
+	Model   string `json:"model"`
+	Variant string `json:"variant,omitempty"`
+	// Polarity is the background polarity the image was read with,
+	// and PolaritySource whether it was detected or given by the client
+	Polarity       string `json:"polarity"`
+	PolaritySource string `json:"polarity_source"`
+	// Number is every digit found in the image read left to right,
+	// and Digits the prediction and position of each of them
+	Number string            `json:"number"`
+	Digits []DigitPrediction `json:"digits"`
+	// Cached is set when the result came from the cache, and Preview,
+	// on request, is the image the network received as a PNG data URL
+	Cached  bool   `json:"cached"`
+	Preview string `json:"preview,omitempty"`
 }
 
 func (r *PredictResponse) GetOperation() string {
 	return r.Operation
 }
 
+// Box is a rectangle in the pixels of the uploaded image
+type Box struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// DigitPrediction is one digit of a number
+type DigitPrediction struct {
+	Digit      int     `json:"digit"`
+	Label      string  `json:"label"`
+	Confidence float64 `json:"confidence"`
+	Box        Box     `json:"box"`
+}
+
+// DetectResponse lists the digits found anywhere in an image. Annotated
+// is the image with the detections drawn over it, as a PNG data URL, when
+// the client asked for it.
+type DetectResponse struct {
+	OperationResponse
+	Model      string            `json:"model"`
+	Variant    string            `json:"variant,omitempty"`
+	Count      int               `json:"count"`
+	Detections []DigitPrediction `json:"detections"`
+	Annotated  string            `json:"annotated,omitempty"`
+}
+
+func (r *DetectResponse) GetOperation() string {
+	return r.Operation
+}
+
+// BatchItem is the prediction of one image of a batch. Items that
+// failed have Success unset and the reason in Error.
+type BatchItem struct {
+	Index          int                `json:"index"`
+	Name           string             `json:"name,omitempty"`
+	Success        bool               `json:"success"`
+	Results        map[string]float64 `json:"results,omitempty"`
+	Prediction     int                `json:"prediction"`
+	Label          string             `json:"label,omitempty"`
+	Accuracy       float64            `json:"accuracy"`
+	Polarity       string             `json:"polarity,omitempty"`
+	PolaritySource string             `json:"polarity_source,omitempty"`
+	Cached         bool               `json:"cached"`
+	Error          string             `json:"error,omitempty"`
+}
+
+type BatchPredictResponse struct {
+	OperationResponse
+	Model   string      `json:"model"`
+	Variant string      `json:"variant,omitempty"`
+	Count   int         `json:"count"`
+	Failed  int         `json:"failed"`
+	Items   []BatchItem `json:"items"`
+}
+
+func (r *BatchPredictResponse) GetOperation() string {
+	return r.Operation
+}
+
+// FormValue is a JSON string that also accepts booleans and numbers,
+// so JSON clients can send "invert": true as well as "invert": "auto"
+type FormValue string
+
+func (v *FormValue) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*v = FormValue(s)
+		return nil
+	}
+	var raw interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	switch raw.(type) {
+	case bool, float64:
+		*v = FormValue(string(data))
+	case nil:
+		*v = ""
+	default:
+		return fmt.Errorf("expected a string, boolean or number, got %s", data)
+	}
+	return nil
+}
+
+// PixelPredictRequest is a prediction from pixel data. Pixels holds the
+// values of every network input, either between 0 and 1 or between 0 and
+// 255; Scale can be "unit" or "byte" when the values are ambiguous. Data
+// is a base64 image data URL, or base64 of one byte per input.
+type PixelPredictRequest struct {
+	Pixels   []float64 `json:"pixels"`
+	Data     string    `json:"data"`
+	Scale    string    `json:"scale"`
+	Invert   FormValue `json:"invert"`
+	Binarize FormValue `json:"binarize"`
+	Deskew   FormValue `json:"deskew"`
+	Preview  FormValue `json:"preview"`
+}
+
 type TrainRequest struct {
-	Epochs int  `json:epochs`
-	Force  bool `json:force`
+	Epochs int  `json:"epochs"`
+	Force  bool `json:"force"`
+	// Canary is the percentage of the traffic sent to the trained
+	// version. Without it the trained version replaces the active one.
+	Canary float64 `json:"canary,omitempty"`
+}
+
+// EvaluationMetrics is how a model did on a labeled set. Confusion[i][j]
+// counts the samples of the i-th label predicted as the j-th one, in
+// the order of Labels. Accuracy, precision, recall and F1 are percents.
+type EvaluationMetrics struct {
+	Model     string         `json:"model"`
+	Data      string         `json:"data"`
+	Samples   int            `json:"samples"`
+	Correct   int            `json:"correct"`
+	Accuracy  float64        `json:"accuracy"`
+	MacroF1   float64        `json:"macro_f1"`
+	Labels    []string       `json:"labels"`
+	Confusion [][]int        `json:"confusion_matrix"`
+	Classes   []ClassMetrics `json:"classes"`
+	Duration  string         `json:"duration"`
+}
+
+// ClassMetrics are the scores of one label. Support is the
+// number of samples that have it.
+type ClassMetrics struct {
+	Label     string  `json:"label"`
+	Support   int     `json:"support"`
+	Predicted int     `json:"predicted"`
+	Precision float64 `json:"precision"`
+	Recall    float64 `json:"recall"`
+	F1        float64 `json:"f1"`
+}
+
+type EvaluateResponse struct {
+	OperationResponse
+	Message string `json:"message"`
+	JobID   string `json:"job_id"`
+	Model   string `json:"model"`
+	Data    string `json:"data"`
+}
+
+func (r *EvaluateResponse) GetOperation() string {
+	return r.Operation
 }
 
 type TrainResponse struct {
 	OperationResponse
 	Message string `json:"message"`
+	JobID   string `json:"job_id,omitempty"`
 }
 
 func (r *TrainResponse) GetOperation() string {
 	return r.Operation
 }
+
+// Job is a background training job
+type Job struct {
+	ID       string         `json:"id"`
+	Kind     string         `json:"kind"`
+	Model    string         `json:"model,omitempty"`
+	Status   string         `json:"status"`
+	Epochs   int            `json:"epochs"`
+	Progress JobProgress    `json:"progress"`
+	Metrics  *TrainMetrics  `json:"metrics,omitempty"`
+	History  []EpochMetrics `json:"history,omitempty"`
+	// Evaluation is the report of an evaluation job once it succeeded
+	Evaluation *EvaluationMetrics `json:"evaluation,omitempty"`
+	Error      string             `json:"error,omitempty"`
+	CreatedAt  time.Time          `json:"created_at"`
+	StartedAt  *time.Time         `json:"started_at,omitempty"`
+	FinishedAt *time.Time         `json:"finished_at,omitempty"`
+}
+
+type JobProgress struct {
+	Epoch      int     `json:"epoch"`
+	Epochs     int     `json:"epochs"`
+	Samples    int     `json:"samples"`
+	EpochSize  int     `json:"epoch_size"`
+	Percent    float64 `json:"percent"`
+	Loss       float64 `json:"loss"`
+	Throughput float64 `json:"samples_per_second"`
+	ETA        string  `json:"eta,omitempty"`
+}
+
+// EpochMetrics are measured at the end of every training epoch
+type EpochMetrics struct {
+	Epoch              int      `json:"epoch"`
+	Loss               float64  `json:"loss"`
+	ValidationSamples  int      `json:"validation_samples,omitempty"`
+	ValidationAccuracy *float64 `json:"validation_accuracy,omitempty"`
+	Duration           string   `json:"duration"`
+}
+
+// JobEvent is pushed to the clients following a job. Progress events
+// come after every batch of samples, epoch events at the end of every
+// epoch and status events when the job changes state.
+type JobEvent struct {
+	Type     string        `json:"type"`
+	JobID    string        `json:"job_id"`
+	Progress *JobProgress  `json:"progress,omitempty"`
+	Epoch    *EpochMetrics `json:"epoch,omitempty"`
+	Job      *Job          `json:"job,omitempty"`
+}
+
+// TrainMetrics are the results of a finished training job
+type TrainMetrics struct {
+	Epochs       int      `json:"epochs"`
+	Samples      int      `json:"samples"`
+	Duration     string   `json:"duration"`
+	TestSamples  int      `json:"test_samples,omitempty"`
+	TestAccuracy *float64 `json:"test_accuracy,omitempty"`
+	// Version is the registry version the trained network was saved as
+	Version int `json:"version,omitempty"`
+}
+
+type JobResponse struct {
+	OperationResponse
+	Job *Job `json:"job"`
+}
+
+func (r *JobResponse) GetOperation() string {
+	return r.Operation
+}
+
+type JobListResponse struct {
+	OperationResponse
+	Jobs []*Job `json:"jobs"`
+}
+
+func (r *JobListResponse) GetOperation() string {
+	return r.Operation
+}
+
+type MetricsResponse struct {
+	OperationResponse
+	JobID      string             `json:"job_id"`
+	Metrics    *TrainMetrics      `json:"metrics,omitempty"`
+	Evaluation *EvaluationMetrics `json:"evaluation,omitempty"`
+}
+
+func (r *MetricsResponse) GetOperation() string {
+	return r.Operation
+}
+
+// ModelVersion describes one version of a model in the registry
+type ModelVersion struct {
+	Name         string    `json:"name"`
+	Version      int       `json:"version"`
+	Dataset      string    `json:"dataset"`
+	Preprocess   string    `json:"preprocess"`
+	Labels       []string  `json:"labels"`
+	Inputs       int       `json:"inputs"`
+	Hiddens      int       `json:"hiddens"`
+	Outputs      int       `json:"outputs"`
+	LearningRate float64   `json:"learning_rate"`
+	Description  string    `json:"description,omitempty"`
+	Accuracy     *float64  `json:"accuracy,omitempty"`
+	Size         int64     `json:"size"`
+	CreatedAt    time.Time `json:"created_at"`
+	Active       bool      `json:"active"`
+}
+
+// Model is a named model with all its versions, oldest first
+type Model struct {
+	Name          string         `json:"name"`
+	ActiveVersion int            `json:"active_version,omitempty"`
+	Versions      []ModelVersion `json:"versions"`
+}
+
+type ModelListResponse struct {
+	OperationResponse
+	Models []Model `json:"models"`
+}
+
+func (r *ModelListResponse) GetOperation() string {
+	return r.Operation
+}
+
+type ModelResponse struct {
+	OperationResponse
+	Model *Model `json:"model"`
+}
+
+func (r *ModelResponse) GetOperation() string {
+	return r.Operation
+}
+
+type ModelVersionResponse struct {
+	OperationResponse
+	Message string        `json:"message,omitempty"`
+	Version *ModelVersion `json:"version"`
+}
+
+func (r *ModelVersionResponse) GetOperation() string {
+	return r.Operation
+}
+
+// SplitRequest sends a percentage of the traffic of a model to another
+// of its versions
+type SplitRequest struct {
+	Version int     `json:"version"`
+	Weight  float64 `json:"weight"`
+}
+
+// Split is a traffic split between the active version of a model, the
+// baseline, and a candidate version
+type Split struct {
+	Name      string         `json:"name"`
+	Weight    float64        `json:"weight"`
+	Header    string         `json:"header"`
+	StartedAt time.Time      `json:"started_at"`
+	Variants  []VariantStats `json:"variants"`
+}
+
+// VariantStats describe how one side of a split has been doing.
+// Confidence counts the predictions by confidence, in ten buckets of
+// 10%. Accuracy is the share of the feedback that agreed with the
+// prediction, once there is some.
+type VariantStats struct {
+	Variant        string   `json:"variant"`
+	Model          string   `json:"model"`
+	Requests       int      `json:"requests"`
+	Predictions    int      `json:"predictions"`
+	MeanLatency    string   `json:"mean_latency"`
+	MaxLatency     string   `json:"max_latency"`
+	MeanConfidence float64  `json:"mean_confidence"`
+	Confidence     [10]int  `json:"confidence"`
+	Feedback       int      `json:"feedback"`
+	Correct        int      `json:"correct"`
+	Accuracy       *float64 `json:"accuracy,omitempty"`
+}
+
+type SplitResponse struct {
+	OperationResponse
+	Message string `json:"message,omitempty"`
+	Split   *Split `json:"split"`
+}
+
+func (r *SplitResponse) GetOperation() string {
+	return r.Operation
+}
+
+// FeedbackRequest tells which label a prediction should have had. Model
+// and Label are the ones of the prediction response.
+type FeedbackRequest struct {
+	Model    string `json:"model"`
+	Label    string `json:"label"`
+	Expected string `json:"expected"`
+}
+
+type FeedbackResponse struct {
+	OperationResponse
+	Variant string `json:"variant,omitempty"`
+	Correct bool   `json:"correct"`
+}
+
+func (r *FeedbackResponse) GetOperation() string {
+	return r.Operation
+}
+
+// ShadowRequest runs a version of a model alongside the served one
+type ShadowRequest struct {
+	Version int `json:"version"`
+}
+
+// Shadow summarizes how a shadow model compares with the served one.
+// Confusion counts the predictions by the label of the served model,
+// then by the label of the shadow. Dropped are the predictions the
+// shadow was too busy to run.
+type Shadow struct {
+	Name          string                    `json:"name"`
+	Candidate     string                    `json:"candidate"`
+	StartedAt     time.Time                 `json:"started_at"`
+	Compared      int                       `json:"compared"`
+	Agreed        int                       `json:"agreed"`
+	AgreementRate *float64                  `json:"agreement_rate,omitempty"`
+	Dropped       int                       `json:"dropped"`
+	Confusion     map[string]map[string]int `json:"confusion"`
+	Disagreements []ShadowDisagreement      `json:"disagreements"`
+}
+
+// ShadowDisagreement is a prediction the two models answered differently
+type ShadowDisagreement struct {
+	Input            string             `json:"input"`
+	Time             time.Time          `json:"time"`
+	Model            string             `json:"model"`
+	Label            string             `json:"label"`
+	Results          map[string]float64 `json:"results"`
+	CandidateLabel   string             `json:"candidate_label"`
+	CandidateResults map[string]float64 `json:"candidate_results"`
+}
+
+type ShadowResponse struct {
+	OperationResponse
+	Message string  `json:"message,omitempty"`
+	Shadow  *Shadow `json:"shadow"`
+}
+
+func (r *ShadowResponse) GetOperation() string {
+	return r.Operation
+}
+
+// Check is one of the conditions the server needs to answer requests
+type Check struct {
+	Name    string `json:"name"`
+	OK      bool   `json:"ok"`
+	Message string `json:"message,omitempty"`
+}
+
+type HealthResponse struct {
+	OperationResponse
+	Status string  `json:"status"`
+	Checks []Check `json:"checks,omitempty"`
+}
+
+func (r *HealthResponse) GetOperation() string {
+	return r.Operation
+}
+
+// ModelInfo describes a served model. TrainedAt and Accuracy are
+// unset for a network that is not in the registry yet.
+type ModelInfo struct {
+	Name         string     `json:"name"`
+	Default      bool       `json:"default"`
+	Version      int        `json:"version,omitempty"`
+	Dataset      string     `json:"dataset,omitempty"`
+	Preprocess   string     `json:"preprocess"`
+	Labels       []string   `json:"labels"`
+	Inputs       int        `json:"inputs"`
+	Hiddens      int        `json:"hiddens"`
+	Outputs      int        `json:"outputs"`
+	LearningRate float64    `json:"learning_rate"`
+	Description  string     `json:"description,omitempty"`
+	TrainedAt    *time.Time `json:"trained_at,omitempty"`
+	Accuracy     *float64   `json:"accuracy,omitempty"`
+}
+
+// BuildInfo describes the binary of the server
+type BuildInfo struct {
+	GoVersion string `json:"go_version"`
+	Module    string `json:"module"`
+	Version   string `json:"version"`
+	Revision  string `json:"revision,omitempty"`
+	Time      string `json:"time,omitempty"`
+	Modified  bool   `json:"modified,omitempty"`
+}
+
+type InfoResponse struct {
+	OperationResponse
+	Build     BuildInfo   `json:"build"`
+	StartedAt time.Time   `json:"started_at"`
+	Uptime    string      `json:"uptime"`
+	Cache     string      `json:"cache"`
+	Models    []ModelInfo `json:"models"`
+}
+
+func (r *InfoResponse) GetOperation() string {
+	return r.Operation
+}
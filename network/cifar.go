@@ -0,0 +1,210 @@
+package network
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// CIFAR-10 images are 32 x 32 RGB
+const (
+	CifarWidth    = 32
+	CifarHeight   = 32
+	CifarChannels = 3
+	CifarInputs   = CifarWidth * CifarHeight * CifarChannels
+)
+
+// every record in a binary batch is one label byte followed
+// by the red, green and blue planes of the image
+const cifarRecordSize = 1 + CifarInputs
+
+// CifarLabels are the class names, indexed by label
+var CifarLabels = []string{
+	"airplane", "automobile", "bird", "cat", "deer",
+	"dog", "frog", "horse", "ship", "truck",
+}
+
+// CifarTrainFiles are the default training batches
+var CifarTrainFiles = []string{
+	"./cifar_dataset/data_batch_1.bin",
+	"./cifar_dataset/data_batch_2.bin",
+	"./cifar_dataset/data_batch_3.bin",
+	"./cifar_dataset/data_batch_4.bin",
+	"./cifar_dataset/data_batch_5.bin",
+}
+
+// CifarTestFile is the default test batch
+const CifarTestFile = "./cifar_dataset/test_batch.bin"
+
+// CifarSample is a labeled image from a CIFAR-10 batch
+type CifarSample struct {
+	Label int
+	Image *Tensor
+}
+
+// LoadCifarBatch reads every sample of a CIFAR-10 binary batch file
+func LoadCifarBatch(path string) ([]CifarSample, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening the batch file: %v", err)
+	}
+	defer f.Close()
+	return ReadCifarBatch(f)
+}
+
+// ReadCifarBatch reads CIFAR-10 binary records until EOF
+func ReadCifarBatch(r io.Reader) ([]CifarSample, error) {
+	var samples []CifarSample
+	err := readCifarRecords(r, func(s CifarSample) error {
+		samples = append(samples, s)
+		return nil
+	})
+	return samples, err
+}
+
+// ReadCifarRecords streams the records of a CIFAR-10 binary batch to fn
+// as the inputs of a network. It stops at the first error fn returns.
+func ReadCifarRecords(r io.Reader, fn func(inputs []float64, label int) error) error {
+	return readCifarRecords(r, func(s CifarSample) error {
+		return fn(s.Image.Flatten(), s.Label)
+	})
+}
+
+// CifarCount counts the records of a CIFAR-10 binary batch file
+func CifarCount(file string) (int, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return 0, err
+	}
+	return int(info.Size() / cifarRecordSize), nil
+}
+
+// readCifarRecords streams the records to fn so that training does not
+// have to keep a whole batch of tensors in memory. It stops at the first
+// error fn returns.
+func readCifarRecords(r io.Reader, fn func(CifarSample) error) error {
+	br := bufio.NewReader(r)
+	record := make([]byte, cifarRecordSize)
+	for {
+		_, err := io.ReadFull(br, record)
+		if err == io.EOF {
+			return nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("truncated CIFAR-10 record")
+		}
+		if err != nil {
+			return err
+		}
+		label := int(record[0])
+		if label >= len(CifarLabels) {
+			return fmt.Errorf("invalid CIFAR-10 label: %d", label)
+		}
+		t := NewTensor(CifarWidth, CifarHeight, CifarChannels)
+		for i, v := range record[1:] {
+			t.Data[i] = scalePixel(float64(v))
+		}
+		if err := fn(CifarSample{Label: label, Image: t}); err != nil {
+			return err
+		}
+	}
+}
+
+// CifarTrain trains the network with the given CIFAR-10 batch files
+func (net *Network) CifarTrain(files []string, ep int) error {
+	return net.CifarTrainContext(context.Background(), files, ep, nil)
+}
+
+// CifarTrainContext trains the network with CIFAR-10 batch files,
+// reporting progress and stopping when the context is cancelled
+func (net *Network) CifarTrainContext(ctx context.Context, files []string, ep int, progress ProgressFunc) error {
+	if net.Inputs != CifarInputs {
+		return fmt.Errorf("network has %d inputs, CIFAR-10 needs %d", net.Inputs, CifarInputs)
+	}
+	t1 := time.Now()
+	size := 0
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			logrus.Errorf("error opening the training file: %v", err)
+			return err
+		}
+		size += int(info.Size()) / cifarRecordSize
+	}
+	for epochs := 0; epochs < ep; epochs++ {
+		samples := 0
+		var batchLoss, epochLoss float64
+		for _, file := range files {
+			f, err := os.Open(file)
+			if err != nil {
+				logrus.Errorf("error opening the training file: %v", err)
+				return err
+			}
+			err = readCifarRecords(f, func(s CifarSample) error {
+				loss := net.Train(s.Image.Flatten(), net.targets(s.Label))
+				batchLoss += loss
+				epochLoss += loss
+				samples++
+				if samples%cancelInterval == 0 {
+					if err := ctx.Err(); err != nil {
+						return err
+					}
+				}
+				if samples%progressInterval == 0 {
+					progress.report(Progress{
+						Epoch: epochs + 1, Epochs: ep, Samples: samples, EpochSize: size,
+						Loss: batchLoss / progressInterval,
+					})
+					batchLoss = 0
+				}
+				return nil
+			})
+			f.Close()
+			if err != nil {
+				return err
+			}
+		}
+		progress.report(Progress{
+			Epoch: epochs + 1, Epochs: ep, Samples: samples, EpochSize: samples,
+			Loss: meanOf(epochLoss, samples), EpochDone: true,
+		})
+	}
+	logrus.WithField("duration", time.Since(t1)).Info("training done")
+	return nil
+}
+
+// CifarPredict checks the network against a CIFAR-10 test batch
+func (net *Network) CifarPredict(file string) error {
+	t1 := time.Now()
+	score, _, err := net.CifarScore(file)
+	if err != nil {
+		return err
+	}
+	elapsed := time.Since(t1)
+	fmt.Printf("Time taken to check: %s\n", elapsed)
+	fmt.Println("score:", score)
+	return nil
+}
+
+// CifarScore counts the samples of a CIFAR-10 batch file
+// the network predicts correctly
+func (net *Network) CifarScore(file string) (score, total int, err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	err = readCifarRecords(f, func(s CifarSample) error {
+		if net.best(net.Predict(s.Image.Flatten())) == s.Label {
+			score++
+		}
+		total++
+		return nil
+	})
+	return score, total, err
+}
@@ -0,0 +1,137 @@
+package network
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// cifarRecord is a binary record of the label with every value of the
+// red, green and blue planes set to r, g and b
+func cifarRecord(label, r, g, b byte) []byte {
+	plane := CifarWidth * CifarHeight
+	record := []byte{label}
+	for _, v := range []byte{r, g, b} {
+		record = append(record, bytes.Repeat([]byte{v}, plane)...)
+	}
+	return record
+}
+
+func TestReadCifarBatch(t *testing.T) {
+	two := append(cifarRecord(3, 0, 255, 0), cifarRecord(9, 255, 0, 255)...)
+	tests := []struct {
+		name   string
+		data   []byte
+		labels []int
+		err    string
+	}{
+		{name: "empty file"},
+		{name: "two records", data: two, labels: []int{3, 9}},
+		{name: "truncated record", data: two[:len(two)-1], err: "truncated CIFAR-10 record"},
+		{name: "only a label", data: []byte{1}, err: "truncated CIFAR-10 record"},
+		{name: "label above 9", data: cifarRecord(10, 0, 0, 0), err: "invalid CIFAR-10 label: 10"},
+	}
+	for _, tc := range tests {
+		samples, err := ReadCifarBatch(bytes.NewReader(tc.data))
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s: got error %v, want %q", tc.name, err, tc.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if len(samples) != len(tc.labels) {
+			t.Errorf("%s: got %d samples, want %d", tc.name, len(samples), len(tc.labels))
+			continue
+		}
+		for i, s := range samples {
+			if s.Label != tc.labels[i] {
+				t.Errorf("%s: sample %d has label %d, want %d", tc.name, i, s.Label, tc.labels[i])
+			}
+		}
+	}
+
+	// the planes of a record are the channels of the tensor
+	samples, _ := ReadCifarBatch(bytes.NewReader(two))
+	for i, want := range [][3]float64{{0.001, 1, 0.001}, {1, 0.001, 1}} {
+		img := samples[i].Image
+		for c := 0; c < CifarChannels; c++ {
+			if got := img.At(5, 7, c); got != want[c] {
+				t.Errorf("sample %d channel %d is %g, want %g", i, c, got, want[c])
+			}
+		}
+	}
+}
+
+func TestTensorIsChannelPlanar(t *testing.T) {
+	tensor := NewTensor(3, 2, 2)
+	if tensor.Len() != 12 || len(tensor.Flatten()) != 12 {
+		t.Fatalf("a 3x2x2 tensor holds %d values", len(tensor.Flatten()))
+	}
+	for c := 0; c < 2; c++ {
+		for y := 0; y < 2; y++ {
+			for x := 0; x < 3; x++ {
+				tensor.Set(x, y, c, float64(100*c+10*y+x))
+			}
+		}
+	}
+	// the first channel row by row, then the second
+	want := []float64{0, 1, 2, 10, 11, 12, 100, 101, 102, 110, 111, 112}
+	for i, v := range tensor.Flatten() {
+		if v != want[i] {
+			t.Fatalf("flattened %v, want %v", tensor.Flatten(), want)
+		}
+	}
+	if second := tensor.Channel(1); second[0] != 100 || second[5] != 112 || len(second) != 6 {
+		t.Errorf("channel 1 is %v", second)
+	}
+	for c := 0; c < 2; c++ {
+		for y := 0; y < 2; y++ {
+			for x := 0; x < 3; x++ {
+				if got := tensor.At(x, y, c); got != float64(100*c+10*y+x) {
+					t.Errorf("At(%d, %d, %d) = %g", x, y, c, got)
+				}
+			}
+		}
+	}
+}
+
+func TestTensorFromImage(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	img.Set(0, 0, color.NRGBA{255, 0, 0, 255})
+	img.Set(1, 0, color.NRGBA{0, 0, 255, 255})
+
+	rgb := TensorFromImage(img, 2, 1, 3).Flatten()
+	want := []float64{1, 0.001, 0.001, 0.001, 0.001, 1}
+	for i, v := range rgb {
+		if v != want[i] {
+			t.Fatalf("RGB tensor %v, want %v", rgb, want)
+		}
+	}
+	gray := TensorFromImage(img, 2, 1, 1).Flatten()
+	if len(gray) != 2 || gray[0] <= gray[1] {
+		t.Errorf("luminance %v, red is brighter than blue", gray)
+	}
+
+	path := filepath.Join(t.TempDir(), "red.png")
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	data, err := DataFromImageRGB(path)
+	if err != nil || len(data) != CifarInputs {
+		t.Fatalf("got %d values and %v, want %d", len(data), err, CifarInputs)
+	}
+	if _, err := DataFromImageRGB(filepath.Join(t.TempDir(), "missing.png")); err == nil {
+		t.Error("a missing file was read")
+	}
+}
@@ -0,0 +1,250 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"neural-network/images"
+	"sort"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// DetectOptions tune the sliding window detector
+type DetectOptions struct {
+	// MinSize is the height in pixels of the smallest digit searched,
+	// the largest one is as tall as the image
+	MinSize int
+	// ScaleStep is the ratio between two levels of the pyramid
+	ScaleStep float64
+	// Stride is the step of the window, in pixels of the 28 x 28 window
+	Stride int
+	// Threshold is the lowest confidence kept, between 0 and 1
+	Threshold float64
+	// Overlap is the intersection over union above which
+	// the weaker of two detections is dropped
+	Overlap float64
+	MNIST   images.MNISTOptions
+}
+
+// DefaultDetectOptions search digits of 20 pixels and more
+var DefaultDetectOptions = DetectOptions{
+	MinSize:   images.MNISTBoxSize,
+	ScaleStep: 1.25,
+	Stride:    3,
+	Threshold: 0.9,
+	Overlap:   0.3,
+	MNIST:     images.DefaultMNISTOptions,
+}
+
+// Detection is a digit found in a larger image
+type Detection struct {
+	Box        image.Rectangle
+	Digit      int
+	Confidence float64
+}
+
+// Windows are only classified when they look like an MNIST sample: enough
+// ink in the 20 x 20 center, almost none in the margin around it, and a
+// digit filling most of the center so the pyramid level matches its size.
+const (
+	windowMargin = (images.MNISTSize - images.MNISTBoxSize) / 2
+	minWindowInk = 0.04
+	maxMarginInk = 0.05
+	minWindowFit = 0.75
+	// detections covering this much of a smaller one are the same digit
+	maxContained = 0.8
+	// windows classified together
+	detectBatch = 256
+	// bounds of the work of a detection: the pixels of the largest level
+	// of the pyramid and the windows classified over all the levels
+	maxLevelPixels = 4 << 20
+	maxCandidates  = 4096
+)
+
+// ErrDetectionTooLarge is returned when the search would go over the
+// bounds of a detection, a larger MinSize or a smaller image is needed
+var ErrDetectionTooLarge = errors.New("detection too large")
+
+// candidate is a window waiting for the network
+type candidate struct {
+	box   image.Rectangle
+	input []float64
+}
+
+// Detect finds digits anywhere in an image. It slides a 28 x 28 window
+// over a pyramid of scaled copies of the image, classifies the windows
+// that look like a digit and keeps the most confident detection among the
+// overlapping ones. Detections are ordered from left to right.
+func (net *Network) Detect(img image.Image, opts DetectOptions) ([]Detection, error) {
+	if net.Inputs != MnistInputs {
+		return nil, fmt.Errorf("network has %d inputs, detection needs %d", net.Inputs, MnistInputs)
+	}
+	if opts.MinSize <= 0 || opts.ScaleStep <= 1 || opts.Stride <= 0 {
+		return nil, fmt.Errorf("invalid detection options: %+v", opts)
+	}
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	// the smallest digits are searched in the largest level
+	if scale := float64(images.MNISTBoxSize) / float64(opts.MinSize); float64(w)*float64(h)*scale*scale > maxLevelPixels {
+		return nil, fmt.Errorf("%w: digits of %d pixels in a %dx%d image, search larger digits or send a smaller image",
+			ErrDetectionTooLarge, opts.MinSize, w, h)
+	}
+	gray := images.CleanInk(img, opts.MNIST)
+
+	var candidates []candidate
+	for size := float64(opts.MinSize); size <= float64(minInt(w, h)); size *= opts.ScaleStep {
+		scale := float64(images.MNISTBoxSize) / size
+		found := windows(gray, scale, opts, maxCandidates-len(candidates)+1)
+		candidates = append(candidates, found...)
+		if len(candidates) > maxCandidates {
+			return nil, fmt.Errorf("%w: more than %d windows look like digits", ErrDetectionTooLarge, maxCandidates)
+		}
+	}
+
+	var detections []Detection
+	for from := 0; from < len(candidates); from += detectBatch {
+		chunk := candidates[from:minInt(from+detectBatch, len(candidates))]
+		inputs := make([][]float64, len(chunk))
+		for i, c := range chunk {
+			inputs[i] = c.input
+		}
+		output := net.PredictBatch(inputs)
+		for j, c := range chunk {
+			digit, confidence := bestColumn(output, j)
+			if confidence < opts.Threshold {
+				continue
+			}
+			detections = append(detections, Detection{
+				Box:        c.box.Add(img.Bounds().Min),
+				Digit:      digit,
+				Confidence: confidence,
+			})
+		}
+	}
+	detections = suppress(detections, opts.Overlap)
+	sort.Slice(detections, func(i, j int) bool {
+		return detections[i].Box.Min.X < detections[j].Box.Min.X
+	})
+	return detections, nil
+}
+
+// windows collects the windows of one pyramid level that hold a digit,
+// with their box in the pixels of the original image, stopping at limit
+func windows(gray *image.Gray, scale float64, opts DetectOptions, limit int) []candidate {
+	w := int(math.Round(float64(gray.Rect.Dx()) * scale))
+	h := int(math.Round(float64(gray.Rect.Dy()) * scale))
+	if w < images.MNISTSize || h < images.MNISTSize {
+		return nil
+	}
+	level := gray
+	if w != gray.Rect.Dx() || h != gray.Rect.Dy() {
+		level = images.Grayscale(images.Resize(gray, w, h))
+	}
+	sum := integral(level)
+	area := func(x, y, size int) int {
+		return sum[(y+size)*(w+1)+x+size] - sum[y*(w+1)+x+size] - sum[(y+size)*(w+1)+x] + sum[y*(w+1)+x]
+	}
+	minInk := int(minWindowInk * images.MNISTBoxSize * images.MNISTBoxSize * 255)
+	seen := make(map[image.Rectangle]bool)
+	var found []candidate
+	for y := 0; y+images.MNISTSize <= h; y += opts.Stride {
+		for x := 0; x+images.MNISTSize <= w; x += opts.Stride {
+			center := area(x+windowMargin, y+windowMargin, images.MNISTBoxSize)
+			if center < minInk {
+				continue
+			}
+			if total := area(x, y, images.MNISTSize); float64(total-center) > maxMarginInk*float64(total) {
+				continue
+			}
+			window := level.SubImage(image.Rect(x, y, x+images.MNISTSize, y+images.MNISTSize)).(*image.Gray)
+			ink, ok := images.InkBounds(window)
+			if !ok || float64(maxInt(ink.Dx(), ink.Dy())) < minWindowFit*images.MNISTBoxSize || seen[ink] {
+				continue
+			}
+			// neighbouring windows often hold the same digit
+			seen[ink] = true
+			box := image.Rect(
+				int(math.Floor(float64(ink.Min.X)/scale)), int(math.Floor(float64(ink.Min.Y)/scale)),
+				int(math.Ceil(float64(ink.Max.X)/scale)), int(math.Ceil(float64(ink.Max.Y)/scale)),
+			).Intersect(image.Rect(0, 0, gray.Rect.Dx(), gray.Rect.Dy()))
+			found = append(found, candidate{
+				box:   box,
+				input: DataFromGray(images.FitMNIST(window, opts.MNIST.Deskew)),
+			})
+			if len(found) == limit {
+				return found
+			}
+		}
+	}
+	return found
+}
+
+// integral returns the summed area table of the image,
+// with a row and a column of zeros before the pixels
+func integral(gray *image.Gray) []int {
+	w, h := gray.Rect.Dx(), gray.Rect.Dy()
+	sum := make([]int, (w+1)*(h+1))
+	for y := 0; y < h; y++ {
+		row := 0
+		for x := 0; x < w; x++ {
+			row += int(gray.Pix[y*gray.Stride+x])
+			sum[(y+1)*(w+1)+x+1] = sum[y*(w+1)+x+1] + row
+		}
+	}
+	return sum
+}
+
+// suppress keeps the most confident of the overlapping detections
+func suppress(detections []Detection, overlap float64) []Detection {
+	sort.Slice(detections, func(i, j int) bool {
+		return detections[i].Confidence > detections[j].Confidence
+	})
+	var kept []Detection
+	for _, d := range detections {
+		keep := true
+		for _, k := range kept {
+			inter := boxArea(d.Box.Intersect(k.Box))
+			union := boxArea(d.Box) + boxArea(k.Box) - inter
+			smaller := minInt(boxArea(d.Box), boxArea(k.Box))
+			if float64(inter) > overlap*float64(union) || float64(inter) > maxContained*float64(smaller) {
+				keep = false
+				break
+			}
+		}
+		if keep {
+			kept = append(kept, d)
+		}
+	}
+	return kept
+}
+
+func boxArea(r image.Rectangle) int {
+	return r.Dx() * r.Dy()
+}
+
+// bestColumn returns the highest output of column j and its index
+func bestColumn(output mat.Matrix, j int) (int, float64) {
+	r, _ := output.Dims()
+	best, highest := 0, 0.0
+	for i := 0; i < r; i++ {
+		if v := output.At(i, j); v > highest {
+			best, highest = i, v
+		}
+	}
+	return best, highest
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,91 @@
+package network
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"neural-network/images"
+	"testing"
+)
+
+func TestSuppress(t *testing.T) {
+	detections := []Detection{
+		{Box: image.Rect(0, 0, 20, 20), Digit: 1, Confidence: 0.92},
+		// mostly over the first one, and more confident
+		{Box: image.Rect(2, 2, 22, 22), Digit: 7, Confidence: 0.98},
+		// inside the second one
+		{Box: image.Rect(4, 4, 14, 14), Digit: 4, Confidence: 0.95},
+		// touching the second one
+		{Box: image.Rect(22, 0, 42, 20), Digit: 3, Confidence: 0.91},
+		{Box: image.Rect(60, 0, 80, 20), Digit: 5, Confidence: 0.99},
+	}
+	kept := suppress(detections, DefaultDetectOptions.Overlap)
+	want := []int{5, 7, 3}
+	if len(kept) != len(want) {
+		t.Fatalf("kept %v, want the digits %v", kept, want)
+	}
+	for i, d := range kept {
+		if d.Digit != want[i] {
+			t.Errorf("detection %d is a %d, want %d", i, d.Digit, want[i])
+		}
+	}
+}
+
+// digitPage draws thick dark strokes of the given height on white,
+// one per box
+func digitPage(w, h int, boxes ...image.Rectangle) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+	for _, b := range boxes {
+		draw.Draw(img, b, image.NewUniform(color.Black), image.Point{}, draw.Src)
+		draw.Draw(img, b.Inset(b.Dx()/4), image.White, image.Point{}, draw.Src)
+	}
+	return img
+}
+
+func TestWindows(t *testing.T) {
+	opts := DefaultDetectOptions
+	digit := image.Rect(40, 30, 56, 48)
+	gray := images.CleanInk(digitPage(120, 80, digit), opts.MNIST)
+
+	found := windows(gray, 1, opts, maxCandidates)
+	if len(found) == 0 {
+		t.Fatal("no window holds the digit")
+	}
+	for _, c := range found {
+		if c.box != digit {
+			t.Errorf("window box %v, want the digit at %v", c.box, digit)
+		}
+		if len(c.input) != MnistInputs {
+			t.Errorf("window input has %d values, want %d", len(c.input), MnistInputs)
+		}
+	}
+
+	// at half the scale, the boxes are still in the pixels of the image
+	for _, c := range windows(gray, 0.5, opts, maxCandidates) {
+		if !c.box.Overlaps(digit) {
+			t.Errorf("window box %v at half the scale misses the digit at %v", c.box, digit)
+		}
+	}
+	if found := windows(images.CleanInk(digitPage(120, 80), opts.MNIST), 1, opts, maxCandidates); len(found) != 0 {
+		t.Errorf("found %d windows in a blank image", len(found))
+	}
+	if found := windows(gray, 1, opts, 1); len(found) != 1 {
+		t.Errorf("found %d windows with a limit of 1", len(found))
+	}
+}
+
+func TestDetectRejectsLargeSearches(t *testing.T) {
+	net := NewNetwork(MnistInputs, 10, 10, 0.1)
+	opts := DefaultDetectOptions
+	opts.MinSize = 8
+	// digits of 8 pixels are searched in a level 2.5 times as large
+	_, err := net.Detect(digitPage(1000, 1000), opts)
+	if !errors.Is(err, ErrDetectionTooLarge) {
+		t.Errorf("got %v, want %v", err, ErrDetectionTooLarge)
+	}
+	if _, err := net.Detect(digitPage(100, 100), opts); err != nil {
+		t.Errorf("a small image: %v", err)
+	}
+}
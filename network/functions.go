@@ -3,8 +3,9 @@ package network
 import (
 	"fmt"
 	"image"
-	"image/png"
 	"math"
+	"neural-network/images"
+	"neural-network/utils"
 	"os"
 
 	"gonum.org/v1/gonum/mat"
@@ -72,6 +73,17 @@ func subtract(m, n mat.Matrix) mat.Matrix {
 	return o
 }
 
+// mean of the squared values of a column vector
+func meanSquare(m mat.Matrix) float64 {
+	r, _ := m.Dims()
+	sum := 0.0
+	for i := 0; i < r; i++ {
+		v := m.At(i, 0)
+		sum += v * v
+	}
+	return sum / float64(r)
+}
+
 // randomly generate a float64 array
 func randomArray(size int, v float64) (data []float64) {
 	dist := distuv.Uniform{
@@ -97,31 +109,51 @@ func matrixPrint(X mat.Matrix) {
 func DataFromImage(filePath string) (pixels []float64) {
 	// read the file
 	imgFile, err := os.Open(filePath)
-	defer imgFile.Close()
 	if err != nil {
 		fmt.Println("Cannot read file:", err)
+		return nil
 	}
-	img, err := png.Decode(imgFile)
+	defer imgFile.Close()
+	img, _, err := utils.Decode(imgFile)
 	if err != nil {
 		fmt.Println("Cannot decode file:", err)
+		return nil
 	}
+	// the image is expected to be a dark digit on a light
+	// background, the preprocessing turns it around because
+	// that's how the MNIST database was trained (in reverse)
+	return MNISTData(img, images.DefaultMNISTOptions)
+}
 
-	// create a grayscale image
-	bounds := img.Bounds()
-	gray := image.NewGray(bounds)
+// MnistInputs is the size of an MNIST sample, 28 x 28 gray pixels
+const MnistInputs = images.MNISTSize * images.MNISTSize
 
-	for x := 0; x < bounds.Max.X; x++ {
-		for y := 0; y < bounds.Max.Y; y++ {
-			var rgba = img.At(x, y)
-			gray.Set(x, y, rgba)
-		}
-	}
-	// make a pixel array
+// MNISTData preprocesses an arbitrary image the way the MNIST
+// digits were built and returns the network input
+func MNISTData(img image.Image, opts images.MNISTOptions) []float64 {
+	return DataFromGray(images.PrepareMNIST(img, opts))
+}
+
+// DataFromGray makes a pixel array from a light on dark gray image
+func DataFromGray(gray *image.Gray) (pixels []float64) {
 	pixels = make([]float64, len(gray.Pix))
-	// populate the pixel array subtract Pix from 255 because that's how
-	// the MNIST database was trained (in reverse)
 	for i := 0; i < len(gray.Pix); i++ {
-		pixels[i] = (float64(255-gray.Pix[i]) / 255.0 * 0.999) + 0.001
+		pixels[i] = scalePixel(float64(gray.Pix[i]))
 	}
 	return
 }
+
+// DataFromImageRGB reads the RGB pixel data of an image file, resized
+// to the 32 x 32 x 3 shape of the CIFAR-10 dataset
+func DataFromImageRGB(filePath string) ([]float64, error) {
+	imgFile, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the image: %w", err)
+	}
+	defer imgFile.Close()
+	img, _, err := utils.Decode(imgFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode %s: %w", filePath, err)
+	}
+	return TensorFromImage(img, CifarWidth, CifarHeight, CifarChannels).Flatten(), nil
+}
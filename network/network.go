@@ -2,11 +2,15 @@ package network
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
 	"encoding/csv"
 	"fmt"
 	"io"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"strconv"
 	"time"
 
@@ -37,8 +41,18 @@ func NewNetwork(input, hidden, output int, rate float64) (net *Network) {
 	return
 }
 
-// Train the neural network
-func (net *Network) Train(inputData []float64, targetData []float64) {
+// Clone copies the network, so one copy can be trained
+// while the other keeps answering predictions
+func (net *Network) Clone() *Network {
+	clone := *net
+	clone.HiddenWeights = mat.DenseCopyOf(net.HiddenWeights)
+	clone.OutputWeights = mat.DenseCopyOf(net.OutputWeights)
+	return &clone
+}
+
+// Train the neural network, returning the mean squared
+// error of the sample before the weights were updated
+func (net *Network) Train(inputData []float64, targetData []float64) float64 {
 	// feedforward
 	inputs := mat.NewDense(len(inputData), 1, inputData)
 	hiddenInputs := dot(net.HiddenWeights, inputs)
@@ -61,6 +75,8 @@ func (net *Network) Train(inputData []float64, targetData []float64) {
 		scale(net.LearningRate,
 			dot(multiply(hiddenErrors, sigmoidPrime(hiddenOutputs)),
 				inputs.T()))).(*mat.Dense)
+
+	return meanSquare(outputErrors)
 }
 
 // Predict uses the neural network to predict the value given input data
@@ -74,41 +90,212 @@ func (net *Network) Predict(inputData []float64) mat.Matrix {
 	return finalOutputs
 }
 
+// targets builds the expected output vector for a label
+func (net *Network) targets(label int) []float64 {
+	targets := make([]float64, net.Outputs)
+	for i := range targets {
+		targets[i] = 0.001
+	}
+	targets[label] = 0.999
+	return targets
+}
+
+// best returns the index of the highest output
+func (net *Network) best(output mat.Matrix) int {
+	best := 0
+	highest := 0.0
+	for i := 0; i < net.Outputs; i++ {
+		if output.At(i, 0) > highest {
+			best = i
+			highest = output.At(i, 0)
+		}
+	}
+	return best
+}
+
+// PredictBatch feeds many inputs through the network as a single
+// matrix, one input per column, and returns one output per column
+func (net *Network) PredictBatch(inputData [][]float64) mat.Matrix {
+	inputs := mat.NewDense(net.Inputs, len(inputData), nil)
+	for j, data := range inputData {
+		inputs.SetCol(j, data)
+	}
+	hiddenInputs := dot(net.HiddenWeights, inputs)
+	hiddenOutputs := apply(sigmoid, hiddenInputs)
+	finalInputs := dot(net.OutputWeights, hiddenOutputs)
+	finalOutputs := apply(sigmoid, finalInputs)
+	return finalOutputs
+}
+
+// DataDir is where Save and Load keep the weights
+const DataDir = "./data"
+
+// files of a saved network
+const (
+	HiddenWeightsFile = "hweights.model"
+	OutputWeightsFile = "oweights.model"
+)
+
 func (net *Network) Save() error {
 	logrus.WithField("step", "saving weights").Info("training network")
-	h, err := os.Create("./data/hweights.model")
+	return net.SaveTo(DataDir)
+}
+
+// SaveTo writes the weights of the network to a directory
+func (net *Network) SaveTo(dir string) error {
+	if err := writeWeights(filepath.Join(dir, HiddenWeightsFile), net.HiddenWeights); err != nil {
+		return err
+	}
+	return writeWeights(filepath.Join(dir, OutputWeightsFile), net.OutputWeights)
+}
+
+func writeWeights(path string, m *mat.Dense) error {
+	f, err := os.Create(path)
 	if err != nil {
 		return fmt.Errorf("error creating the weights file: %v", err)
 	}
-	if err == nil {
-		net.HiddenWeights.MarshalBinaryTo(h)
+	if _, err := m.MarshalBinaryTo(f); err != nil {
+		f.Close()
+		return fmt.Errorf("error writing the weights file: %v", err)
 	}
-	logrus.WithField("path", h.Name()).Info("training network")
-	defer h.Close()
-	o, err := os.Create("./data/oweights.model")
-	if err == nil {
-		net.OutputWeights.MarshalBinaryTo(o)
+	logrus.WithField("path", path).Info("training network")
+	return f.Close()
+}
+
+// Load reads the weights saved with Save. The network keeps its
+// weights when they cannot be read.
+func (net *Network) Load() error {
+	if err := net.LoadFrom(DataDir); err != nil {
+		return fmt.Errorf("cannot load the weights: %w", err)
 	}
-	defer o.Close()
 	return nil
 }
 
-// load a neural network from file
-func (net *Network) Load() {
-	h, err := os.Open("./data/hweights.model")
-	if err == nil {
-		logrus.Info("Loading hidden weights")
-		net.HiddenWeights.Reset()
-		net.HiddenWeights.UnmarshalBinaryFrom(h)
+// LoadFrom reads weights saved with SaveTo. The weights must have the
+// shape of the network, which is left untouched when they do not.
+func (net *Network) LoadFrom(dir string) error {
+	hidden, output, err := readWeightFiles(dir)
+	if err != nil {
+		return err
+	}
+	if r, c := hidden.Dims(); r != net.Hiddens || c != net.Inputs {
+		return fmt.Errorf("hidden weights are %d x %d, the network needs %d x %d", r, c, net.Hiddens, net.Inputs)
 	}
-	defer h.Close()
-	o, err := os.Open("./data/oweights.model")
-	if err == nil {
-		logrus.Info("Loading output weights")
-		net.OutputWeights.Reset()
-		net.OutputWeights.UnmarshalBinaryFrom(o)
+	if r, c := output.Dims(); r != net.Outputs || c != net.Hiddens {
+		return fmt.Errorf("output weights are %d x %d, the network needs %d x %d", r, c, net.Outputs, net.Hiddens)
+	}
+	logrus.Info("Loading hidden weights")
+	net.HiddenWeights = hidden
+	logrus.Info("Loading output weights")
+	net.OutputWeights = output
+	return nil
+}
+
+// OpenNetwork builds a network from weights saved with SaveTo,
+// taking its shape from the weights
+func OpenNetwork(dir string, rate float64) (*Network, error) {
+	hidden, output, err := readWeightFiles(dir)
+	if err != nil {
+		return nil, err
 	}
-	defer o.Close()
+	return fromWeights(hidden, output, rate)
+}
+
+// ReadNetwork builds a network from the content of its two weight files
+func ReadNetwork(hidden, output io.Reader, rate float64) (*Network, error) {
+	h, err := readWeights(hidden)
+	if err != nil {
+		return nil, err
+	}
+	o, err := readWeights(output)
+	if err != nil {
+		return nil, err
+	}
+	return fromWeights(h, o, rate)
+}
+
+func fromWeights(hidden, output *mat.Dense, rate float64) (*Network, error) {
+	hiddens, inputs := hidden.Dims()
+	outputs, c := output.Dims()
+	if c != hiddens {
+		return nil, fmt.Errorf("output weights have %d columns, the hidden layer has %d neurons", c, hiddens)
+	}
+	return &Network{
+		Inputs:        inputs,
+		Hiddens:       hiddens,
+		Outputs:       outputs,
+		HiddenWeights: hidden,
+		OutputWeights: output,
+		LearningRate:  rate,
+	}, nil
+}
+
+func readWeightFiles(dir string) (*mat.Dense, *mat.Dense, error) {
+	hidden, err := readWeightFile(filepath.Join(dir, HiddenWeightsFile))
+	if err != nil {
+		return nil, nil, err
+	}
+	output, err := readWeightFile(filepath.Join(dir, OutputWeightsFile))
+	if err != nil {
+		return nil, nil, err
+	}
+	return hidden, output, nil
+}
+
+func readWeightFile(path string) (*mat.Dense, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m, err := readWeights(bufio.NewReader(f))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return m, nil
+}
+
+// MaxWeights bounds the weights of a layer read by ReadWeightsData
+const MaxWeights = 1 << 24
+
+// weightsHeaderSize is the size of the header of a weight file,
+// which holds the shape of the matrix
+const weightsHeaderSize = 40
+
+// ReadWeightsData reads the content of one weight file, no more than
+// the shape in its header says it holds. Files with more than MaxWeights
+// weights or with more data than their shape are rejected.
+func ReadWeightsData(r io.Reader) ([]byte, error) {
+	header := make([]byte, weightsHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("invalid weights: %v", err)
+	}
+	rows := binary.LittleEndian.Uint64(header[8:16])
+	cols := binary.LittleEndian.Uint64(header[16:24])
+	if rows == 0 || cols == 0 || rows > MaxWeights || cols > MaxWeights || rows*cols > MaxWeights {
+		return nil, fmt.Errorf("invalid weights: a %dx%d matrix, at most %d weights", rows, cols, MaxWeights)
+	}
+	// the buffer grows with the data read, not with what the header claims
+	size := int64(rows * cols * 8)
+	buf := bytes.NewBuffer(header)
+	if n, err := io.Copy(buf, io.LimitReader(r, size)); err != nil {
+		return nil, fmt.Errorf("invalid weights: %v", err)
+	} else if n < size {
+		return nil, fmt.Errorf("invalid weights: %d bytes of data, a %dx%d matrix needs %d", n, rows, cols, size)
+	}
+	data := buf.Bytes()
+	if n, _ := io.CopyN(io.Discard, r, 1); n > 0 {
+		return nil, fmt.Errorf("invalid weights: more data than a %dx%d matrix", rows, cols)
+	}
+	return data, nil
+}
+
+func readWeights(r io.Reader) (*mat.Dense, error) {
+	m := &mat.Dense{}
+	if _, err := m.UnmarshalBinaryFrom(r); err != nil {
+		return nil, fmt.Errorf("invalid weights: %v", err)
+	}
+	return m, nil
 }
 
 // predict a number from an image
@@ -128,81 +315,126 @@ func (net *Network) PredictFromImage(path string) int {
 	return best
 }
 
+// MnistTrain trains the network with the MNIST training set
 func (net *Network) MnistTrain(ep int) error {
+	return net.MnistTrainContext(context.Background(), MnistTrainFile, ep, nil)
+}
+
+// MnistTrainContext trains the network with an MNIST CSV file,
+// reporting progress and stopping when the context is cancelled
+func (net *Network) MnistTrainContext(ctx context.Context, file string, ep int, progress ProgressFunc) error {
 	rand.NewSource(time.Now().UTC().UnixNano())
 	t1 := time.Now()
+	size, err := countLines(file)
+	if err != nil {
+		logrus.Errorf("error opening the training file: %v", err)
+		return err
+	}
 
 	for epochs := 0; epochs < ep; epochs++ {
-		testFile, err := os.Open("./mnist_dataset/mnist_train.csv")
+		trainFile, err := os.Open(file)
 		if err != nil {
 			logrus.Errorf("error opening the training file: %v", err)
 			return err
 		}
-		r := csv.NewReader(bufio.NewReader(testFile))
-		for {
-			record, err := r.Read()
-			if err == io.EOF {
-				break
-			}
-
-			inputs := make([]float64, net.Inputs)
-			for i := range inputs {
-				x, _ := strconv.ParseFloat(record[i], 64)
-				inputs[i] = (x / 255.0 * 0.999) + 0.001
+		samples := 0
+		var batchLoss, epochLoss float64
+		err = net.ReadMnistRecords(trainFile, func(inputs []float64, label int) error {
+			loss := net.Train(inputs, net.targets(label))
+			batchLoss += loss
+			epochLoss += loss
+			samples++
+			if samples%cancelInterval == 0 {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
 			}
-
-			targets := make([]float64, 10)
-			for i := range targets {
-				targets[i] = 0.001
+			if samples%progressInterval == 0 {
+				progress.report(Progress{
+					Epoch: epochs + 1, Epochs: ep, Samples: samples, EpochSize: size,
+					Loss: batchLoss / progressInterval,
+				})
+				batchLoss = 0
 			}
-			x, _ := strconv.Atoi(record[0])
-			targets[x] = 0.999
-
-			net.Train(inputs, targets)
+			return nil
+		})
+		trainFile.Close()
+		if err != nil {
+			return err
 		}
-		testFile.Close()
+		progress.report(Progress{
+			Epoch: epochs + 1, Epochs: ep, Samples: samples, EpochSize: samples,
+			Loss: meanOf(epochLoss, samples), EpochDone: true,
+		})
 	}
-	elapsed := time.Since(t1)
-	fmt.Printf("\nTime taken to train: %s\n", elapsed)
+	logrus.WithField("duration", time.Since(t1)).Info("training done")
 	return nil
 }
 
+// MnistPredict checks the network against the MNIST test set
 func (net *Network) MnistPredict() {
 	t1 := time.Now()
-	checkFile, _ := os.Open("mnist_dataset/mnist_test.csv")
+	score, _, _ := net.MnistScore(MnistTestFile)
+	elapsed := time.Since(t1)
+	fmt.Printf("Time taken to check: %s\n", elapsed)
+	fmt.Println("score:", score)
+}
+
+// MnistScore counts the records of an MNIST CSV file
+// the network predicts correctly
+func (net *Network) MnistScore(file string) (score, total int, err error) {
+	checkFile, err := os.Open(file)
+	if err != nil {
+		return 0, 0, err
+	}
 	defer checkFile.Close()
 
-	score := 0
-	r := csv.NewReader(bufio.NewReader(checkFile))
-	for {
-		record, err := r.Read()
+	err = net.ReadMnistRecords(checkFile, func(inputs []float64, label int) error {
+		if net.best(net.Predict(inputs)) == label {
+			score++
+		}
+		total++
+		return nil
+	})
+	return score, total, err
+}
+
+// ReadMnistRecords streams the records of a CSV in the MNIST format to fn:
+// the label, then one value from 0 to 255 for every input of the network.
+// It stops at the first invalid record or error fn returns.
+func (net *Network) ReadMnistRecords(r io.Reader, fn func(inputs []float64, label int) error) error {
+	cr := csv.NewReader(bufio.NewReader(r))
+	cr.FieldsPerRecord = -1
+	for line := 1; ; line++ {
+		record, err := cr.Read()
 		if err == io.EOF {
-			break
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(record) != net.Inputs+1 {
+			return fmt.Errorf("record %d has %d values, expected a label and %d pixels", line, len(record), net.Inputs)
+		}
+		label, err := strconv.Atoi(record[0])
+		if err != nil || label < 0 || label >= net.Outputs {
+			return fmt.Errorf("record %d has an invalid label %q", line, record[0])
 		}
 		inputs := make([]float64, net.Inputs)
 		for i := range inputs {
-			if i == 0 {
-				inputs[i] = 1.0
+			x, err := strconv.ParseFloat(record[i+1], 64)
+			if err != nil || x < 0 || x > 255 {
+				return fmt.Errorf("record %d has an invalid pixel %q", line, record[i+1])
 			}
-			x, _ := strconv.ParseFloat(record[i], 64)
 			inputs[i] = (x / 255.0 * 0.999) + 0.001
 		}
-		outputs := net.Predict(inputs)
-		best := 0
-		highest := 0.0
-		for i := 0; i < net.Outputs; i++ {
-			if outputs.At(i, 0) > highest {
-				best = i
-				highest = outputs.At(i, 0)
-			}
-		}
-		target, _ := strconv.Atoi(record[0])
-		if best == target {
-			score++
+		if err := fn(inputs, label); err != nil {
+			return err
 		}
 	}
+}
 
-	elapsed := time.Since(t1)
-	fmt.Printf("Time taken to check: %s\n", elapsed)
-	fmt.Println("score:", score)
+// MnistCount counts the records of an MNIST CSV file
+func MnistCount(file string) (int, error) {
+	return countLines(file)
 }
@@ -0,0 +1,129 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// litNetwork predicts the index of the brightest of its first 10 inputs
+func litNetwork() *Network {
+	hidden := mat.NewDense(10, MnistInputs, nil)
+	output := mat.NewDense(10, 10, nil)
+	for k := 0; k < 10; k++ {
+		hidden.Set(k, k, 10)
+		output.Set(k, k, 10)
+	}
+	net, _ := fromWeights(hidden, output, 0.1)
+	return net
+}
+
+func TestMnistScoreReadsPixelsAfterLabel(t *testing.T) {
+	var csv strings.Builder
+	for label := 0; label < 10; label++ {
+		fmt.Fprint(&csv, label)
+		for p := 0; p < MnistInputs; p++ {
+			if p == label {
+				csv.WriteString(",255")
+			} else {
+				csv.WriteString(",0")
+			}
+		}
+		csv.WriteString("\n")
+	}
+	file := filepath.Join(t.TempDir(), "test.csv")
+	if err := os.WriteFile(file, []byte(csv.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	score, total, err := litNetwork().MnistScore(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if score != 10 || total != 10 {
+		t.Errorf("got %d of %d right, want 10 of 10", score, total)
+	}
+}
+
+func TestReadMnistRecordsSkipsTheLabel(t *testing.T) {
+	// a 9 with only the last pixel lit: the label must not be read as
+	// the first pixel, nor push the last one out
+	record := "9" + strings.Repeat(",0", MnistInputs-1) + ",255\n"
+	calls := 0
+	err := litNetwork().ReadMnistRecords(strings.NewReader(record), func(inputs []float64, label int) error {
+		calls++
+		if label != 9 {
+			t.Errorf("label %d, want 9", label)
+		}
+		if len(inputs) != MnistInputs {
+			t.Fatalf("%d inputs, want %d", len(inputs), MnistInputs)
+		}
+		if inputs[0] != 0.001 {
+			t.Errorf("first input %g, want 0.001 for a blank pixel", inputs[0])
+		}
+		if inputs[MnistInputs-1] != 1 {
+			t.Errorf("last input %g, want 1 for the lit pixel", inputs[MnistInputs-1])
+		}
+		return nil
+	})
+	if err != nil || calls != 1 {
+		t.Fatalf("read %d records: %v", calls, err)
+	}
+}
+
+func TestReadMnistRecordsRejectsInvalidRecords(t *testing.T) {
+	pixels := strings.Repeat(",0", MnistInputs)
+	for name, record := range map[string]string{
+		"short":          "3" + pixels[2:],
+		"label":          "x" + pixels,
+		"label too high": "10" + pixels,
+		"pixel":          "3,300" + pixels[2:],
+	} {
+		err := litNetwork().ReadMnistRecords(strings.NewReader(record+"\n"), func([]float64, int) error {
+			return nil
+		})
+		if err == nil {
+			t.Errorf("%s: the record was accepted", name)
+		}
+	}
+}
+
+func TestReadWeightsData(t *testing.T) {
+	m := mat.NewDense(2, 3, []float64{1, 2, 3, 4, 5, 6})
+	data, err := m.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadWeightsData(bytes.NewReader(data))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("got %d bytes and %v, want the %d bytes of the matrix", len(got), err, len(data))
+	}
+	if _, err := ReadWeightsData(bytes.NewReader(append(data, 0))); err == nil {
+		t.Error("data after the matrix was accepted")
+	}
+	if _, err := ReadWeightsData(bytes.NewReader(data[:len(data)-1])); err == nil {
+		t.Error("a truncated matrix was accepted")
+	}
+
+	// a header claiming the largest matrix allowed, without its data,
+	// must not make the reader allocate for it
+	header := make([]byte, weightsHeaderSize)
+	copy(header, data[:weightsHeaderSize])
+	binary.LittleEndian.PutUint64(header[8:], 4096)
+	binary.LittleEndian.PutUint64(header[16:], 4096)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if _, err := ReadWeightsData(bytes.NewReader(header)); err == nil {
+		t.Fatal("a header without data was accepted")
+	}
+	runtime.ReadMemStats(&after)
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Errorf("reading a bare header allocated %d bytes", allocated)
+	}
+}
@@ -0,0 +1,82 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+)
+
+// The MNIST data sets used for training and testing
+const (
+	MnistTrainFile = "./mnist_dataset/mnist_train.csv"
+	MnistTestFile  = "./mnist_dataset/mnist_test.csv"
+)
+
+// how many samples are trained between progress reports
+// and between checks for cancellation
+const (
+	progressInterval = 1000
+	cancelInterval   = 100
+)
+
+// Progress reports how far a training run has got
+type Progress struct {
+	// Epoch is the current epoch, starting at 1
+	Epoch  int
+	Epochs int
+	// Samples is the number of samples trained in the current epoch
+	Samples   int
+	EpochSize int
+	// Loss is the mean squared error of the samples since the last
+	// report, or of the whole epoch when EpochDone is set
+	Loss      float64
+	EpochDone bool
+}
+
+// Done is the fraction of the whole run already trained
+func (p Progress) Done() float64 {
+	if p.Epochs == 0 || p.EpochSize == 0 {
+		return 0
+	}
+	epoch := float64(p.Samples) / float64(p.EpochSize)
+	return (float64(p.Epoch-1) + epoch) / float64(p.Epochs)
+}
+
+// ProgressFunc is called regularly while the network trains
+type ProgressFunc func(Progress)
+
+func (fn ProgressFunc) report(p Progress) {
+	if fn != nil {
+		fn(p)
+	}
+}
+
+// countLines counts the records of a CSV file
+func countLines(file string) (int, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	count := 0
+	buf := make([]byte, 64*1024)
+	r := bufio.NewReader(f)
+	for {
+		n, err := r.Read(buf)
+		count += bytes.Count(buf[:n], []byte{'\n'})
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+	}
+}
+
+func meanOf(sum float64, n int) float64 {
+	if n == 0 {
+		return 0
+	}
+	return sum / float64(n)
+}
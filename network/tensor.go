@@ -0,0 +1,84 @@
+package network
+
+import (
+	"image"
+	"neural-network/images"
+)
+
+// Tensor is a multi-channel image stored in channel-major order:
+// all the values of the first channel, then the second, and so on.
+// This is the same layout the CIFAR-10 binary batches use.
+type Tensor struct {
+	Width    int
+	Height   int
+	Channels int
+	Data     []float64
+}
+
+// NewTensor creates a zeroed tensor of the given shape
+func NewTensor(width, height, channels int) *Tensor {
+	return &Tensor{
+		Width:    width,
+		Height:   height,
+		Channels: channels,
+		Data:     make([]float64, width*height*channels),
+	}
+}
+
+// Len is the number of values in the tensor, which is also
+// the number of network inputs it feeds
+func (t *Tensor) Len() int {
+	return t.Width * t.Height * t.Channels
+}
+
+func (t *Tensor) At(x, y, c int) float64 {
+	return t.Data[t.index(x, y, c)]
+}
+
+func (t *Tensor) Set(x, y, c int, v float64) {
+	t.Data[t.index(x, y, c)] = v
+}
+
+// Channel returns the values of a single channel
+func (t *Tensor) Channel(c int) []float64 {
+	size := t.Width * t.Height
+	return t.Data[c*size : (c+1)*size]
+}
+
+// Flatten returns the tensor as a network input vector
+func (t *Tensor) Flatten() []float64 {
+	return t.Data
+}
+
+func (t *Tensor) index(x, y, c int) int {
+	return c*t.Width*t.Height + y*t.Width + x
+}
+
+// TensorFromImage resizes the image to width x height and turns it into
+// a tensor scaled to the (0.001, 1.0) range used for training.
+// With 3 channels the RGB values are kept, with 1 channel the image is
+// reduced to its luminance.
+func TensorFromImage(img image.Image, width, height, channels int) *Tensor {
+	resized := images.Resize(img, width, height)
+	t := NewTensor(width, height, channels)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			i := y*resized.Stride + x*4
+			p := resized.Pix[i : i+4 : i+4]
+			if channels == 1 {
+				lum := 0.299*float64(p[0]) + 0.587*float64(p[1]) + 0.114*float64(p[2])
+				t.Set(x, y, 0, scalePixel(lum))
+				continue
+			}
+			for c := 0; c < channels && c < 3; c++ {
+				t.Set(x, y, c, scalePixel(float64(p[c])))
+			}
+		}
+	}
+	return t
+}
+
+// scale a 0-255 pixel value into the range the network is trained on
+func scalePixel(v float64) float64 {
+	return (v / 255.0 * 0.999) + 0.001
+}
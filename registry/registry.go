@@ -0,0 +1,411 @@
+package registry
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"neural-network/models"
+	"neural-network/network"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// files of the registry. Every model is a directory with one directory per
+// version, "v1", "v2" and so on, holding the weights and the metadata, and
+// a file with the number of the active version.
+const (
+	metaFile   = "meta.json"
+	activeFile = "active"
+)
+
+// maxMetaSize bounds the metadata read from an archive
+const maxMetaSize = 1 << 20
+
+var (
+	ErrNotFound    = errors.New("model not found")
+	ErrInvalidName = errors.New("model names are lowercase letters, digits, - and _, and start with a letter or a digit")
+	ErrActive      = errors.New("the active version of a model cannot be deleted")
+)
+
+var validName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// Registry keeps named, versioned models in a directory
+type Registry struct {
+	mu   sync.RWMutex
+	root string
+}
+
+// New opens the registry in root, creating the directory if needed
+func New(root string) (*Registry, error) {
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, fmt.Errorf("cannot create the model registry: %v", err)
+	}
+	return &Registry{root: root}, nil
+}
+
+// ValidName reports whether name can be used for a model
+func ValidName(name string) bool {
+	return validName.MatchString(name)
+}
+
+// List returns every model of the registry, ordered by name
+func (r *Registry) List() ([]models.Model, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	entries, err := os.ReadDir(r.root)
+	if err != nil {
+		return nil, err
+	}
+	list := []models.Model{}
+	for _, entry := range entries {
+		if !entry.IsDir() || !ValidName(entry.Name()) {
+			continue
+		}
+		m, err := r.model(entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		if len(m.Versions) > 0 {
+			list = append(list, *m)
+		}
+	}
+	return list, nil
+}
+
+// Get returns a model with all its versions
+func (r *Registry) Get(name string) (*models.Model, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	m, err := r.model(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(m.Versions) == 0 {
+		return nil, ErrNotFound
+	}
+	return m, nil
+}
+
+// Version returns the metadata of one version of a model
+func (r *Registry) Version(name string, version int) (*models.ModelVersion, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.version(name, version)
+}
+
+// Active returns the metadata of the active version of a model
+func (r *Registry) Active(name string) (*models.ModelVersion, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	active, err := r.active(name)
+	if err != nil {
+		return nil, err
+	}
+	return r.version(name, active)
+}
+
+// Load reads the network of a version
+func (r *Registry) Load(name string, version int) (*network.Network, *models.ModelVersion, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	v, err := r.version(name, version)
+	if err != nil {
+		return nil, nil, err
+	}
+	net, err := network.OpenNetwork(r.dir(name, version), v.LearningRate)
+	if err != nil {
+		return nil, nil, err
+	}
+	return net, v, nil
+}
+
+// Create stores the network as the next version of the model described
+// by meta. The shape of the network overrides the one in meta.
+func (r *Registry) Create(meta models.ModelVersion, net *network.Network) (*models.ModelVersion, error) {
+	if !ValidName(meta.Name) {
+		return nil, ErrInvalidName
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := os.MkdirAll(filepath.Join(r.root, meta.Name), 0o755); err != nil {
+		return nil, err
+	}
+	// the version is written aside and renamed in place,
+	// so a crash never leaves a version half written
+	tmp, err := os.MkdirTemp(filepath.Join(r.root, meta.Name), ".tmp-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	if err := net.SaveTo(tmp); err != nil {
+		return nil, err
+	}
+	versions, err := r.versions(meta.Name)
+	if err != nil {
+		return nil, err
+	}
+	meta.Version = 1
+	if n := len(versions); n > 0 {
+		meta.Version = versions[n-1] + 1
+	}
+	meta.Inputs, meta.Hiddens, meta.Outputs = net.Inputs, net.Hiddens, net.Outputs
+	meta.LearningRate = net.LearningRate
+	meta.CreatedAt = time.Now().UTC()
+	meta.Size = dirSize(tmp)
+	meta.Active = false
+	if err := writeJSON(filepath.Join(tmp, metaFile), &meta); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, r.dir(meta.Name, meta.Version)); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+// Activate makes a version the active one of its model
+func (r *Registry) Activate(name string, version int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, err := r.version(name, version); err != nil {
+		return err
+	}
+	file := filepath.Join(r.root, name, activeFile)
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.Itoa(version)), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// Delete removes a version that is not active, and the
+// model itself once its last version is gone
+func (r *Registry) Delete(name string, version int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, err := r.version(name, version); err != nil {
+		return err
+	}
+	if active, err := r.active(name); err == nil && active == version {
+		return ErrActive
+	}
+	if err := os.RemoveAll(r.dir(name, version)); err != nil {
+		return err
+	}
+	if versions, err := r.versions(name); err == nil && len(versions) == 0 {
+		return os.RemoveAll(filepath.Join(r.root, name))
+	}
+	return nil
+}
+
+// Export writes a version as a zip archive of its
+// weights and metadata, the format Import reads
+func (r *Registry) Export(name string, version int, w io.Writer) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if _, err := r.version(name, version); err != nil {
+		return err
+	}
+	zw := zip.NewWriter(w)
+	for _, file := range []string{metaFile, network.HiddenWeightsFile, network.OutputWeightsFile} {
+		f, err := os.Open(filepath.Join(r.dir(name, version), file))
+		if err != nil {
+			return err
+		}
+		dst, err := zw.Create(file)
+		if err == nil {
+			_, err = io.Copy(dst, f)
+		}
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// ReadArchive reads an archive written by Export. The metadata in the
+// archive is optional; only what describes the model is kept from it,
+// Create assigns the rest.
+func ReadArchive(archive []byte) (*network.Network, models.ModelVersion, error) {
+	var meta models.ModelVersion
+	zr, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		return nil, meta, fmt.Errorf("invalid model archive: %v", err)
+	}
+	files := make(map[string][]byte)
+	for _, f := range zr.File {
+		base := path.Base(f.Name)
+		if base != metaFile && base != network.HiddenWeightsFile && base != network.OutputWeightsFile {
+			continue
+		}
+		if _, ok := files[base]; ok {
+			return nil, meta, fmt.Errorf("the model archive has more than one %s", base)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, meta, err
+		}
+		data, err := readArchived(rc, base)
+		rc.Close()
+		if err != nil {
+			return nil, meta, fmt.Errorf("%s: %v", base, err)
+		}
+		files[base] = data
+	}
+	for _, file := range []string{network.HiddenWeightsFile, network.OutputWeightsFile} {
+		if files[file] == nil {
+			return nil, meta, fmt.Errorf("the model archive has no %s", file)
+		}
+	}
+	if data, ok := files[metaFile]; ok {
+		var archived models.ModelVersion
+		if err := json.Unmarshal(data, &archived); err != nil {
+			return nil, meta, fmt.Errorf("invalid %s: %v", metaFile, err)
+		}
+		meta.Dataset = archived.Dataset
+		meta.Preprocess = archived.Preprocess
+		meta.Labels = archived.Labels
+		meta.Description = archived.Description
+		meta.Accuracy = archived.Accuracy
+		meta.LearningRate = archived.LearningRate
+	}
+	net, err := network.ReadNetwork(bytes.NewReader(files[network.HiddenWeightsFile]), bytes.NewReader(files[network.OutputWeightsFile]), meta.LearningRate)
+	if err != nil {
+		return nil, meta, err
+	}
+	return net, meta, nil
+}
+
+// readArchived reads a file of an archive, no larger than a file of its
+// name can be: the weight files are as large as the shape in their header
+func readArchived(r io.Reader, name string) ([]byte, error) {
+	if name != metaFile {
+		return network.ReadWeightsData(r)
+	}
+	data, err := io.ReadAll(io.LimitReader(r, maxMetaSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxMetaSize {
+		return nil, fmt.Errorf("larger than %d bytes", maxMetaSize)
+	}
+	return data, nil
+}
+
+// model must be called with r.mu held
+func (r *Registry) model(name string) (*models.Model, error) {
+	if !ValidName(name) {
+		return nil, ErrNotFound
+	}
+	versions, err := r.versions(name)
+	if err != nil {
+		return nil, err
+	}
+	m := &models.Model{Name: name, Versions: []models.ModelVersion{}}
+	if active, err := r.active(name); err == nil {
+		m.ActiveVersion = active
+	}
+	for _, version := range versions {
+		v, err := r.version(name, version)
+		if err != nil {
+			return nil, err
+		}
+		m.Versions = append(m.Versions, *v)
+	}
+	return m, nil
+}
+
+// version must be called with r.mu held
+func (r *Registry) version(name string, version int) (*models.ModelVersion, error) {
+	if !ValidName(name) {
+		return nil, ErrNotFound
+	}
+	data, err := os.ReadFile(filepath.Join(r.dir(name, version), metaFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	v := &models.ModelVersion{}
+	if err := json.Unmarshal(data, v); err != nil {
+		return nil, fmt.Errorf("invalid metadata of %s v%d: %v", name, version, err)
+	}
+	if active, err := r.active(name); err == nil {
+		v.Active = active == version
+	}
+	return v, nil
+}
+
+// versions returns the version numbers of a model in order.
+// It must be called with r.mu held.
+func (r *Registry) versions(name string) ([]int, error) {
+	entries, err := os.ReadDir(filepath.Join(r.root, name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var versions []int
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), "v") {
+			continue
+		}
+		if version, err := strconv.Atoi(entry.Name()[1:]); err == nil && version > 0 {
+			versions = append(versions, version)
+		}
+	}
+	sort.Ints(versions)
+	return versions, nil
+}
+
+// active must be called with r.mu held
+func (r *Registry) active(name string) (int, error) {
+	data, err := os.ReadFile(filepath.Join(r.root, name, activeFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, ErrNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	version, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid active version of %s: %v", name, err)
+	}
+	return version, nil
+}
+
+func (r *Registry) dir(name string, version int) string {
+	return filepath.Join(r.root, name, "v"+strconv.Itoa(version))
+}
+
+func writeJSON(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+func dirSize(dir string) int64 {
+	var size int64
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		if info, err := entry.Info(); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
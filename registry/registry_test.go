@@ -0,0 +1,102 @@
+package registry
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"neural-network/models"
+	"neural-network/network"
+	"strings"
+	"testing"
+)
+
+type entry struct {
+	name string
+	data []byte
+}
+
+// archive zips the entries, in order
+func archive(t *testing.T, entries ...entry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		w, err := zw.Create(e.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(e.data)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func weights(t *testing.T, net *network.Network) ([]byte, []byte) {
+	t.Helper()
+	hidden, err := net.HiddenWeights.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := net.OutputWeights.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hidden, output
+}
+
+func TestExportReadArchive(t *testing.T) {
+	r, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := r.Create(models.ModelVersion{Name: "digits", Dataset: "mnist"}, network.NewNetwork(784, 20, 10, 0.1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := r.Export("digits", v.Version, &buf); err != nil {
+		t.Fatal(err)
+	}
+	net, meta, err := ReadArchive(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if net.Inputs != 784 || net.Hiddens != 20 || net.Outputs != 10 || meta.Dataset != "mnist" {
+		t.Errorf("got a %d-%d-%d network for %q", net.Inputs, net.Hiddens, net.Outputs, meta.Dataset)
+	}
+}
+
+func TestReadArchiveRejectsOversizedEntries(t *testing.T) {
+	hidden, output := weights(t, network.NewNetwork(4, 3, 2, 0.1))
+	huge := append([]byte{}, hidden...)
+	binary.LittleEndian.PutUint64(huge[8:16], 1<<40)
+	tests := map[string][]byte{
+		// a few kilobytes that decompress to far more than the weights
+		"padded weights": archive(t,
+			entry{network.HiddenWeightsFile, append(append([]byte{}, hidden...), make([]byte, 64<<20)...)},
+			entry{network.OutputWeightsFile, output}),
+		"huge shape": archive(t,
+			entry{network.HiddenWeightsFile, huge},
+			entry{network.OutputWeightsFile, output}),
+		"large metadata": archive(t,
+			entry{metaFile, []byte(`{"description":"` + strings.Repeat("x", maxMetaSize) + `"}`)},
+			entry{network.HiddenWeightsFile, hidden},
+			entry{network.OutputWeightsFile, output}),
+		"repeated weights": archive(t,
+			entry{network.HiddenWeightsFile, hidden},
+			entry{"copy/" + network.HiddenWeightsFile, hidden},
+			entry{network.OutputWeightsFile, output}),
+	}
+	for name, data := range tests {
+		if _, _, err := ReadArchive(data); err == nil {
+			t.Errorf("%s: the archive was read", name)
+		}
+	}
+	if _, _, err := ReadArchive(archive(t,
+		entry{network.HiddenWeightsFile, hidden},
+		entry{network.OutputWeightsFile, output})); err != nil {
+		t.Errorf("a valid archive: %v", err)
+	}
+}
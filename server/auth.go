@@ -0,0 +1,176 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"neural-network/auth"
+	"neural-network/config"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// APIKeyHeader carries the API key of clients that
+// do not send it as an Authorization bearer token
+const APIKeyHeader = "X-API-Key"
+
+var (
+	errMissingKey  = errors.New("an API key is required")
+	errInvalidKey  = errors.New("invalid API key")
+	errForbidden   = errors.New("the API key does not allow this")
+	errRateLimited = errors.New("too many requests")
+)
+
+// authenticator knows the API keys and limits the clients
+type authenticator struct {
+	keys      *auth.Keyring
+	anonymous auth.Scope
+	perKey    *auth.Limiter
+	perIP     *auth.Limiter
+	// proxyHops is how many trusted proxies are in front of the server
+	proxyHops int
+}
+
+func newAuthenticator(c config.Auth) (*authenticator, error) {
+	keys := make([]auth.Key, 0, len(c.Keys))
+	for _, k := range c.Keys {
+		scope, err := auth.ParseScopes(k.Scopes)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %v", k.Name, err)
+		}
+		keys = append(keys, auth.Key{Name: k.Name, Hash: auth.Hash(k.Key), Scope: scope})
+	}
+	if c.KeysFile != "" {
+		fileKeys, err := auth.ReadKeysFile(c.KeysFile)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, fileKeys...)
+	}
+	ring, err := auth.NewKeyring(keys)
+	if err != nil {
+		return nil, err
+	}
+	anonymous, err := auth.ParseScopes(c.Anonymous)
+	if err != nil {
+		return nil, err
+	}
+	if ring.Len() == 0 && !anonymous.Allows(auth.ScopeAdmin) {
+		logrus.Warnf("no API keys are configured, requests are limited to the %s scope", anonymous)
+	}
+	hops := 0
+	if c.TrustProxy {
+		hops = c.ProxyHops
+		if hops == 0 {
+			hops = 1
+		}
+	}
+	return &authenticator{
+		keys:      ring,
+		anonymous: anonymous,
+		perKey:    auth.NewLimiter(c.RateLimit.PerKey.Rate, c.RateLimit.PerKey.Burst),
+		perIP:     auth.NewLimiter(c.RateLimit.PerIP.Rate, c.RateLimit.PerIP.Burst),
+		proxyHops: hops,
+	}, nil
+}
+
+// require lets a request through when its API key, or the anonymous
+// scope without one, allows the scope of the route. Requests with a
+// valid key are rate limited by key, the others by IP.
+func (s *Server) require(scope auth.Scope, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		value := apiKey(r)
+		if value == "" {
+			if !s.allow(w, r, s.auth.perIP, "ip:"+s.auth.clientIP(r)) {
+				return
+			}
+			if !s.auth.anonymous.Allows(scope) {
+				s.reject(w, r, http.StatusUnauthorized, "missing_key",
+					fmt.Errorf("%w: this route needs the %s scope", errMissingKey, scope))
+				return
+			}
+			next(w, r)
+			return
+		}
+		key, ok := s.auth.keys.Lookup(value)
+		if !ok {
+			if !s.allow(w, r, s.auth.perIP, "ip:"+s.auth.clientIP(r)) {
+				return
+			}
+			s.reject(w, r, http.StatusUnauthorized, "invalid_key", errInvalidKey)
+			return
+		}
+		if !s.allow(w, r, s.auth.perKey, "key:"+key.Name) {
+			return
+		}
+		if !key.Scope.Allows(scope) {
+			s.reject(w, r, http.StatusForbidden, "forbidden",
+				fmt.Errorf("%w: key %s has the %s scope, this route needs %s", errForbidden, key.Name, key.Scope, scope))
+			return
+		}
+		next(w, r)
+	}
+}
+
+// allow takes a token for the client, answering 429 when there is none
+func (s *Server) allow(w http.ResponseWriter, r *http.Request, l *auth.Limiter, client string) bool {
+	ok, wait := l.Allow(client)
+	if ok {
+		return true
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	s.reject(w, r, http.StatusTooManyRequests, "rate_limit", errRateLimited)
+	return false
+}
+
+func (s *Server) reject(w http.ResponseWriter, r *http.Request, status int, reason string, err error) {
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="neural-network"`)
+	}
+	rejectedTotal.Inc(reason)
+	s.handleError(w, r, status, err)
+}
+
+// apiKey reads the key of a request, from an Authorization
+// bearer token or the X-API-Key header
+func apiKey(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); h != "" {
+		if scheme, token, ok := strings.Cut(h, " "); ok && strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token)
+		}
+	}
+	return r.Header.Get(APIKeyHeader)
+}
+
+// clientIP is the address the request came from. Behind trusted proxies
+// it is the address the outermost one got the request from: every proxy
+// appends the address it saw to X-Forwarded-For, so that is the entry
+// as many hops from the right, and the ones before it are whatever the
+// client sent.
+func (a *authenticator) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if a.proxyHops == 0 {
+		return host
+	}
+	var addrs []string
+	for _, forwarded := range r.Header.Values("X-Forwarded-For") {
+		for _, addr := range strings.Split(forwarded, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	addrs = append(addrs, host)
+	i := len(addrs) - 1 - a.proxyHops
+	if i < 0 {
+		i = 0
+	}
+	return addrs[i]
+}
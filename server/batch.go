@@ -0,0 +1,420 @@
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"neural-network/cache"
+	"neural-network/models"
+	"neural-network/utils"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// limits of a batch request. maxBatchDecoded bounds what the zip
+// archives of a batch decompress to, and maxBatchPixels the pixels of
+// all its images once decoded.
+const (
+	maxBatchSize     = 32 << 20
+	maxBatchItems    = 256
+	maxBatchItemSize = maxUploadSize
+	maxBatchDecoded  = 64 << 20
+	maxBatchPixels   = 64 << 20
+)
+
+var (
+	errEmptyBatch    = errors.New("the batch has no images")
+	errBatchTooLarge = errors.New("batch too large")
+)
+
+// batchBudget bounds the images read from a batch. It is spent while
+// reading, so an archive with too many entries or that decompresses to
+// too much is given up on before it is expanded.
+type batchBudget struct {
+	items    int
+	maxItems int
+	bytes    int64
+}
+
+func newBatchBudget(maxItems int, maxBytes int64) *batchBudget {
+	return &batchBudget{maxItems: maxItems, bytes: maxBytes}
+}
+
+// next counts one more image
+func (b *batchBudget) next() error {
+	if b.items == b.maxItems {
+		return fmt.Errorf("%w: at most %d images", errBatchTooLarge, b.maxItems)
+	}
+	b.items++
+	return nil
+}
+
+// read reads an image of at most limit bytes out of the bytes left.
+// An image over the limit only fails its own item.
+func (b *batchBudget) read(r io.Reader, limit int64) ([]byte, error) {
+	max := limit
+	if b.bytes < max {
+		max = b.bytes
+	}
+	data, err := io.ReadAll(io.LimitReader(r, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > max {
+		if max < limit {
+			return nil, fmt.Errorf("%w: the archives decompress to too many bytes", errBatchTooLarge)
+		}
+		return nil, fmt.Errorf("image larger than %d bytes", limit)
+	}
+	b.bytes -= int64(len(data))
+	return data, nil
+}
+
+// batchItem is one image of a batch, still encoded
+type batchItem struct {
+	name string
+	data []byte
+	err  error
+}
+
+// batchRequest is the JSON form of a batch: either an object with the
+// images and the preprocessing values, or just an array of images.
+// Images are base64 strings or data URLs.
+type batchRequest struct {
+	Images   []string         `json:"images"`
+	Invert   models.FormValue `json:"invert"`
+	Binarize models.FormValue `json:"binarize"`
+	Deskew   models.FormValue `json:"deskew"`
+}
+
+func (s *Server) predictBatchRoute(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	m, err := s.pickModel(r)
+	if err != nil {
+		s.handleError(w, r, http.StatusNotFound, err)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxBatchSize)
+	items, values, err := readBatch(r)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) || errors.Is(err, errBatchTooLarge) {
+		s.handleError(w, r, http.StatusRequestEntityTooLarge, err)
+		return
+	}
+	if errors.Is(err, errUnsupportedMedia) {
+		s.handleError(w, r, http.StatusUnsupportedMediaType, err)
+		return
+	}
+	if err != nil {
+		s.handleError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if len(items) == 0 {
+		s.handleError(w, r, http.StatusBadRequest, errEmptyBatch)
+		return
+	}
+	resp, err := s.PredictBatch(m, items, values)
+	if err != nil {
+		s.handleError(w, r, http.StatusRequestEntityTooLarge, err)
+		return
+	}
+	var answers []answer
+	for _, item := range resp.Items {
+		if item.Success {
+			answers = append(answers, answer{item.Label, item.Accuracy})
+		}
+	}
+	m.observe(start, answers...)
+	resp.Time = time.Since(start).String()
+	s.sendResponse(w, r, http.StatusOK, resp, start)
+}
+
+// PredictBatch predicts every image of the batch. Images that are not in
+// the cache go through the network together as one matrix. An image that
+// cannot be read only fails its own item, the whole batch fails when its
+// images decode to more than maxBatchPixels pixels. Only the inputs of
+// the network are kept, each image is dropped once it is read.
+func (s *Server) PredictBatch(m *servedModel, items []batchItem, values url.Values) (*models.BatchPredictResponse, error) {
+	resp := &models.BatchPredictResponse{Items: make([]models.BatchItem, len(items))}
+	resp.Operation = "predict_batch"
+	resp.Model = m.id()
+	resp.Variant = m.variant
+	var pending []int
+	var inputs [][]float64
+	prepared := make([]*prediction, len(items))
+	pixels := maxBatchPixels
+	for i, item := range items {
+		out := &resp.Items[i]
+		out.Index = i
+		out.Name = item.name
+		if item.err != nil {
+			out.Error = item.err.Error()
+			continue
+		}
+		config, _, err := utils.DecodeConfig(bytes.NewReader(item.data))
+		if err != nil {
+			out.Error = err.Error()
+			continue
+		}
+		if size := config.Width * config.Height; size <= maxImagePixels {
+			if pixels -= size; pixels < 0 {
+				return nil, fmt.Errorf("%w: the images decode to more than %d pixels", errBatchTooLarge, maxBatchPixels)
+			}
+		}
+		img, _, err := utils.DecodeLimited(bytes.NewReader(item.data), maxImagePixels)
+		if err != nil {
+			out.Error = err.Error()
+			continue
+		}
+		sum := sha256.Sum256(item.data)
+		p, err := prepare(img, hex.EncodeToString(sum[:]), values)
+		if err != nil {
+			out.Error = err.Error()
+			continue
+		}
+		p.image = nil
+		prepared[i] = p
+		out.Polarity = p.polarity.String()
+		out.PolaritySource = p.source
+		p.key = m.cacheNamespace() + p.key
+		isCached, cached, err := checkCache(p.key)
+		if err != nil {
+			logrus.Warnf("cache lookup failed: %v", err)
+		}
+		if isCached {
+			out.Prediction = cached.Prediction
+			out.Label = m.label(cached.Prediction)
+			out.Results = cached.Results
+			out.Accuracy = cached.Accuracy
+			out.Cached = true
+			out.Success = true
+			continue
+		}
+		pending = append(pending, i)
+		inputs = append(inputs, m.imageData(img, p.opts))
+	}
+
+	if len(inputs) > 0 {
+		output := m.net.PredictBatch(inputs)
+		for j, i := range pending {
+			out := &resp.Items[i]
+			prediction, results, accuracy := columnResults(output, j)
+			out.Prediction = prediction
+			out.Label = m.label(prediction)
+			out.Results = makeResultsMap(results)
+			out.Accuracy = accuracy
+			out.Success = true
+			s.cacheItem(prepared[i].key, out)
+		}
+	}
+	for _, item := range resp.Items {
+		if !item.Success {
+			resp.Failed++
+		}
+	}
+	resp.Count = len(items)
+	resp.Success = resp.Failed < resp.Count
+	return resp, nil
+}
+
+// cacheItem stores a batch result in the same shape as a /predict
+// response, so both endpoints share their cache entries
+func (s *Server) cacheItem(key string, item *models.BatchItem) {
+	value := &models.PredictResponse{
+		Results:    item.Results,
+		Prediction: item.Prediction,
+		Accuracy:   item.Accuracy,
+	}
+	value.Operation = "predict"
+	data, err := json.Marshal(value)
+	if err == nil {
+		err = cache.Put(key, string(data))
+	}
+	if err != nil {
+		logrus.Warnf("cannot cache batch item: %v", err)
+	}
+}
+
+// readBatch reads the images of a multipart, zip or JSON request,
+// at most maxBatchItems of them
+func readBatch(r *http.Request) ([]batchItem, url.Values, error) {
+	values := r.URL.Query()
+	budget := newBatchBudget(maxBatchItems, maxBatchDecoded)
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", errUnsupportedMedia, err)
+	}
+	switch mediaType {
+	case "multipart/form-data":
+		items, err := readMultipartBatch(r, values, budget)
+		return items, values, err
+	case "application/zip", "application/x-zip-compressed":
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			return nil, nil, err
+		}
+		items, err := readZipBatch(data, budget)
+		return items, values, err
+	case "application/json":
+		items, err := readJSONBatch(r.Body, values, budget)
+		return items, values, err
+	}
+	return nil, nil, fmt.Errorf("%w: %s, send a multipart form, a zip or JSON", errUnsupportedMedia, mediaType)
+}
+
+// readMultipartBatch reads every file part as an image,
+// expanding the zip archives among them
+func readMultipartBatch(r *http.Request, values url.Values, budget *batchBudget) ([]batchItem, error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	var items []batchItem
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return items, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if part.FileName() == "" {
+			value, err := io.ReadAll(io.LimitReader(part, maxFieldSize))
+			part.Close()
+			if err != nil {
+				return nil, err
+			}
+			values.Set(part.FormName(), string(value))
+			continue
+		}
+		data, err := readLimited(part, maxBatchItemSize)
+		part.Close()
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return nil, err
+		}
+		if err == nil && isZip(data) {
+			var entries []batchItem
+			entries, err = readZipBatch(data, budget)
+			if errors.Is(err, errBatchTooLarge) {
+				return nil, err
+			}
+			if err == nil {
+				items = append(items, entries...)
+				continue
+			}
+			data = nil
+		}
+		if err := budget.next(); err != nil {
+			return nil, err
+		}
+		items = append(items, batchItem{name: part.FileName(), data: data, err: err})
+	}
+}
+
+// readZipBatch reads every file of a zip archive as an image,
+// spending the budget entry by entry
+func readZipBatch(data []byte, budget *batchBudget) ([]batchItem, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid zip archive: %v", err)
+	}
+	var items []batchItem
+	for _, f := range zr.File {
+		name := f.Name
+		if f.FileInfo().IsDir() || strings.HasPrefix(name, "__MACOSX/") || strings.HasPrefix(path.Base(name), ".") {
+			continue
+		}
+		if err := budget.next(); err != nil {
+			return nil, err
+		}
+		rc, err := f.Open()
+		if err != nil {
+			items = append(items, batchItem{name: name, err: err})
+			continue
+		}
+		data, err := budget.read(rc, maxBatchItemSize)
+		rc.Close()
+		if errors.Is(err, errBatchTooLarge) {
+			return nil, err
+		}
+		items = append(items, batchItem{name: name, data: data, err: err})
+	}
+	return items, nil
+}
+
+func readJSONBatch(body io.Reader, values url.Values, budget *batchBudget) ([]batchItem, error) {
+	raw, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	var req batchRequest
+	if trimmed := bytes.TrimSpace(raw); len(trimmed) > 0 && trimmed[0] == '[' {
+		err = json.Unmarshal(trimmed, &req.Images)
+	} else {
+		err = json.Unmarshal(raw, &req)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range map[string]models.FormValue{"invert": req.Invert, "binarize": req.Binarize, "deskew": req.Deskew} {
+		if value != "" {
+			values.Set(name, string(value))
+		}
+	}
+	items := make([]batchItem, len(req.Images))
+	for i, encoded := range req.Images {
+		if err := budget.next(); err != nil {
+			return nil, err
+		}
+		items[i].name = fmt.Sprintf("images[%d]", i)
+		items[i].data, items[i].err = decodeBase64Image(encoded)
+	}
+	return items, nil
+}
+
+// decodeBase64Image accepts standard, URL safe and unpadded base64,
+// optionally wrapped in a data URL such as "data:image/png;base64,..."
+func decodeBase64Image(encoded string) ([]byte, error) {
+	encoded = strings.TrimSpace(encoded)
+	if strings.HasPrefix(encoded, "data:") {
+		comma := strings.IndexByte(encoded, ',')
+		if comma < 0 || !strings.HasSuffix(encoded[:comma], ";base64") {
+			return nil, errors.New("only base64 data URLs are supported")
+		}
+		encoded = encoded[comma+1:]
+	}
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if data, err := enc.DecodeString(encoded); err == nil {
+			return data, nil
+		}
+	}
+	return nil, errors.New("invalid base64 image")
+}
+
+func readLimited(r io.Reader, limit int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("image larger than %d bytes", limit)
+	}
+	return data, nil
+}
+
+func isZip(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("PK\x03\x04"))
+}
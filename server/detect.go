@@ -0,0 +1,135 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"neural-network/images"
+	"neural-network/models"
+	"neural-network/network"
+	"neural-network/utils"
+	"strconv"
+	"time"
+)
+
+// maxDetectPixels bounds the images searched for digits, the work of a
+// detection grows with the pixels of every level of the pyramid
+const maxDetectPixels = 4 << 20
+
+func (s *Server) detectRoute(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	m, err := s.pickModel(r)
+	if err != nil {
+		s.handleError(w, r, http.StatusNotFound, err)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+	resp, status, err := s.DetectDigits(m, r)
+	if err != nil {
+		s.handleError(w, r, status, err)
+		return
+	}
+	answers := make([]answer, len(resp.Detections))
+	for i, d := range resp.Detections {
+		answers[i] = answer{d.Label, d.Confidence}
+	}
+	m.observe(start, answers...)
+	resp.Time = time.Since(start).String()
+	s.sendResponse(w, r, http.StatusOK, resp, start)
+}
+
+// DetectDigits finds the digits of an uploaded photo, wherever they are.
+// Besides the values /predict reads, the request can set "min_size", the
+// height in pixels of the smallest digit searched, "min_confidence" in
+// percent, and "annotate" to get the image back with the detections drawn.
+func (s *Server) DetectDigits(m *servedModel, r *http.Request) (*models.DetectResponse, int, error) {
+	u, err := readUpload(r, maxDetectPixels)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) || errors.Is(err, utils.ErrImageTooLarge) {
+		return nil, http.StatusRequestEntityTooLarge, err
+	}
+	if err == utils.ErrUnsupportedFormat || errors.Is(err, errUnsupportedMedia) {
+		return nil, http.StatusUnsupportedMediaType, err
+	}
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	if m.preprocess != PreprocessMNIST {
+		return nil, http.StatusBadRequest, fmt.Errorf("detection needs a model with the %s preprocessing", PreprocessMNIST)
+	}
+	p, err := prepare(u.image, u.checksum, u.values)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	opts, annotate, err := detectOptions(u.values, p.opts)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	detections, err := m.net.Detect(p.image, opts)
+	if errors.Is(err, network.ErrDetectionTooLarge) {
+		return nil, http.StatusRequestEntityTooLarge, err
+	}
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	resp := &models.DetectResponse{Detections: []models.DigitPrediction{}}
+	resp.Operation = "detect"
+	resp.Model = m.id()
+	resp.Variant = m.variant
+	labels := make([]images.Label, len(detections))
+	for i, d := range detections {
+		confidence := float64(int(d.Confidence*10000)) / 100
+		resp.Detections = append(resp.Detections, models.DigitPrediction{
+			Digit:      d.Digit,
+			Label:      m.label(d.Digit),
+			Confidence: confidence,
+			Box: models.Box{
+				X:      d.Box.Min.X,
+				Y:      d.Box.Min.Y,
+				Width:  d.Box.Dx(),
+				Height: d.Box.Dy(),
+			},
+		})
+		labels[i] = images.Label{Box: d.Box, Text: fmt.Sprintf("%s %.0f%%", m.label(d.Digit), confidence)}
+	}
+	resp.Count = len(resp.Detections)
+	if annotate {
+		var buf bytes.Buffer
+		if err := utils.Encode(&buf, images.Annotate(p.image, labels), utils.PNG); err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		resp.Annotated = "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())
+	}
+	resp.Success = true
+	return resp, http.StatusOK, nil
+}
+
+// detectOptions reads the detection values of a request
+func detectOptions(values url.Values, mnist images.MNISTOptions) (network.DetectOptions, bool, error) {
+	opts := network.DefaultDetectOptions
+	opts.MNIST = mnist
+	var annotate bool
+	var err error
+	if v := values.Get("min_size"); v != "" {
+		if opts.MinSize, err = strconv.Atoi(v); err != nil || opts.MinSize < 8 {
+			return opts, false, fmt.Errorf("min_size must be a number of pixels of at least 8, got %q", v)
+		}
+	}
+	if v := values.Get("min_confidence"); v != "" {
+		percent, err := strconv.ParseFloat(v, 64)
+		if err != nil || percent < 0 || percent > 100 {
+			return opts, false, fmt.Errorf("min_confidence must be a percentage, got %q", v)
+		}
+		opts.Threshold = percent / 100
+	}
+	if v := values.Get("annotate"); v != "" {
+		if annotate, err = strconv.ParseBool(v); err != nil {
+			return opts, false, fmt.Errorf("annotate must be true or false: %v", err)
+		}
+	}
+	return opts, annotate, nil
+}
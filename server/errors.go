@@ -0,0 +1,160 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"neural-network/models"
+	"neural-network/registry"
+	"neural-network/utils"
+	"strings"
+)
+
+// maxJSONSize bounds the JSON bodies of the requests that are not uploads
+const maxJSONSize = 1 << 20
+
+var (
+	errUnsupportedMedia = errors.New("unsupported content type")
+	errInvalidRequest   = errors.New("invalid request")
+	errRouteNotFound    = errors.New("no such route")
+	errMethodNotAllowed = errors.New("method not allowed on this route")
+)
+
+// errorCodes gives the errors the server knows a code of their own,
+// the others get the code of their status
+var errorCodes = []struct {
+	err  error
+	code string
+}{
+	{errMissingImage, models.CodeMissingImage},
+	{errUnsupportedMedia, models.CodeUnsupportedMedia},
+	{utils.ErrUnsupportedFormat, models.CodeUnsupportedMedia},
+	{utils.ErrImageTooLarge, models.CodeImageTooLarge},
+	{errMissingKey, models.CodeMissingKey},
+	{errInvalidKey, models.CodeInvalidKey},
+	{errForbidden, models.CodeForbidden},
+	{errRateLimited, models.CodeRateLimited},
+	{errModelNotServed, models.CodeModelNotFound},
+	{registry.ErrNotFound, models.CodeModelNotFound},
+	{errJobNotFound, models.CodeJobNotFound},
+	{errJobRunning, models.CodeJobRunning},
+	{errNotTrainable, models.CodeNoTrainingData},
+	{errNoTestSet, models.CodeNoTrainingData},
+}
+
+var statusCodes = map[int]string{
+	http.StatusBadRequest:            models.CodeBadRequest,
+	http.StatusUnauthorized:          models.CodeInvalidKey,
+	http.StatusForbidden:             models.CodeForbidden,
+	http.StatusNotFound:              models.CodeNotFound,
+	http.StatusMethodNotAllowed:      models.CodeMethodNotAllowed,
+	http.StatusConflict:              models.CodeConflict,
+	http.StatusRequestEntityTooLarge: models.CodeTooLarge,
+	http.StatusUnsupportedMediaType:  models.CodeUnsupportedMedia,
+	http.StatusUnprocessableEntity:   models.CodeValidation,
+	http.StatusTooManyRequests:       models.CodeRateLimited,
+	http.StatusServiceUnavailable:    models.CodeUnavailable,
+}
+
+// validationError lists every invalid field of a request
+type validationError struct {
+	details []models.ErrorDetail
+}
+
+func (e *validationError) Error() string {
+	msgs := make([]string, len(e.details))
+	for i, d := range e.details {
+		msgs[i] = d.Field + ": " + d.Message
+	}
+	return fmt.Sprintf("%v: %s", errInvalidRequest, strings.Join(msgs, "; "))
+}
+
+func (e *validationError) Unwrap() error {
+	return errInvalidRequest
+}
+
+// check records the field as invalid unless ok
+func (e *validationError) check(ok bool, field, format string, args ...interface{}) {
+	if !ok {
+		e.details = append(e.details, models.ErrorDetail{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+}
+
+// err is nil when every field is valid
+func (e *validationError) err() error {
+	if len(e.details) == 0 {
+		return nil
+	}
+	return e
+}
+
+// errorCode is the code the client gets for an error
+func errorCode(status int, err error) string {
+	var invalid *validationError
+	if errors.As(err, &invalid) {
+		return models.CodeValidation
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return models.CodeTooLarge
+	}
+	var syntax *json.SyntaxError
+	var typ *json.UnmarshalTypeError
+	if errors.As(err, &syntax) || errors.As(err, &typ) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return models.CodeInvalidJSON
+	}
+	for _, c := range errorCodes {
+		if errors.Is(err, c.err) {
+			return c.code
+		}
+	}
+	if code, ok := statusCodes[status]; ok {
+		return code
+	}
+	if status >= http.StatusInternalServerError {
+		return models.CodeInternal
+	}
+	return models.CodeBadRequest
+}
+
+// handleError answers with the error and logs it. Handlers must
+// return right after it, a request gets a single response.
+func (s *Server) handleError(w http.ResponseWriter, r *http.Request, status int, cause error) {
+	resp := models.NewErrorResponse(status, errorCode(status, cause), cause)
+	var invalid *validationError
+	if errors.As(cause, &invalid) {
+		resp.Message = errInvalidRequest.Error()
+		resp.Details = invalid.details
+	}
+	resp.RequestID = requestID(r)
+	response, _ := json.Marshal(resp)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(response)
+	s.logger.Error(status, r.URL.Path, fmt.Errorf("%s: %w", resp.RequestID, cause))
+}
+
+// decodeJSON reads the JSON body of a request into v, answering
+// with the error and returning false when it cannot. Unknown fields
+// are rejected, so a misspelt option is not silently ignored.
+func (s *Server) decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	r.Body = http.MaxBytesReader(w, r.Body, maxJSONSize)
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	if err == nil {
+		return true
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		s.handleError(w, r, http.StatusRequestEntityTooLarge, err)
+		return false
+	}
+	if err == io.EOF {
+		err = errors.New("the request body is empty")
+	}
+	s.handleError(w, r, http.StatusBadRequest, err)
+	return false
+}
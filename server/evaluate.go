@@ -0,0 +1,392 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"net/url"
+	"neural-network/models"
+	"neural-network/network"
+	"neural-network/utils"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// JobKindEvaluate is the kind of the jobs started by POST /evaluate
+const JobKindEvaluate = "evaluate"
+
+// limits of an uploaded labeled set. The images of a zip are held in
+// memory for the job, maxEvaluationImages and maxEvaluationDecoded bound
+// them once decompressed.
+const (
+	maxEvaluationSize    = 64 << 20
+	maxEvaluationImages  = 10000
+	maxEvaluationDecoded = 256 << 20
+)
+
+// samples evaluated between two progress events
+const evaluationBatch = 500
+
+var (
+	errNoTestSet       = errors.New("the model has no test set, upload a labeled set")
+	errTestSetMissing  = errors.New("the test set is not available")
+	errEmptyEvaluation = errors.New("the labeled set has no samples")
+)
+
+// evalSet is a labeled set a model is evaluated on. each streams the
+// inputs of its samples with their label, as an index in the labels
+// of the model, and size is how many there are.
+type evalSet struct {
+	name string
+	size int
+	each func(fn func(inputs []float64, label int) error) error
+}
+
+// evaluateRoute starts a job that runs the model against a labeled set:
+// the test set of its dataset, or one uploaded as a CSV in the MNIST
+// format or a zip of images in directories named after their label
+func (s *Server) evaluateRoute(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	m, err := s.routeModel(r)
+	if err != nil {
+		s.handleError(w, r, http.StatusNotFound, err)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxEvaluationSize)
+	set, err := s.evaluationSet(m, r)
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge), errors.Is(err, errBatchTooLarge):
+		s.handleError(w, r, http.StatusRequestEntityTooLarge, err)
+		return
+	case errors.Is(err, errUnsupportedMedia):
+		s.handleError(w, r, http.StatusUnsupportedMediaType, err)
+		return
+	case errors.Is(err, errInvalidRequest):
+		s.handleError(w, r, http.StatusUnprocessableEntity, err)
+		return
+	case errors.Is(err, errNoTestSet):
+		s.handleError(w, r, http.StatusConflict, err)
+		return
+	case errors.Is(err, errTestSetMissing):
+		s.handleError(w, r, http.StatusServiceUnavailable, err)
+		return
+	case err != nil:
+		s.handleError(w, r, http.StatusBadRequest, err)
+		return
+	case set.size == 0:
+		s.handleError(w, r, http.StatusBadRequest, errEmptyEvaluation)
+		return
+	}
+	j, err := s.jobs.start(JobKindEvaluate, m.name, 0, func(ctx context.Context, j *job) error {
+		return s.runEvaluation(ctx, j, m, set)
+	})
+	if err != nil {
+		s.handleError(w, r, http.StatusConflict, err)
+		return
+	}
+	resp := &models.EvaluateResponse{Message: "Evaluation started", JobID: j.state.ID, Model: m.id(), Data: set.name}
+	resp.Operation = "evaluate"
+	resp.Success = true
+	resp.Time = time.Since(start).String()
+	s.sendResponse(w, r, http.StatusAccepted, resp, start)
+}
+
+// evaluationSet reads the labeled set of a request: the test set without
+// a body, a CSV or zip body, or a multipart form with one in its file
+// and the "invert", "binarize" and "deskew" values for the images of a zip
+func (s *Server) evaluationSet(m *servedModel, r *http.Request) (*evalSet, error) {
+	values := r.URL.Query()
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		return testSet(m)
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errUnsupportedMedia, err)
+	}
+	var name string
+	var data []byte
+	switch mediaType {
+	case "multipart/form-data":
+		if name, data, err = readEvaluationForm(r, values); err != nil {
+			return nil, err
+		}
+		if data == nil {
+			return testSet(m)
+		}
+	case "text/csv", "application/zip", "application/x-zip-compressed":
+		name = "upload"
+		if data, err = io.ReadAll(r.Body); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("%w: %s, send a CSV, a zip or a multipart form", errUnsupportedMedia, mediaType)
+	}
+	if isZip(data) {
+		return zipSet(m, name, data, values)
+	}
+	return csvSet(m, name, data), nil
+}
+
+// readEvaluationForm reads the file of a multipart form and its values
+func readEvaluationForm(r *http.Request, values url.Values) (string, []byte, error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return "", nil, err
+	}
+	var name string
+	var data []byte
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return name, data, nil
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		if part.FileName() == "" {
+			value, err := io.ReadAll(io.LimitReader(part, maxFieldSize))
+			part.Close()
+			if err != nil {
+				return "", nil, err
+			}
+			values.Set(part.FormName(), string(value))
+			continue
+		}
+		if data != nil {
+			part.Close()
+			return "", nil, errors.New("upload a single labeled set")
+		}
+		name = part.FileName()
+		data, err = io.ReadAll(part)
+		part.Close()
+		if err != nil {
+			return "", nil, err
+		}
+	}
+}
+
+// testSet is the test set of the dataset of the model
+func testSet(m *servedModel) (*evalSet, error) {
+	if !trainable(m.dataset) {
+		return nil, fmt.Errorf("%w: %s was not trained on %s or %s", errNoTestSet, m.name, DatasetMNIST, DatasetCIFAR10)
+	}
+	file, count, read := network.MnistTestFile, network.MnistCount, m.net.ReadMnistRecords
+	if m.dataset == DatasetCIFAR10 {
+		file, count, read = network.CifarTestFile, network.CifarCount, network.ReadCifarRecords
+	}
+	size, err := count(file)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errTestSetMissing, err)
+	}
+	return &evalSet{
+		name: file,
+		size: size,
+		each: func(fn func(inputs []float64, label int) error) error {
+			f, err := os.Open(file)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			return read(f, fn)
+		},
+	}, nil
+}
+
+// csvSet reads a CSV in the MNIST format, one value per input of the model
+func csvSet(m *servedModel, name string, data []byte) *evalSet {
+	size := bytes.Count(data, []byte{'\n'})
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		size++
+	}
+	return &evalSet{
+		name: name,
+		size: size,
+		each: func(fn func(inputs []float64, label int) error) error {
+			return m.net.ReadMnistRecords(bytes.NewReader(data), fn)
+		},
+	}
+}
+
+// zipSet reads a zip of images in directories named after their label,
+// preprocessed as the model does for predictions
+func zipSet(m *servedModel, name string, data []byte, values url.Values) (*evalSet, error) {
+	items, err := readZipBatch(data, newBatchBudget(maxEvaluationImages, maxEvaluationDecoded))
+	if err != nil {
+		return nil, err
+	}
+	labels := make(map[string]int, len(m.labels))
+	for i, l := range m.labels {
+		labels[l] = i
+	}
+	invalid := &validationError{}
+	classes := make([]int, len(items))
+	for i, item := range items {
+		dir := path.Base(path.Dir(item.name))
+		class, ok := labels[dir]
+		invalid.check(ok, item.name, "%q is not a label of %s, the images go in a directory named after their label", dir, m.id())
+		classes[i] = class
+	}
+	for _, field := range []string{"binarize", "deskew"} {
+		if v := values.Get(field); v != "" {
+			_, err := strconv.ParseBool(v)
+			invalid.check(err == nil, field, "must be true or false")
+		}
+	}
+	if invert := values.Get("invert"); invert != "" && !strings.EqualFold(invert, "auto") {
+		_, err := strconv.ParseBool(invert)
+		invalid.check(err == nil, "invert", "must be auto, true or false")
+	}
+	if err := invalid.err(); err != nil {
+		return nil, err
+	}
+	return &evalSet{
+		name: name,
+		size: len(items),
+		each: func(fn func(inputs []float64, label int) error) error {
+			for i, item := range items {
+				if item.err != nil {
+					return fmt.Errorf("%s: %v", item.name, item.err)
+				}
+				img, _, err := utils.DecodeLimited(bytes.NewReader(item.data), maxImagePixels)
+				if err != nil {
+					return fmt.Errorf("%s: %v", item.name, err)
+				}
+				p, err := prepare(img, "", values)
+				if err != nil {
+					return fmt.Errorf("%s: %v", item.name, err)
+				}
+				if err := fn(m.imageData(img, p.opts), classes[i]); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}, nil
+}
+
+// runEvaluation predicts every sample of the set with the model and
+// reports the accuracy, confusion matrix and scores of every label.
+// Progress is published to the job every evaluationBatch samples.
+func (s *Server) runEvaluation(ctx context.Context, j *job, m *servedModel, set *evalSet) error {
+	start := time.Now()
+	classes := m.net.Outputs
+	confusion := make([][]int, classes)
+	for i := range confusion {
+		confusion[i] = make([]int, classes)
+	}
+	samples := 0
+	report := func() {
+		jp := models.JobProgress{Samples: samples, EpochSize: set.size}
+		if set.size > 0 {
+			jp.Percent = math.Min(float64(samples)/float64(set.size), 1) * 100
+		}
+		if elapsed := time.Since(start); elapsed > 0 {
+			jp.Throughput = float64(samples) / elapsed.Seconds()
+		}
+		if remaining := set.size - samples; jp.Throughput > 0 && remaining > 0 {
+			jp.ETA = time.Duration(float64(remaining) / jp.Throughput * float64(time.Second)).Round(time.Second).String()
+		}
+		j.update(func(state *models.Job) {
+			state.Progress = jp
+		})
+		j.publish(models.JobEvent{Type: EventProgress, Progress: &jp})
+	}
+	err := set.each(func(inputs []float64, label int) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if len(inputs) != m.net.Inputs {
+			return fmt.Errorf("sample %d has %d inputs, %s takes %d", samples+1, len(inputs), m.id(), m.net.Inputs)
+		}
+		if label >= classes {
+			return fmt.Errorf("sample %d has label %d, %s has %d labels", samples+1, label, m.id(), classes)
+		}
+		predicted, _, _ := columnResults(m.net.Predict(inputs), 0)
+		confusion[label][predicted]++
+		samples++
+		if samples%evaluationBatch == 0 {
+			report()
+		}
+		return nil
+	})
+	if err != nil {
+		logrus.WithField("job", j.state.ID).Errorf("evaluation stopped: %v", err)
+		return err
+	}
+	if samples == 0 {
+		return errEmptyEvaluation
+	}
+	report()
+	labels := make([]string, classes)
+	for i := range labels {
+		labels[i] = m.label(i)
+	}
+	metrics := evaluationMetrics(confusion, labels)
+	metrics.Model = m.id()
+	metrics.Data = set.name
+	metrics.Duration = time.Since(start).String()
+	j.update(func(state *models.Job) {
+		state.Evaluation = metrics
+	})
+	return nil
+}
+
+// evaluationMetrics scores every label from the confusion matrix. The
+// macro F1 is the mean F1 of the labels that have samples in the set.
+func evaluationMetrics(confusion [][]int, labels []string) *models.EvaluationMetrics {
+	metrics := &models.EvaluationMetrics{
+		Labels:    labels,
+		Confusion: confusion,
+		Classes:   make([]models.ClassMetrics, len(labels)),
+	}
+	present := 0
+	for i := range confusion {
+		c := &metrics.Classes[i]
+		c.Label = labels[i]
+		for j := range confusion {
+			c.Support += confusion[i][j]
+			c.Predicted += confusion[j][i]
+		}
+		hits := float64(confusion[i][i])
+		metrics.Samples += c.Support
+		metrics.Correct += confusion[i][i]
+		if c.Predicted > 0 {
+			c.Precision = hits / float64(c.Predicted) * 100
+		}
+		if c.Support > 0 {
+			c.Recall = hits / float64(c.Support) * 100
+			present++
+		}
+		if c.Precision+c.Recall > 0 {
+			c.F1 = 2 * c.Precision * c.Recall / (c.Precision + c.Recall)
+		}
+		if c.Support > 0 {
+			metrics.MacroF1 += c.F1
+		}
+		c.Precision, c.Recall, c.F1 = round2(c.Precision), round2(c.Recall), round2(c.F1)
+	}
+	if present > 0 {
+		metrics.MacroF1 = round2(metrics.MacroF1 / float64(present))
+	}
+	if metrics.Samples > 0 {
+		metrics.Accuracy = round2(float64(metrics.Correct) / float64(metrics.Samples) * 100)
+	}
+	return metrics
+}
+
+// round2 rounds a percent to two decimals
+func round2(v float64) float64 {
+	return math.Round(v*100) / 100
+}
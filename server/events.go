@@ -0,0 +1,87 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"neural-network/models"
+	"time"
+
+	"github.com/fehernandez12/sonate"
+)
+
+// comments sent on idle streams so proxies keep the connection open
+const keepAliveInterval = 15 * time.Second
+
+// jobEventsRoute streams the events of a job as Server-Sent Events
+// until the job finishes or the client goes away.
+func (s *Server) jobEventsRoute(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	j, err := s.jobs.get(sonate.Vars(r)["id"])
+	if err != nil {
+		s.handleError(w, r, http.StatusNotFound, err)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		s.handleError(w, r, http.StatusInternalServerError, errors.New("streaming is not supported"))
+		return
+	}
+	events, unsubscribe := j.subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+	terminal := false
+	for {
+		select {
+		case <-r.Context().Done():
+			s.logger.Info(http.StatusOK, r.URL.Path, start)
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case event, ok := <-events:
+			if !ok {
+				// the final status may have been dropped
+				// if the client was falling behind
+				if !terminal {
+					state := j.snapshot()
+					writeEvent(w, models.JobEvent{Type: EventStatus, JobID: state.ID, Job: state})
+					flusher.Flush()
+				}
+				s.logger.Info(http.StatusOK, r.URL.Path, start)
+				return
+			}
+			if event.Job != nil {
+				terminal = isTerminal(event.Job.Status)
+			}
+			if err := writeEvent(w, event); err != nil {
+				s.logger.Error(http.StatusInternalServerError, r.URL.Path, err)
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, event models.JobEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+	return err
+}
+
+func isTerminal(status string) bool {
+	return status == JobSucceeded || status == JobFailed || status == JobCancelled
+}
@@ -2,48 +2,124 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"neural-network/models"
-	"os"
 	"time"
+
+	"github.com/fehernandez12/sonate"
 )
 
-type ErrorResponse struct {
-	Messages []string `json:messages`
+func (s *Server) trainRoute(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	m, err := s.routeModel(r)
+	if err != nil {
+		s.handleError(w, r, http.StatusNotFound, err)
+		return
+	}
+	var req models.TrainRequest
+	if !s.decodeJSON(w, r, &req) {
+		return
+	}
+	resp, err := s.TrainNetwork(m, &req)
+	if err == errJobRunning || errors.Is(err, errNotTrainable) {
+		s.handleError(w, r, http.StatusConflict, err)
+		return
+	}
+	if errors.Is(err, errInvalidRequest) {
+		s.handleError(w, r, http.StatusUnprocessableEntity, err)
+		return
+	}
+	if err != nil {
+		s.handleError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	statusCode := getStatusCode(resp.GetOperation())
+	if resp.JobID != "" {
+		statusCode = http.StatusAccepted
+	}
+	s.sendResponse(w, r, statusCode, resp, start)
+}
+
+func (s *Server) listJobsRoute(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	resp := &models.JobListResponse{Jobs: s.jobs.list()}
+	resp.Operation = "jobs"
+	resp.Success = true
+	resp.Time = time.Since(start).String()
+	s.sendResponse(w, r, http.StatusOK, resp, start)
 }
 
-func (s *Server) handleError(w http.ResponseWriter, statusCode int, route string, cause error) {
-	errorResponse := &ErrorResponse{}
-	errorResponse.Messages = append(errorResponse.Messages, cause.Error())
-	response, err := json.Marshal(errorResponse)
+func (s *Server) jobRoute(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	j, err := s.jobs.get(sonate.Vars(r)["id"])
 	if err != nil {
-		s.handleError(w, http.StatusInternalServerError, route, err)
+		s.handleError(w, r, http.StatusNotFound, err)
+		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(statusCode)
-	w.Write(response)
-	s.logger.Error(statusCode, route, cause)
+	resp := &models.JobResponse{Job: j.snapshot()}
+	resp.Operation = "job"
+	resp.Success = true
+	resp.Time = time.Since(start).String()
+	s.sendResponse(w, r, http.StatusOK, resp, start)
 }
 
-func (s *Server) trainRoute(w http.ResponseWriter, r *http.Request) {
+func (s *Server) jobMetricsRoute(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
-	var req models.TrainRequest
-	decoder := json.NewDecoder(r.Body)
-	err := decoder.Decode(&req)
+	j, err := s.jobs.get(sonate.Vars(r)["id"])
 	if err != nil {
-		s.handleError(w, http.StatusBadRequest, "/train", err)
+		s.handleError(w, r, http.StatusNotFound, err)
+		return
+	}
+	state := j.snapshot()
+	if state.Metrics == nil && state.Evaluation == nil {
+		if !j.finished() {
+			err = errJobNotDone
+		} else {
+			err = fmt.Errorf("job %s has no metrics", state.Status)
+		}
+		s.handleError(w, r, http.StatusConflict, err)
+		return
+	}
+	resp := &models.MetricsResponse{JobID: state.ID, Metrics: state.Metrics, Evaluation: state.Evaluation}
+	resp.Operation = "metrics"
+	resp.Success = true
+	resp.Time = time.Since(start).String()
+	s.sendResponse(w, r, http.StatusOK, resp, start)
+}
+
+func (s *Server) cancelJobRoute(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	j, err := s.jobs.cancel(sonate.Vars(r)["id"])
+	if err == errJobNotFound {
+		s.handleError(w, r, http.StatusNotFound, err)
+		return
 	}
-	resp, err := s.TrainNetwork(&req)
 	if err != nil {
-		s.handleError(w, http.StatusBadRequest, "/train", err)
+		s.handleError(w, r, http.StatusConflict, err)
+		return
+	}
+	// wait a moment for the job to notice, so the
+	// response can usually show it as cancelled
+	select {
+	case <-j.done:
+	case <-time.After(time.Second):
 	}
+	resp := &models.JobResponse{Job: j.snapshot()}
+	resp.Operation = "cancel"
+	resp.Success = true
+	resp.Time = time.Since(start).String()
+	s.sendResponse(w, r, http.StatusOK, resp, start)
+}
+
+// sendResponse writes resp as JSON and logs the request
+func (s *Server) sendResponse(w http.ResponseWriter, r *http.Request, statusCode int, resp models.Response, start time.Time) {
 	response, err := json.Marshal(resp)
 	if err != nil {
-		s.logger.Error(http.StatusInternalServerError, r.URL.Path, err)
-		sendErrorResponse(w, http.StatusInternalServerError, err)
+		s.handleError(w, r, http.StatusInternalServerError, err)
 		return
 	}
-	statusCode := getStatusCode(resp.GetOperation())
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(statusCode)
 	w.Write(response)
@@ -52,39 +128,17 @@ func (s *Server) trainRoute(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) predictRoute(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
-	if err := r.ParseMultipartForm(2 << 20); err != nil {
-		s.logger.Error(http.StatusBadRequest, r.URL.Path, err)
-		sendErrorResponse(w, http.StatusBadRequest, err)
-		return
-	}
-	var resp models.Response
-	if _, err := os.Stat("./tmp"); err != nil {
-		if os.IsNotExist(err) {
-			os.Mkdir("./tmp", 0755)
-		} else {
-			s.logger.Error(http.StatusInternalServerError, r.URL.Path, err)
-			sendErrorResponse(w, http.StatusInternalServerError, err)
-			return
-		}
-	}
-	var status int
-	var err error
-	resp, status, err = s.PredictNetwork(r)
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+	m, err := s.pickModel(r)
 	if err != nil {
-		s.logger.Error(status, r.URL.Path, err)
-		sendErrorResponse(w, status, err)
+		s.handleError(w, r, http.StatusNotFound, err)
 		return
 	}
-	os.RemoveAll("./tmp")
-	response, err := json.Marshal(resp)
+	resp, status, err := s.PredictNetwork(m, r)
 	if err != nil {
-		s.logger.Error(http.StatusInternalServerError, r.URL.Path, err)
-		sendErrorResponse(w, http.StatusInternalServerError, err)
+		s.handleError(w, r, status, err)
 		return
 	}
-	statusCode := getStatusCode(resp.GetOperation())
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(statusCode)
-	w.Write(response)
-	s.logger.Info(statusCode, r.URL.Path, start)
+	m.observe(start, answer{resp.Label, resp.Accuracy})
+	s.sendResponse(w, r, getStatusCode(resp.GetOperation()), resp, start)
 }
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"neural-network/cache"
+	"neural-network/models"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// healthzRoute answers as long as the process can serve HTTP
+func (s *Server) healthzRoute(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	resp := &models.HealthResponse{Status: "ok"}
+	resp.Operation = "healthz"
+	resp.Success = true
+	resp.Time = time.Since(start).String()
+	s.sendResponse(w, r, http.StatusOK, resp, start)
+}
+
+// readyzRoute answers 503 until the default model has trained weights
+// and while the cache cannot be reached. A server that fell back to the
+// in-memory cache is ready.
+func (s *Server) readyzRoute(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	checks := []models.Check{s.modelCheck(), cacheCheck()}
+	resp := &models.HealthResponse{Status: "ready", Checks: checks}
+	resp.Operation = "readyz"
+	resp.Success = true
+	status := http.StatusOK
+	for _, c := range checks {
+		if !c.OK {
+			resp.Status = "not ready"
+			resp.Success = false
+			status = http.StatusServiceUnavailable
+		}
+	}
+	resp.Time = time.Since(start).String()
+	s.sendResponse(w, r, status, resp, start)
+}
+
+func (s *Server) modelCheck() models.Check {
+	check := models.Check{Name: "model"}
+	m := s.model()
+	switch {
+	case m == nil:
+		check.Message = fmt.Sprintf("%s is not loaded", s.config.Network.Model)
+	case m.version == nil:
+		check.Message = fmt.Sprintf("%s has no trained version, its weights are random", m.name)
+	default:
+		check.OK = true
+		check.Message = "serving " + m.id()
+	}
+	return check
+}
+
+func cacheCheck() models.Check {
+	check := models.Check{Name: "cache", Message: cache.Backend()}
+	if err := cache.Ping(); err != nil {
+		check.Message = fmt.Sprintf("%s: %v", cache.Backend(), err)
+		return check
+	}
+	check.OK = true
+	return check
+}
+
+// infoRoute describes the served models and the build of the server
+func (s *Server) infoRoute(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	resp := &models.InfoResponse{
+		Build:     buildInfo(),
+		StartedAt: s.started,
+		Uptime:    time.Since(s.started).Round(time.Second).String(),
+		Cache:     cache.Backend(),
+		Models:    []models.ModelInfo{},
+	}
+	for _, m := range s.served.list() {
+		info := models.ModelInfo{
+			Name:         m.name,
+			Default:      m.name == s.config.Network.Model,
+			Dataset:      m.dataset,
+			Preprocess:   m.preprocess,
+			Labels:       m.labels,
+			Inputs:       m.net.Inputs,
+			Hiddens:      m.net.Hiddens,
+			Outputs:      m.net.Outputs,
+			LearningRate: m.net.LearningRate,
+		}
+		if v := m.version; v != nil {
+			trained := v.CreatedAt
+			info.Version = v.Version
+			info.Description = v.Description
+			info.TrainedAt = &trained
+			info.Accuracy = v.Accuracy
+		}
+		resp.Models = append(resp.Models, info)
+	}
+	resp.Operation = "info"
+	resp.Success = true
+	resp.Time = time.Since(start).String()
+	s.sendResponse(w, r, http.StatusOK, resp, start)
+}
+
+// buildInfo reads the module and version control
+// information the go tool embeds in the binary
+func buildInfo() models.BuildInfo {
+	info := models.BuildInfo{GoVersion: runtime.Version(), Version: "unknown"}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	info.Module = bi.Main.Path
+	if bi.Main.Version != "" {
+		info.Version = bi.Main.Version
+	}
+	for _, setting := range bi.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			info.Revision = setting.Value
+		case "vcs.time":
+			info.Time = setting.Value
+		case "vcs.modified":
+			info.Modified = setting.Value == "true"
+		}
+	}
+	return info
+}
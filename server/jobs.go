@@ -0,0 +1,263 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"neural-network/models"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// job states
+const (
+	JobPending   = "pending"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+)
+
+// job event types
+const (
+	EventProgress = "progress"
+	EventEpoch    = "epoch"
+	EventStatus   = "status"
+)
+
+// finished jobs kept around for clients to query
+const maxFinishedJobs = 100
+
+// events buffered for every subscriber, a client that falls
+// further behind misses events instead of slowing the job down
+const eventBuffer = 64
+
+var (
+	errJobRunning  = errors.New("a job of this kind is already running")
+	errJobNotFound = errors.New("job not found")
+	errJobFinished = errors.New("job already finished")
+	errJobNotDone  = errors.New("job has not finished yet")
+)
+
+// job is a background task tracked by the jobManager
+type job struct {
+	mu          sync.Mutex
+	state       models.Job
+	cancel      context.CancelFunc
+	done        chan struct{}
+	subscribers map[chan models.JobEvent]struct{}
+	closed      bool
+}
+
+// snapshot copies the state so it can be encoded without holding the lock
+func (j *job) snapshot() *models.Job {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	state := j.state
+	return &state
+}
+
+func (j *job) update(fn func(state *models.Job)) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	fn(&j.state)
+}
+
+// subscribe returns a channel with the events of the job. The first event
+// is always the current status, and the channel is closed when the job
+// finishes or the returned function is called.
+func (j *job) subscribe() (<-chan models.JobEvent, func()) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	ch := make(chan models.JobEvent, eventBuffer)
+	state := j.state
+	ch <- models.JobEvent{Type: EventStatus, JobID: state.ID, Job: &state}
+	if j.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	j.subscribers[ch] = struct{}{}
+	return ch, func() {
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		if _, ok := j.subscribers[ch]; ok {
+			delete(j.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// publish sends the event to every subscriber without blocking
+func (j *job) publish(event models.JobEvent) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.broadcast(event)
+}
+
+// broadcast must be called with j.mu held
+func (j *job) broadcast(event models.JobEvent) {
+	event.JobID = j.state.ID
+	for ch := range j.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// publishStatus sends the current state, and closes every
+// subscription once the job is over
+func (j *job) publishStatus(final bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	state := j.state
+	j.broadcast(models.JobEvent{Type: EventStatus, Job: &state})
+	if !final {
+		return
+	}
+	for ch := range j.subscribers {
+		close(ch)
+	}
+	j.subscribers = nil
+	j.closed = true
+}
+
+func (j *job) finished() bool {
+	select {
+	case <-j.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// jobManager runs jobs in the background. Only one job of each kind runs
+// at a time for a model, so two trainings never write to the same network
+// together.
+type jobManager struct {
+	mu      sync.Mutex
+	jobs    map[string]*job
+	order   []string
+	running map[string]*job
+}
+
+func newJobManager() *jobManager {
+	return &jobManager{
+		jobs:    make(map[string]*job),
+		running: make(map[string]*job),
+	}
+}
+
+// start registers a job and runs fn in a goroutine. The context given to
+// fn is cancelled when the job is cancelled.
+func (m *jobManager) start(kind, model string, epochs int, fn func(ctx context.Context, j *job) error) (*job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := kind + ":" + model
+	if _, ok := m.running[key]; ok {
+		return nil, errJobRunning
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &job{
+		state: models.Job{
+			ID:        uuid.New().String(),
+			Kind:      kind,
+			Model:     model,
+			Status:    JobPending,
+			Epochs:    epochs,
+			CreatedAt: time.Now(),
+		},
+		cancel:      cancel,
+		done:        make(chan struct{}),
+		subscribers: make(map[chan models.JobEvent]struct{}),
+	}
+	m.jobs[j.state.ID] = j
+	m.order = append(m.order, j.state.ID)
+	m.running[key] = j
+	m.prune()
+
+	go func() {
+		defer close(j.done)
+		defer cancel()
+		j.update(func(state *models.Job) {
+			now := time.Now()
+			state.Status = JobRunning
+			state.StartedAt = &now
+		})
+		j.publishStatus(false)
+		err := fn(ctx, j)
+		m.mu.Lock()
+		delete(m.running, key)
+		m.mu.Unlock()
+		j.update(func(state *models.Job) {
+			now := time.Now()
+			state.FinishedAt = &now
+			switch {
+			case err == nil:
+				state.Status = JobSucceeded
+			case errors.Is(err, context.Canceled):
+				state.Status = JobCancelled
+			default:
+				state.Status = JobFailed
+				state.Error = err.Error()
+			}
+		})
+		j.publishStatus(true)
+	}()
+	return j, nil
+}
+
+func (m *jobManager) get(id string) (*job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j, ok := m.jobs[id]
+	if !ok {
+		return nil, errJobNotFound
+	}
+	return j, nil
+}
+
+// list returns every job, oldest first
+func (m *jobManager) list() []*models.Job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	jobs := make([]*models.Job, 0, len(m.order))
+	for _, id := range m.order {
+		jobs = append(jobs, m.jobs[id].snapshot())
+	}
+	return jobs
+}
+
+// cancel stops a pending or running job
+func (m *jobManager) cancel(id string) (*job, error) {
+	j, err := m.get(id)
+	if err != nil {
+		return nil, err
+	}
+	if j.finished() {
+		return j, errJobFinished
+	}
+	j.cancel()
+	return j, nil
+}
+
+// prune forgets the oldest finished jobs. It must be called with m.mu held.
+func (m *jobManager) prune() {
+	finished := 0
+	for _, id := range m.order {
+		if m.jobs[id].finished() {
+			finished++
+		}
+	}
+	for i := 0; i < len(m.order) && finished > maxFinishedJobs; {
+		id := m.order[i]
+		if !m.jobs[id].finished() {
+			i++
+			continue
+		}
+		delete(m.jobs, id)
+		m.order = append(m.order[:i], m.order[i+1:]...)
+		finished--
+	}
+}
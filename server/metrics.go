@@ -0,0 +1,113 @@
+package server
+
+import (
+	"net/http"
+	"neural-network/metrics"
+	"strconv"
+	"time"
+
+	"github.com/fehernandez12/sonate"
+	"github.com/felixge/httpsnoop"
+)
+
+var (
+	requestsTotal = metrics.NewCounterVec("nn_http_requests_total",
+		"HTTP requests by route, method and status.", "route", "method", "status")
+	requestDuration = metrics.NewHistogramVec("nn_http_request_duration_seconds",
+		"Time taken to answer HTTP requests, in seconds.", metrics.DefaultBuckets, "route", "method", "status")
+	rejectedTotal = metrics.NewCounterVec("nn_http_rejected_total",
+		"Requests rejected by authentication or rate limiting, by reason.", "reason")
+	predictionsTotal = metrics.NewCounterVec("nn_predictions_total",
+		"Predictions by model, version and predicted label.", "model", "version", "label")
+	predictionConfidence = metrics.NewHistogramVec("nn_prediction_confidence",
+		"Confidence of the predictions, from 0 to 1.",
+		[]float64{.1, .2, .3, .4, .5, .6, .7, .8, .9, 1}, "model", "version")
+	feedbackTotal = metrics.NewCounterVec("nn_feedback_total",
+		"Predictions clients said were right or wrong, by model and version.", "model", "version", "correct")
+)
+
+// every status a job can be in, so a scrape reports the ones with no job
+var jobStatuses = []string{JobPending, JobRunning, JobSucceeded, JobFailed, JobCancelled}
+
+// answer is a label predicted by a model and its confidence in percent
+type answer struct {
+	label      string
+	confidence float64
+}
+
+// observe records the predictions of a request answered by the model,
+// and the request itself when the model is part of a traffic split
+func (m *servedModel) observe(start time.Time, answers ...answer) {
+	version := m.versionLabel()
+	for _, a := range answers {
+		predictionsTotal.Inc(m.name, version, a.label)
+		predictionConfidence.Observe(a.confidence/100, m.name, version)
+	}
+	if m.split != nil {
+		m.split.record(m.variant, time.Since(start), answers)
+	}
+}
+
+// versionLabel is the version of the model in metrics
+func (m *servedModel) versionLabel() string {
+	if m.version == nil {
+		return "untrained"
+	}
+	return strconv.Itoa(m.version.Version)
+}
+
+// metricsMiddleware counts the requests and their latency by route
+// template, so the paths of models and jobs do not make new series
+func (s *Server) metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unknown"
+		if current := sonate.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		m := httpsnoop.CaptureMetrics(next, w, r)
+		status := strconv.Itoa(m.Code)
+		requestsTotal.Inc(route, r.Method, status)
+		requestDuration.Observe(m.Duration.Seconds(), route, r.Method, status)
+	})
+}
+
+// metricsRoute writes the metrics of the server in the Prometheus text
+// format. The state of the models and jobs is read at every scrape.
+func (s *Server) metricsRoute(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	state := metrics.NewRegistry()
+	info := state.NewGaugeVec("nn_model_info",
+		"Models being served, with their version, dataset and preprocessing.",
+		"model", "version", "dataset", "preprocess")
+	splits := state.NewGaugeVec("nn_model_split_weight",
+		"Percentage of the traffic of a model sent to a candidate version.", "model", "candidate")
+	for _, m := range s.served.list() {
+		info.Set(1, m.name, m.versionLabel(), m.dataset, m.preprocess)
+		if sp := s.served.split(m.name); sp != nil {
+			splits.Set(sp.weight, m.name, sp.candidate.versionLabel())
+		}
+	}
+	jobs := state.NewGaugeVec("nn_jobs",
+		"Jobs the server remembers, by kind and status.", "kind", "status")
+	progress := state.NewGaugeVec("nn_job_progress_ratio",
+		"Progress of the running jobs, from 0 to 1.", "job", "kind", "model")
+	for _, status := range jobStatuses {
+		jobs.Set(0, JobKindTrain, status)
+		jobs.Set(0, JobKindEvaluate, status)
+	}
+	for _, j := range s.jobs.list() {
+		jobs.Add(1, j.Kind, j.Status)
+		if j.Status == JobRunning {
+			progress.Set(j.Progress.Percent/100, j.ID, j.Kind, j.Model)
+		}
+	}
+
+	w.Header().Set("Content-Type", metrics.ContentType)
+	w.WriteHeader(http.StatusOK)
+	if err := metrics.Default.Write(w); err == nil {
+		state.Write(w)
+	}
+	s.logger.Info(http.StatusOK, r.URL.Path, start)
+}
@@ -0,0 +1,513 @@
+package server
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"neural-network/auth"
+	"neural-network/models"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+//go:embed docs.html
+var docsPage []byte
+
+// operation documents a route in the OpenAPI document. Body and
+// Response are values of the JSON types sent and returned, Form the
+// multipart fields of an upload. Errors lists the statuses the route
+// answers with an error, on top of the ones of its scope.
+type operation struct {
+	method  string
+	path    string
+	id      string
+	tag     string
+	summary string
+	// description adds what the summary cannot say in a line
+	description string
+	scope       auth.Scope
+	body        interface{}
+	form        []formField
+	zip         bool
+	// optional is set when the request body can be left out
+	optional bool
+	response interface{}
+	status   int
+	// content replaces the JSON response, such as text/event-stream
+	content string
+	errors  []int
+}
+
+// formField is a multipart field, a file when binary is set
+type formField struct {
+	name        string
+	description string
+	binary      bool
+	required    bool
+}
+
+// the values an image upload accepts, besides the image itself
+var imageForm = []formField{
+	{name: "image", description: "The image, in JPEG, PNG, GIF, BMP, TIFF or WEBP.", binary: true, required: true},
+	{name: "invert", description: "auto, true or false: whether the digits are light on a dark background."},
+	{name: "binarize", description: "true to turn the image black and white before predicting."},
+	{name: "deskew", description: "true to straighten slanted digits."},
+}
+
+var predictForm = append(append([]formField{}, imageForm...),
+	formField{name: "preview", description: "true to get the image the network received, as a PNG data URL."},
+)
+
+var evaluateForm = []formField{
+	{name: "data", description: "A CSV in the MNIST format, or a zip of images in directories named after their label.", binary: true},
+	{name: "invert", description: "auto, true or false: whether the digits of the images are light on a dark background."},
+	{name: "binarize", description: "true to turn the images black and white before predicting."},
+	{name: "deskew", description: "true to straighten slanted digits."},
+}
+
+var detectForm = append(append([]formField{}, imageForm...),
+	formField{name: "min_size", description: "Height in pixels of the smallest digit searched."},
+	formField{name: "min_confidence", description: "Confidence in percent under which detections are dropped."},
+	formField{name: "annotate", description: "true to get the image back with the detections drawn."},
+)
+
+var modelForm = []formField{
+	{name: "model", description: "The zip archive of the model, as downloaded.", binary: true, required: true},
+	{name: "dataset", description: "Overrides the dataset of the archive."},
+	{name: "preprocess", description: "Overrides the preprocessing of the archive."},
+	{name: "labels", description: "Comma separated labels, overriding the ones of the archive."},
+	{name: "description", description: "Overrides the description of the archive."},
+}
+
+var batchForm = []formField{
+	{name: "images", description: "Any number of image files, or zip archives of images.", binary: true, required: true},
+	{name: "invert", description: "Applied to every image, as for /predict."},
+	{name: "binarize", description: "Applied to every image, as for /predict."},
+	{name: "deskew", description: "Applied to every image, as for /predict."},
+}
+
+// operations is every route of the API, as served by routes
+var operations = []operation{
+	{method: http.MethodGet, path: "/healthz", id: "healthz", tag: "server",
+		summary: "Liveness of the server", response: models.HealthResponse{}},
+	{method: http.MethodGet, path: "/readyz", id: "readyz", tag: "server",
+		summary: "Whether the server can answer predictions", response: models.HealthResponse{},
+		errors: []int{http.StatusServiceUnavailable}},
+	{method: http.MethodGet, path: "/info", id: "info", tag: "server",
+		summary: "Build, uptime and served models", response: models.InfoResponse{}},
+	{method: http.MethodGet, path: "/metrics", id: "metrics", tag: "server",
+		summary: "Prometheus metrics", content: "text/plain"},
+	{method: http.MethodGet, path: "/openapi.json", id: "openapi", tag: "server",
+		summary: "This document", content: "application/json"},
+	{method: http.MethodGet, path: "/docs", id: "docs", tag: "server",
+		summary: "Viewer of this document", content: "text/html"},
+	{method: http.MethodGet, path: "/ui", id: "ui", tag: "server",
+		summary: "Page to draw or upload a digit and see how the network reads it", content: "text/html"},
+
+	{method: http.MethodPost, path: "/train", id: "train", tag: "training", scope: auth.ScopeTrain,
+		summary: "Train the default model", body: models.TrainRequest{}, response: models.TrainResponse{},
+		description: "The server has training data for the mnist and cifar10 datasets only, " +
+			"other models answer 409 with the no_training_data code.",
+		status: http.StatusAccepted, errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusConflict, http.StatusUnprocessableEntity}},
+	{method: http.MethodGet, path: "/train/jobs", id: "listJobs", tag: "training", scope: auth.ScopeTrain,
+		summary: "List the training jobs", response: models.JobListResponse{}},
+	{method: http.MethodGet, path: "/train/jobs/{id}", id: "getJob", tag: "training", scope: auth.ScopeTrain,
+		summary: "Get a training job", response: models.JobResponse{}, errors: []int{http.StatusNotFound}},
+	{method: http.MethodDelete, path: "/train/jobs/{id}", id: "cancelJob", tag: "training", scope: auth.ScopeTrain,
+		summary: "Cancel a training job", response: models.JobResponse{},
+		errors: []int{http.StatusNotFound, http.StatusConflict}},
+	{method: http.MethodGet, path: "/train/jobs/{id}/metrics", id: "getJobMetrics", tag: "training", scope: auth.ScopeTrain,
+		summary: "Results of a finished training or evaluation job", response: models.MetricsResponse{},
+		errors: []int{http.StatusNotFound, http.StatusConflict}},
+	{method: http.MethodGet, path: "/train/jobs/{id}/events", id: "streamJobEvents", tag: "training", scope: auth.ScopeTrain,
+		summary: "Server-Sent Events of a training job, each one a JobEvent", content: "text/event-stream",
+		response: models.JobEvent{}, errors: []int{http.StatusNotFound}},
+	{method: http.MethodPost, path: "/models/{name}/train", id: "trainModel", tag: "training", scope: auth.ScopeTrain,
+		summary: "Train a model", body: models.TrainRequest{}, response: models.TrainResponse{},
+		description: "The server has training data for the mnist and cifar10 datasets only, " +
+			"other models answer 409 with the no_training_data code.",
+		status: http.StatusAccepted, errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusConflict, http.StatusUnprocessableEntity}},
+	{method: http.MethodPost, path: "/evaluate", id: "evaluate", tag: "training", scope: auth.ScopeTrain,
+		summary: "Evaluate the default model on its test set or an uploaded labeled set, the report is in the job",
+		description: "Without a labeled set, models of datasets other than mnist and cifar10 " +
+			"answer 409 with the no_training_data code.",
+		form: evaluateForm, zip: true, optional: true, response: models.EvaluateResponse{}, status: http.StatusAccepted,
+		errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusConflict, http.StatusRequestEntityTooLarge,
+			http.StatusUnsupportedMediaType, http.StatusUnprocessableEntity, http.StatusServiceUnavailable}},
+	{method: http.MethodPost, path: "/models/{name}/evaluate", id: "evaluateModel", tag: "training", scope: auth.ScopeTrain,
+		summary: "Evaluate a model on its test set or an uploaded labeled set, the report is in the job",
+		description: "Without a labeled set, models of datasets other than mnist and cifar10 " +
+			"answer 409 with the no_training_data code.",
+		form: evaluateForm, zip: true, optional: true, response: models.EvaluateResponse{}, status: http.StatusAccepted,
+		errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusConflict, http.StatusRequestEntityTooLarge,
+			http.StatusUnsupportedMediaType, http.StatusUnprocessableEntity, http.StatusServiceUnavailable}},
+
+	{method: http.MethodPost, path: "/predict", id: "predict", tag: "prediction", scope: auth.ScopePredict,
+		summary: "Predict the digits of an image with the default model", form: predictForm, response: models.PredictResponse{},
+		errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusRequestEntityTooLarge, http.StatusUnsupportedMediaType}},
+	{method: http.MethodPost, path: "/predict/batch", id: "predictBatch", tag: "prediction", scope: auth.ScopePredict,
+		summary: "Predict many images at once", form: batchForm, zip: true, body: batchRequest{},
+		response: models.BatchPredictResponse{},
+		errors:   []int{http.StatusBadRequest, http.StatusNotFound, http.StatusRequestEntityTooLarge, http.StatusUnsupportedMediaType}},
+	{method: http.MethodPost, path: "/predict/pixels", id: "predictPixels", tag: "prediction", scope: auth.ScopePredict,
+		summary: "Predict from pixel values or a base64 image", body: models.PixelPredictRequest{},
+		response: models.PredictResponse{},
+		errors:   []int{http.StatusBadRequest, http.StatusNotFound, http.StatusRequestEntityTooLarge}},
+	{method: http.MethodPost, path: "/detect", id: "detect", tag: "prediction", scope: auth.ScopePredict,
+		summary: "Find the digits anywhere in a photo", form: detectForm, response: models.DetectResponse{},
+		errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusRequestEntityTooLarge, http.StatusUnsupportedMediaType}},
+	{method: http.MethodPost, path: "/models/{name}/predict", id: "predictModel", tag: "prediction", scope: auth.ScopePredict,
+		summary: "Predict the digits of an image with a model", form: predictForm, response: models.PredictResponse{},
+		errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusRequestEntityTooLarge, http.StatusUnsupportedMediaType}},
+	{method: http.MethodPost, path: "/models/{name}/feedback", id: "feedback", tag: "rollout", scope: auth.ScopePredict,
+		summary: "Tell which label a prediction should have had", body: models.FeedbackRequest{},
+		response: models.FeedbackResponse{},
+		errors:   []int{http.StatusBadRequest, http.StatusNotFound, http.StatusUnprocessableEntity}},
+
+	{method: http.MethodGet, path: "/models", id: "listModels", tag: "models", scope: auth.ScopePredict,
+		summary: "List the models of the registry", response: models.ModelListResponse{},
+		errors: []int{http.StatusInternalServerError}},
+	{method: http.MethodGet, path: "/models/{name}", id: "getModel", tag: "models", scope: auth.ScopePredict,
+		summary: "Get a model and its versions", response: models.ModelResponse{},
+		errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	{method: http.MethodPost, path: "/models/{name}/versions", id: "uploadModel", tag: "models", scope: auth.ScopeAdmin,
+		summary: "Upload a new version of a model", form: modelForm, zip: true, response: models.ModelVersionResponse{},
+		status: http.StatusCreated,
+		errors: []int{http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnsupportedMediaType}},
+	{method: http.MethodGet, path: "/models/{name}/versions/{version}", id: "getModelVersion", tag: "models", scope: auth.ScopePredict,
+		summary: "Get a version of a model", response: models.ModelVersionResponse{},
+		errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	{method: http.MethodDelete, path: "/models/{name}/versions/{version}", id: "deleteModelVersion", tag: "models", scope: auth.ScopeAdmin,
+		summary: "Delete a version of a model", response: models.ModelVersionResponse{},
+		errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusConflict}},
+	{method: http.MethodGet, path: "/models/{name}/versions/{version}/download", id: "downloadModelVersion", tag: "models", scope: auth.ScopeAdmin,
+		summary: "Download a version of a model as a zip archive", content: "application/zip",
+		errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	{method: http.MethodPost, path: "/models/{name}/versions/{version}/activate", id: "activateModelVersion", tag: "models", scope: auth.ScopeAdmin,
+		summary: "Serve a version of a model", response: models.ModelVersionResponse{},
+		errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusConflict}},
+
+	{method: http.MethodGet, path: "/models/{name}/split", id: "getSplit", tag: "rollout", scope: auth.ScopePredict,
+		summary: "Get the traffic split of a model", response: models.SplitResponse{}, errors: []int{http.StatusNotFound}},
+	{method: http.MethodPut, path: "/models/{name}/split", id: "startSplit", tag: "rollout", scope: auth.ScopeAdmin,
+		summary: "Send a share of the traffic of a model to another version", body: models.SplitRequest{},
+		response: models.SplitResponse{},
+		errors:   []int{http.StatusBadRequest, http.StatusNotFound, http.StatusConflict, http.StatusUnprocessableEntity}},
+	{method: http.MethodDelete, path: "/models/{name}/split", id: "endSplit", tag: "rollout", scope: auth.ScopeAdmin,
+		summary: "Send all the traffic back to the active version", response: models.SplitResponse{},
+		errors: []int{http.StatusNotFound}},
+	{method: http.MethodPost, path: "/models/{name}/split/promote", id: "promoteSplit", tag: "rollout", scope: auth.ScopeAdmin,
+		summary: "Make the candidate of a split the active version", response: models.SplitResponse{},
+		errors: []int{http.StatusNotFound, http.StatusConflict}},
+	{method: http.MethodGet, path: "/models/{name}/shadow", id: "getShadow", tag: "rollout", scope: auth.ScopePredict,
+		summary: "Compare the shadow model with the served one", response: models.ShadowResponse{},
+		errors: []int{http.StatusNotFound}},
+	{method: http.MethodPut, path: "/models/{name}/shadow", id: "startShadow", tag: "rollout", scope: auth.ScopeAdmin,
+		summary: "Run another version alongside the served one", body: models.ShadowRequest{},
+		response: models.ShadowResponse{},
+		errors:   []int{http.StatusBadRequest, http.StatusNotFound, http.StatusConflict, http.StatusUnprocessableEntity}},
+	{method: http.MethodDelete, path: "/models/{name}/shadow", id: "endShadow", tag: "rollout", scope: auth.ScopeAdmin,
+		summary: "Stop the shadow model", response: models.ShadowResponse{}, errors: []int{http.StatusNotFound}},
+}
+
+var (
+	openAPIOnce     sync.Once
+	openAPIDocument []byte
+)
+
+func (s *Server) openAPIRoute(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	openAPIOnce.Do(func() {
+		openAPIDocument, _ = json.MarshalIndent(openAPI(), "", "  ")
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(openAPIDocument)
+	s.logger.Info(http.StatusOK, r.URL.Path, start)
+}
+
+func (s *Server) docsRoute(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(docsPage)
+	s.logger.Info(http.StatusOK, r.URL.Path, start)
+}
+
+type object = map[string]interface{}
+
+var pathParam = regexp.MustCompile(`{(\w+)}`)
+
+// openAPI builds the OpenAPI 3 document of operations
+func openAPI() object {
+	sg := &schemaGen{schemas: object{}}
+	errorRef := sg.ref(reflect.TypeOf(models.ErrorResponse{}))
+	sg.schemas["ErrorResponse"].(object)["properties"].(object)["code"].(object)["enum"] = knownErrorCodes()
+
+	paths := object{}
+	for _, op := range operations {
+		item, ok := paths[op.path].(object)
+		if !ok {
+			item = object{}
+			paths[op.path] = item
+		}
+		item[strings.ToLower(op.method)] = sg.operation(op, errorRef)
+	}
+	return object{
+		"openapi": "3.0.3",
+		"info": object{
+			"title": "neural-network",
+			"description": "Digit recognition with neural networks trained on MNIST and CIFAR-10. " +
+				"Errors always have the ErrorResponse shape, with a stable code.",
+			"version": "1.0.0",
+		},
+		"tags": []object{
+			{"name": "prediction", "description": "Predict digits from images"},
+			{"name": "training", "description": "Train models in background jobs"},
+			{"name": "models", "description": "Versions of the models in the registry"},
+			{"name": "rollout", "description": "Traffic splits and shadow models"},
+			{"name": "server", "description": "Health, metrics and documentation"},
+		},
+		"paths": paths,
+		"components": object{
+			"schemas": sg.schemas,
+			"responses": object{
+				"Error": object{
+					"description": "An error",
+					"content":     object{"application/json": object{"schema": errorRef}},
+				},
+			},
+			"securitySchemes": object{
+				"bearer": object{"type": "http", "scheme": "bearer"},
+				"apiKey": object{"type": "apiKey", "in": "header", "name": APIKeyHeader},
+			},
+		},
+	}
+}
+
+// knownErrorCodes is every code errorCode can return
+func knownErrorCodes() []string {
+	seen := map[string]bool{
+		models.CodeValidation:  true,
+		models.CodeTooLarge:    true,
+		models.CodeInvalidJSON: true,
+		models.CodeBadRequest:  true,
+		models.CodeInternal:    true,
+	}
+	for _, c := range errorCodes {
+		seen[c.code] = true
+	}
+	for _, c := range statusCodes {
+		seen[c] = true
+	}
+	codes := make([]string, 0, len(seen))
+	for c := range seen {
+		codes = append(codes, c)
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+func (sg *schemaGen) operation(op operation, errorRef object) object {
+	o := object{
+		"operationId": op.id,
+		"summary":     op.summary,
+		"tags":        []string{op.tag},
+	}
+	if op.description != "" {
+		o["description"] = op.description
+	}
+	var params []object
+	for _, m := range pathParam.FindAllStringSubmatch(op.path, -1) {
+		typ := "string"
+		if m[1] == "version" {
+			typ = "integer"
+		}
+		params = append(params, object{"name": m[1], "in": "path", "required": true, "schema": object{"type": typ}})
+	}
+	if params != nil {
+		o["parameters"] = params
+	}
+
+	body := object{}
+	if op.body != nil {
+		body["application/json"] = object{"schema": sg.request(reflect.TypeOf(op.body))}
+	}
+	if op.form != nil {
+		props, required := object{}, []string{}
+		for _, f := range op.form {
+			p := object{"type": "string", "description": f.description}
+			if f.binary {
+				p["format"] = "binary"
+			}
+			props[f.name] = p
+			if f.required {
+				required = append(required, f.name)
+			}
+		}
+		body["multipart/form-data"] = object{"schema": object{"type": "object", "properties": props, "required": required}}
+	}
+	if op.zip {
+		body["application/zip"] = object{"schema": object{"type": "string", "format": "binary"}}
+	}
+	if len(body) > 0 {
+		o["requestBody"] = object{"required": !op.optional, "content": body}
+	}
+
+	status := op.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	success := object{"description": http.StatusText(status)}
+	switch {
+	case op.content == "":
+		success["content"] = object{"application/json": object{"schema": sg.ref(reflect.TypeOf(op.response))}}
+	case op.response != nil:
+		success["content"] = object{op.content: object{"schema": sg.ref(reflect.TypeOf(op.response))}}
+	case op.content == "application/zip":
+		success["content"] = object{op.content: object{"schema": object{"type": "string", "format": "binary"}}}
+	default:
+		success["content"] = object{op.content: object{"schema": object{"type": "string"}}}
+	}
+	responses := object{strconv.Itoa(status): success}
+	errs := append([]int{}, op.errors...)
+	if op.scope > auth.ScopeNone {
+		o["security"] = []object{{"bearer": []string{}}, {"apiKey": []string{}}}
+		o["x-scope"] = op.scope.String()
+		o["description"] = "Needs an API key with the " + op.scope.String() + " scope, unless anonymous requests have it."
+		errs = append(errs, http.StatusUnauthorized, http.StatusForbidden, http.StatusTooManyRequests)
+	}
+	for _, e := range errs {
+		if e == http.StatusServiceUnavailable && op.response != nil {
+			// readyz answers its checks whatever the outcome
+			responses[strconv.Itoa(e)] = object{"description": http.StatusText(e), "content": success["content"]}
+			continue
+		}
+		responses[strconv.Itoa(e)] = object{"$ref": "#/components/responses/Error"}
+	}
+	// a train request on a model with weights already answers 201
+	if reflect.TypeOf(op.response) == reflect.TypeOf(models.TrainResponse{}) {
+		responses[strconv.Itoa(http.StatusCreated)] = object{"description": "Training skipped", "content": success["content"]}
+	}
+	o["responses"] = responses
+	return o
+}
+
+// schemaGen turns Go types into the schemas of the document,
+// naming every struct as a component
+type schemaGen struct {
+	schemas object
+}
+
+var (
+	timeType      = reflect.TypeOf(time.Time{})
+	formValueType = reflect.TypeOf(models.FormValue(""))
+)
+
+// ref returns a reference to the schema of a struct,
+// or the schema itself for the other types
+func (sg *schemaGen) ref(t reflect.Type) object {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || t == timeType {
+		return sg.schema(t)
+	}
+	name := schemaName(t)
+	if _, ok := sg.schemas[name]; !ok {
+		// set first so recursive types end
+		sg.schemas[name] = object{}
+		sg.schemas[name] = sg.structSchema(t)
+	}
+	return object{"$ref": "#/components/schemas/" + name}
+}
+
+// request is the schema of a request body. The server fills the
+// fields a client leaves out, so none is required.
+func (sg *schemaGen) request(t reflect.Type) object {
+	ref := sg.ref(t)
+	delete(sg.schemas[schemaName(t)].(object), "required")
+	return ref
+}
+
+func (sg *schemaGen) schema(t reflect.Type) object {
+	switch {
+	case t == timeType:
+		return object{"type": "string", "format": "date-time"}
+	case t == formValueType:
+		return object{"oneOf": []object{{"type": "string"}, {"type": "boolean"}, {"type": "number"}}}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return sg.ref(t.Elem())
+	case reflect.Struct:
+		return sg.ref(t)
+	case reflect.Bool:
+		return object{"type": "boolean"}
+	case reflect.Int, reflect.Int32, reflect.Uint, reflect.Uint32:
+		return object{"type": "integer"}
+	case reflect.Int64, reflect.Uint64:
+		return object{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return object{"type": "number"}
+	case reflect.String:
+		return object{"type": "string"}
+	case reflect.Slice:
+		return object{"type": "array", "items": sg.schema(t.Elem())}
+	case reflect.Array:
+		return object{"type": "array", "items": sg.schema(t.Elem()), "minItems": t.Len(), "maxItems": t.Len()}
+	case reflect.Map:
+		return object{"type": "object", "additionalProperties": sg.schema(t.Elem())}
+	}
+	return object{}
+}
+
+// structSchema follows encoding/json: embedded structs are flattened,
+// and fields without omitempty are always there
+func (sg *schemaGen) structSchema(t reflect.Type) object {
+	props, required := object{}, []string{}
+	var add func(t reflect.Type)
+	add = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			tag := f.Tag.Get("json")
+			if tag == "-" {
+				continue
+			}
+			name, opts, _ := strings.Cut(tag, ",")
+			if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+				add(f.Type)
+				continue
+			}
+			if !f.IsExported() {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			props[name] = sg.schema(f.Type)
+			if !strings.Contains(opts, "omitempty") {
+				required = append(required, name)
+			}
+		}
+	}
+	add(t)
+	s := object{"type": "object", "properties": props}
+	if len(required) > 0 {
+		s["required"] = required
+	}
+	return s
+}
+
+// schemaName is the exported form of the name of a type
+func schemaName(t reflect.Type) string {
+	name := []rune(t.Name())
+	name[0] = unicode.ToUpper(name[0])
+	return string(name)
+}
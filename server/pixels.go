@@ -0,0 +1,150 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"net/http"
+	"net/url"
+	"neural-network/models"
+	"neural-network/utils"
+	"time"
+)
+
+func (s *Server) predictPixelsRoute(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	m, err := s.pickModel(r)
+	if err != nil {
+		s.handleError(w, r, http.StatusNotFound, err)
+		return
+	}
+	var req models.PixelPredictRequest
+	if !s.decodeJSON(w, r, &req) {
+		return
+	}
+	resp, status, err := s.PredictPixels(m, &req, start)
+	if err != nil {
+		s.handleError(w, r, status, err)
+		return
+	}
+	m.observe(start, answer{resp.Label, resp.Accuracy})
+	s.sendResponse(w, r, getStatusCode(resp.GetOperation()), resp, start)
+}
+
+// PredictPixels predicts from raw pixel values or a base64 image. Pixels
+// are turned back into an image so they go through the same
+// preprocessing and cache as an uploaded file.
+func (s *Server) PredictPixels(m *servedModel, req *models.PixelPredictRequest, start time.Time) (*models.PredictResponse, int, error) {
+	var img image.Image
+	var raw []byte
+	var err error
+	switch {
+	case len(req.Pixels) > 0 && req.Data != "":
+		return nil, http.StatusBadRequest, errors.New("send either pixels or data, not both")
+	case len(req.Pixels) > 0:
+		raw, err = pixelBytes(req.Pixels, req.Scale)
+	case req.Data != "":
+		raw, err = decodeBase64Image(req.Data)
+		if err == nil {
+			// anything that is not a known image
+			// format is read as one byte per pixel
+			if _, ferr := utils.FormatFromContent(raw); ferr == nil {
+				img, _, err = utils.DecodeLimited(bytes.NewReader(raw), maxImagePixels)
+			}
+		}
+	default:
+		return nil, http.StatusBadRequest, errors.New("pixels or data is required")
+	}
+	if errors.Is(err, utils.ErrImageTooLarge) {
+		return nil, http.StatusRequestEntityTooLarge, err
+	}
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	if img == nil {
+		if len(raw) != m.net.Inputs {
+			return nil, http.StatusBadRequest, fmt.Errorf("expected %d pixels, got %d", m.net.Inputs, len(raw))
+		}
+		if img, err = pixelImage(raw); err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+	}
+	values := url.Values{}
+	values.Set("invert", string(req.Invert))
+	values.Set("binarize", string(req.Binarize))
+	values.Set("deskew", string(req.Deskew))
+	values.Set("preview", string(req.Preview))
+	sum := sha256.Sum256(raw)
+	p, err := prepare(img, hex.EncodeToString(sum[:]), values)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	return s.predictPrepared(m, p, start)
+}
+
+// pixelBytes converts pixel values to bytes. The scale is "unit" for
+// values between 0 and 1, "byte" for values between 0 and 255, or empty
+// to pick "unit" when no value is above 1.
+func pixelBytes(pixels []float64, scale string) ([]byte, error) {
+	if scale == "" {
+		scale = "unit"
+		for _, v := range pixels {
+			if v > 1 {
+				scale = "byte"
+				break
+			}
+		}
+	}
+	var max float64
+	switch scale {
+	case "unit":
+		max = 1
+	case "byte":
+		max = 255
+	default:
+		return nil, fmt.Errorf("scale must be unit or byte, got %q", scale)
+	}
+	raw := make([]byte, len(pixels))
+	for i, v := range pixels {
+		if math.IsNaN(v) || v < 0 || v > max {
+			return nil, fmt.Errorf("pixel %d is out of range: %v", i, v)
+		}
+		raw[i] = uint8(math.Round(v / max * 255))
+	}
+	return raw, nil
+}
+
+// pixelImage rebuilds an image from one byte per network input: a
+// square gray image, or a square RGB image stored one channel after the
+// other like the CIFAR-10 tensors.
+func pixelImage(raw []byte) (image.Image, error) {
+	n := len(raw)
+	if side := squareSide(n); side > 0 {
+		return &image.Gray{Pix: raw, Stride: side, Rect: image.Rect(0, 0, side, side)}, nil
+	}
+	if side := squareSide(n / 3); n%3 == 0 && side > 0 {
+		plane := side * side
+		img := image.NewNRGBA(image.Rect(0, 0, side, side))
+		for i := 0; i < plane; i++ {
+			img.Pix[i*4] = raw[i]
+			img.Pix[i*4+1] = raw[plane+i]
+			img.Pix[i*4+2] = raw[2*plane+i]
+			img.Pix[i*4+3] = 0xff
+		}
+		return img, nil
+	}
+	return nil, fmt.Errorf("cannot make an image out of %d pixels", n)
+}
+
+// squareSide returns the side of a square with n pixels, or 0
+func squareSide(n int) int {
+	side := int(math.Round(math.Sqrt(float64(n))))
+	if side > 0 && side*side == n {
+		return side
+	}
+	return 0
+}
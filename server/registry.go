@@ -0,0 +1,270 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"neural-network/models"
+	"neural-network/registry"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fehernandez12/sonate"
+)
+
+// largest model archive accepted by an upload
+const maxModelSize = 64 << 20
+
+var errVersionInUse = errors.New("the version is in use")
+
+func (s *Server) listModelsRoute(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	list, err := s.registry.List()
+	if err != nil {
+		s.handleError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	resp := &models.ModelListResponse{Models: list}
+	resp.Operation = "models"
+	resp.Success = true
+	resp.Time = time.Since(start).String()
+	s.sendResponse(w, r, http.StatusOK, resp, start)
+}
+
+func (s *Server) modelRoute(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	m, err := s.registry.Get(sonate.Vars(r)["name"])
+	if err != nil {
+		s.handleError(w, r, registryStatus(err), err)
+		return
+	}
+	resp := &models.ModelResponse{Model: m}
+	resp.Operation = "model"
+	resp.Success = true
+	resp.Time = time.Since(start).String()
+	s.sendResponse(w, r, http.StatusOK, resp, start)
+}
+
+func (s *Server) modelVersionRoute(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	name, version, err := versionVars(r)
+	if err != nil {
+		s.handleError(w, r, http.StatusNotFound, err)
+		return
+	}
+	v, err := s.registry.Version(name, version)
+	if err != nil {
+		s.handleError(w, r, registryStatus(err), err)
+		return
+	}
+	resp := &models.ModelVersionResponse{Version: v}
+	resp.Operation = "model_version"
+	resp.Success = true
+	resp.Time = time.Since(start).String()
+	s.sendResponse(w, r, http.StatusOK, resp, start)
+}
+
+// uploadModelRoute stores a model archive as the next version of a model.
+// The archive is the zip /download returns, sent as the "model" file of a
+// multipart form or as an application/zip body. The "dataset",
+// "preprocess", "labels" (comma separated) and "description" values
+// override the ones of the archive.
+func (s *Server) uploadModelRoute(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	name := sonate.Vars(r)["name"]
+	if !registry.ValidName(name) {
+		s.handleError(w, r, http.StatusBadRequest, registry.ErrInvalidName)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxModelSize)
+	archive, err := readModelArchive(r)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		s.handleError(w, r, http.StatusRequestEntityTooLarge, err)
+		return
+	}
+	if errors.Is(err, errUnsupportedMedia) {
+		s.handleError(w, r, http.StatusUnsupportedMediaType, err)
+		return
+	}
+	if err != nil {
+		s.handleError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	net, meta, err := registry.ReadArchive(archive)
+	if err != nil {
+		s.handleError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	meta.Name = name
+	if v := r.FormValue("dataset"); v != "" {
+		meta.Dataset = v
+	}
+	if v := r.FormValue("preprocess"); v != "" {
+		meta.Preprocess = v
+	}
+	if v := r.FormValue("labels"); v != "" {
+		meta.Labels = strings.Split(v, ",")
+		for i := range meta.Labels {
+			meta.Labels[i] = strings.TrimSpace(meta.Labels[i])
+		}
+	}
+	if v := r.FormValue("description"); v != "" {
+		meta.Description = v
+	}
+	if err := checkModel(&meta, net); err != nil {
+		s.handleError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	// the defaults are stored so the metadata says how the model is served
+	served := newServedModel(net, &meta)
+	meta.Preprocess, meta.Labels = served.preprocess, served.labels
+	// uploaded models that do not say their learning
+	// rate train with the one of new networks
+	if net.LearningRate == 0 {
+		net.LearningRate = s.config.Network.LearningRate
+	}
+	v, err := s.registry.Create(meta, net)
+	if err != nil {
+		s.handleError(w, r, registryStatus(err), err)
+		return
+	}
+	resp := &models.ModelVersionResponse{Version: v}
+	resp.Operation = "model_upload"
+	resp.Message = fmt.Sprintf("Stored %s v%d", v.Name, v.Version)
+	resp.Success = true
+	resp.Time = time.Since(start).String()
+	s.sendResponse(w, r, http.StatusCreated, resp, start)
+}
+
+func (s *Server) downloadModelRoute(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	name, version, err := versionVars(r)
+	if err != nil {
+		s.handleError(w, r, http.StatusNotFound, err)
+		return
+	}
+	// the archive is built before anything is written,
+	// so a failure can still be reported as JSON
+	var buf bytes.Buffer
+	if err := s.registry.Export(name, version, &buf); err != nil {
+		s.handleError(w, r, registryStatus(err), err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-v%d.zip"`, name, version))
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+	s.logger.Info(http.StatusOK, r.URL.Path, start)
+}
+
+func (s *Server) activateModelRoute(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	name, version, err := versionVars(r)
+	if err != nil {
+		s.handleError(w, r, http.StatusNotFound, err)
+		return
+	}
+	net, v, err := s.registry.Load(name, version)
+	if err != nil {
+		s.handleError(w, r, registryStatus(err), err)
+		return
+	}
+	if err := checkModel(v, net); err != nil {
+		s.handleError(w, r, http.StatusConflict, err)
+		return
+	}
+	if err := s.activate(v, net); err != nil {
+		s.handleError(w, r, registryStatus(err), err)
+		return
+	}
+	v.Active = true
+	resp := &models.ModelVersionResponse{Version: v}
+	resp.Operation = "model_activate"
+	resp.Message = fmt.Sprintf("Now serving %s v%d", name, version)
+	resp.Success = true
+	resp.Time = time.Since(start).String()
+	s.sendResponse(w, r, http.StatusOK, resp, start)
+}
+
+func (s *Server) deleteModelRoute(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	name, version, err := versionVars(r)
+	if err != nil {
+		s.handleError(w, r, http.StatusNotFound, err)
+		return
+	}
+	v, err := s.registry.Version(name, version)
+	if err != nil {
+		s.handleError(w, r, registryStatus(err), err)
+		return
+	}
+	err = s.served.unlessServing(name, version, func() error {
+		return s.registry.Delete(name, version)
+	})
+	if errors.Is(err, errVersionInUse) {
+		s.handleError(w, r, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		s.handleError(w, r, registryStatus(err), err)
+		return
+	}
+	resp := &models.ModelVersionResponse{Version: v}
+	resp.Operation = "model_delete"
+	resp.Message = fmt.Sprintf("Deleted %s v%d", name, version)
+	resp.Success = true
+	resp.Time = time.Since(start).String()
+	s.sendResponse(w, r, http.StatusOK, resp, start)
+}
+
+// versionVars reads the model name and the version, "3" or "v3", of a route
+func versionVars(r *http.Request) (string, int, error) {
+	vars := sonate.Vars(r)
+	version, err := strconv.Atoi(strings.TrimPrefix(vars["version"], "v"))
+	if err != nil || version <= 0 {
+		return "", 0, fmt.Errorf("invalid version: %q", vars["version"])
+	}
+	return vars["name"], version, nil
+}
+
+func registryStatus(err error) int {
+	switch {
+	case errors.Is(err, registry.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, registry.ErrInvalidName):
+		return http.StatusBadRequest
+	case errors.Is(err, registry.ErrActive):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// readModelArchive reads the zip of a multipart or application/zip upload
+func readModelArchive(r *http.Request) ([]byte, error) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errUnsupportedMedia, err)
+	}
+	switch mediaType {
+	case "application/zip", "application/x-zip-compressed", "application/octet-stream":
+		return io.ReadAll(r.Body)
+	case "multipart/form-data":
+		if err := r.ParseMultipartForm(maxModelSize); err != nil {
+			return nil, err
+		}
+		f, _, err := r.FormFile("model")
+		if err != nil {
+			return nil, fmt.Errorf("the model archive must be sent as the \"model\" file: %v", err)
+		}
+		defer f.Close()
+		return io.ReadAll(f)
+	}
+	return nil, fmt.Errorf("%w: %s, send a zip or a multipart form", errUnsupportedMedia, mediaType)
+}
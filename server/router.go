@@ -2,15 +2,63 @@ package server
 
 import (
 	"net/http"
+	"neural-network/auth"
 
 	"github.com/fehernandez12/sonate"
 )
 
 func (s *Server) router() http.Handler {
+	// outside of the router, so unknown routes get an ID too
+	return requestIDMiddleware(s.routes())
+}
+
+// routes is every route of the API, each one documented in openapi.go
+func (s *Server) routes() *sonate.Router {
 	router := sonate.NewRouter()
 	router.StrictSlash(true)
+	router.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.handleError(w, r, http.StatusNotFound, errRouteNotFound)
+	})
+	router.MethodNotAllowedHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.handleError(w, r, http.StatusMethodNotAllowed, errMethodNotAllowed)
+	})
 	router.Use(s.logger.RequestLoggerMiddleware)
-	router.HandleFunc("/train", s.trainRoute).Methods(http.MethodPost)
-	router.HandleFunc("/predict", s.predictRoute).Methods(http.MethodPost)
+	router.Use(s.metricsMiddleware)
+	router.HandleFunc("/healthz", s.healthzRoute).Methods(http.MethodGet)
+	router.HandleFunc("/readyz", s.readyzRoute).Methods(http.MethodGet)
+	router.HandleFunc("/info", s.infoRoute).Methods(http.MethodGet)
+	router.HandleFunc("/metrics", s.metricsRoute).Methods(http.MethodGet)
+	router.HandleFunc("/openapi.json", s.openAPIRoute).Methods(http.MethodGet)
+	router.HandleFunc("/docs", s.docsRoute).Methods(http.MethodGet)
+	router.HandleFunc("/ui", s.uiRoute).Methods(http.MethodGet)
+	router.HandleFunc("/train", s.require(auth.ScopeTrain, s.trainRoute)).Methods(http.MethodPost)
+	router.HandleFunc("/train/jobs", s.require(auth.ScopeTrain, s.listJobsRoute)).Methods(http.MethodGet)
+	router.HandleFunc("/train/jobs/{id}", s.require(auth.ScopeTrain, s.jobRoute)).Methods(http.MethodGet)
+	router.HandleFunc("/train/jobs/{id}", s.require(auth.ScopeTrain, s.cancelJobRoute)).Methods(http.MethodDelete)
+	router.HandleFunc("/train/jobs/{id}/metrics", s.require(auth.ScopeTrain, s.jobMetricsRoute)).Methods(http.MethodGet)
+	router.HandleFunc("/train/jobs/{id}/events", s.require(auth.ScopeTrain, s.jobEventsRoute)).Methods(http.MethodGet)
+	router.HandleFunc("/evaluate", s.require(auth.ScopeTrain, s.evaluateRoute)).Methods(http.MethodPost)
+	router.HandleFunc("/predict", s.require(auth.ScopePredict, s.predictRoute)).Methods(http.MethodPost)
+	router.HandleFunc("/predict/batch", s.require(auth.ScopePredict, s.predictBatchRoute)).Methods(http.MethodPost)
+	router.HandleFunc("/predict/pixels", s.require(auth.ScopePredict, s.predictPixelsRoute)).Methods(http.MethodPost)
+	router.HandleFunc("/detect", s.require(auth.ScopePredict, s.detectRoute)).Methods(http.MethodPost)
+	router.HandleFunc("/models", s.require(auth.ScopePredict, s.listModelsRoute)).Methods(http.MethodGet)
+	router.HandleFunc("/models/{name}", s.require(auth.ScopePredict, s.modelRoute)).Methods(http.MethodGet)
+	router.HandleFunc("/models/{name}/versions", s.require(auth.ScopeAdmin, s.uploadModelRoute)).Methods(http.MethodPost)
+	router.HandleFunc("/models/{name}/versions/{version}", s.require(auth.ScopePredict, s.modelVersionRoute)).Methods(http.MethodGet)
+	router.HandleFunc("/models/{name}/versions/{version}", s.require(auth.ScopeAdmin, s.deleteModelRoute)).Methods(http.MethodDelete)
+	router.HandleFunc("/models/{name}/versions/{version}/download", s.require(auth.ScopeAdmin, s.downloadModelRoute)).Methods(http.MethodGet)
+	router.HandleFunc("/models/{name}/versions/{version}/activate", s.require(auth.ScopeAdmin, s.activateModelRoute)).Methods(http.MethodPost)
+	router.HandleFunc("/models/{name}/predict", s.require(auth.ScopePredict, s.predictRoute)).Methods(http.MethodPost)
+	router.HandleFunc("/models/{name}/train", s.require(auth.ScopeTrain, s.trainRoute)).Methods(http.MethodPost)
+	router.HandleFunc("/models/{name}/evaluate", s.require(auth.ScopeTrain, s.evaluateRoute)).Methods(http.MethodPost)
+	router.HandleFunc("/models/{name}/split", s.require(auth.ScopePredict, s.splitRoute)).Methods(http.MethodGet)
+	router.HandleFunc("/models/{name}/split", s.require(auth.ScopeAdmin, s.startSplitRoute)).Methods(http.MethodPut)
+	router.HandleFunc("/models/{name}/split", s.require(auth.ScopeAdmin, s.endSplitRoute)).Methods(http.MethodDelete)
+	router.HandleFunc("/models/{name}/split/promote", s.require(auth.ScopeAdmin, s.promoteSplitRoute)).Methods(http.MethodPost)
+	router.HandleFunc("/models/{name}/feedback", s.require(auth.ScopePredict, s.feedbackRoute)).Methods(http.MethodPost)
+	router.HandleFunc("/models/{name}/shadow", s.require(auth.ScopePredict, s.shadowRoute)).Methods(http.MethodGet)
+	router.HandleFunc("/models/{name}/shadow", s.require(auth.ScopeAdmin, s.startShadowRoute)).Methods(http.MethodPut)
+	router.HandleFunc("/models/{name}/shadow", s.require(auth.ScopeAdmin, s.endShadowRoute)).Methods(http.MethodDelete)
 	return router
 }
@@ -1,50 +1,65 @@
 package server
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"mime/multipart"
+	"image"
+	"image/png"
 	"net/http"
+	"net/url"
 	"neural-network/cache"
+	"neural-network/config"
+	"neural-network/images"
 	"neural-network/logger"
 	"neural-network/models"
 	"neural-network/network"
+	"neural-network/registry"
 	"neural-network/utils"
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
-	"github.com/google/uuid"
 	"github.com/gorilla/handlers"
 	"github.com/redis/go-redis/v9"
 	"github.com/sirupsen/logrus"
 	"gonum.org/v1/gonum/mat"
 )
 
-type ServerConfig struct {
-	Timeout int
-	Addr    string
-}
+// datasets the server knows how to train and predict on
+const (
+	DatasetMNIST   = config.DatasetMNIST
+	DatasetCIFAR10 = config.DatasetCIFAR10
+)
 
 type Server struct {
-	config  *ServerConfig
-	logger  *logger.Logger
-	network *network.Network
+	config   *config.Config
+	logger   *logger.Logger
+	registry *registry.Registry
+	served   *modelSet
+	jobs     *jobManager
+	auth     *authenticator
+	started  time.Time
 }
 
-func (s *Server) Config() *ServerConfig {
+func (s *Server) Config() *config.Config {
 	return s.config
 }
 
+// Network returns the network of the default model
 func (s *Server) Network() *network.Network {
-	return s.network
+	return s.model().net
 }
 
-func StartServer() error {
+// StartServer reads the configuration from args, as given after the
+// name of the program, and serves until the process is interrupted
+func StartServer(args []string) error {
 	done := make(chan os.Signal, 1)
 	signal.Notify(done, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
 	stopper := make(chan struct{})
@@ -52,58 +67,118 @@ func StartServer() error {
 		<-done
 		close(stopper)
 	}()
-	server, err := newServer()
+	cfg, err := config.Load(args)
+	if err != nil {
+		return err
+	}
+	configureLogging(cfg.Log)
+	server, err := newServer(cfg)
 	if err != nil {
 		return err
 	}
 	return server.Start(stopper)
 }
 
-func newServer() (*Server, error) {
-	config, err := readServerConfig()
+func newServer(cfg *config.Config) (*Server, error) {
+	cacheRep, err := cache.Open(cfg.Cache)
 	if err != nil {
 		return nil, err
 	}
-	cacheRep := cache.GetRepositoryInstance()
 	cache.SetCacheRepository(cacheRep)
-	return &Server{
-		config:  config,
-		logger:  logger.NewLogger(),
-		network: network.NewNetwork(784, 200, 10, 0.1),
-	}, nil
+	reg, err := registry.New(cfg.Network.Registry)
+	if err != nil {
+		return nil, err
+	}
+	authn, err := newAuthenticator(cfg.Auth)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		config:   cfg,
+		logger:   logger.NewLogger(),
+		registry: reg,
+		served:   newModelSet(),
+		jobs:     newJobManager(),
+		auth:     authn,
+		started:  time.Now(),
+	}
+	if err := s.loadModels(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// configureLogging sets the level and format of the logrus logs
+func configureLogging(c config.Log) {
+	level, err := logrus.ParseLevel(c.Level)
+	if err == nil {
+		logrus.SetLevel(level)
+	}
+	if c.Format == "json" {
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	}
+}
+
+// newNetwork creates an untrained network for a dataset,
+// with the configured hidden layer and learning rate
+func (s *Server) newNetwork(dataset string) *network.Network {
+	n := s.config.Network
+	if dataset == DatasetCIFAR10 {
+		return network.NewNetwork(network.CifarInputs, n.Hiddens, len(network.CifarLabels), n.LearningRate)
+	}
+	return network.NewNetwork(network.MnistInputs, n.Hiddens, 10, n.LearningRate)
 }
 
 func (s *Server) Start(stop <-chan struct{}) error {
+	cors := s.config.Server.CORS
 	corsObj := handlers.CORS(
-		handlers.AllowedOrigins([]string{"*"}),
-		handlers.AllowedMethods([]string{"POST", "GET", "OPTIONS", "PUT", "DELETE"}),
-		handlers.AllowedHeaders([]string{"Content-Type", "Authorization"}),
+		handlers.AllowedOrigins(cors.AllowedOrigins),
+		handlers.AllowedMethods(cors.AllowedMethods),
+		handlers.AllowedHeaders(cors.AllowedHeaders),
 	)
-	// load the neural network weights from file
-	s.network.Load()
 	srv := &http.Server{
-		Addr:    s.config.Addr,
-		Handler: corsObj(s.router()),
+		Addr:              s.config.Server.Addr,
+		Handler:           corsObj(s.router()),
+		ReadTimeout:       s.config.Server.ReadTimeout,
+		ReadHeaderTimeout: s.config.Server.ReadHeaderTimeout,
+		WriteTimeout:      s.config.Server.WriteTimeout,
+		IdleTimeout:       s.config.Server.IdleTimeout,
 	}
 	go func() {
-		s.logger.WithField("addr", s.config.Addr)
+		s.logger.WithField("addr", s.config.Server.Addr)
 		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			logrus.Fatalf("listen: %s\n", err)
 		}
 	}()
 	<-stop
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(s.config.Timeout)*time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), s.config.Server.ShutdownTimeout)
 	defer cancel()
-	logrus.WithField("timeout", s.config.Timeout).Info("shutting down server")
+	logrus.WithField("timeout", s.config.Server.ShutdownTimeout).Info("shutting down server")
 	return srv.Shutdown(ctx)
 }
 
-func (s *Server) TrainNetwork(r *models.TrainRequest) (*models.TrainResponse, error) {
+// maxTrainEpochs bounds the epochs of a training job
+const maxTrainEpochs = 1000
+
+// validateTrainRequest checks every field of a training request.
+// Epochs 0 means the epochs of the configuration.
+func validateTrainRequest(r *models.TrainRequest) error {
+	invalid := &validationError{}
+	invalid.check(r.Epochs >= 0 && r.Epochs <= maxTrainEpochs, "epochs", "must be between 1 and %d, or 0 for the default, got %d", maxTrainEpochs, r.Epochs)
+	invalid.check(r.Canary >= 0 && r.Canary <= 100, "canary", "must be a percentage, got %g", r.Canary)
+	return invalid.err()
+}
+
+func (s *Server) TrainNetwork(m *servedModel, r *models.TrainRequest) (*models.TrainResponse, error) {
 	start := time.Now()
+	if !trainable(m.dataset) {
+		return nil, fmt.Errorf("%w: %s was not trained on %s or %s", errNotTrainable, m.name, DatasetMNIST, DatasetCIFAR10)
+	}
+	if err := validateTrainRequest(r); err != nil {
+		return nil, err
+	}
 	// check if weights are already trained
-	h, err := os.Stat("./data/hweights.model")
-	o, err1 := os.Stat("./data/oweights.model")
-	if ((err1 == nil && o.Size() > 0) && (err == nil && h.Size() > 0)) && !r.Force {
+	if m.version != nil && !r.Force {
 		logrus.WithField("step", "skipping training").Info("training network")
 		return &models.TrainResponse{
 			OperationResponse: models.OperationResponse{
@@ -117,65 +192,166 @@ func (s *Server) TrainNetwork(r *models.TrainRequest) (*models.TrainResponse, er
 		}, nil
 	}
 	logrus.WithField("step", "starting training").Info("training network")
-	resp := &models.TrainResponse{}
-	resp.Operation = "train"
-	if err := s.network.MnistTrain(r.Epochs); err != nil {
-		return nil, err
+	epochs, canary := r.Epochs, r.Canary
+	if epochs == 0 {
+		epochs = s.config.Network.Epochs
 	}
-	if err := s.network.Save(); err != nil {
+	j, err := s.jobs.start(JobKindTrain, m.name, epochs, func(ctx context.Context, j *job) error {
+		return s.runTraining(ctx, j, m, epochs, canary)
+	})
+	if err != nil {
 		return nil, err
 	}
+	resp := &models.TrainResponse{}
+	resp.Operation = "train"
+	resp.JobID = j.state.ID
 	resp.Time = time.Since(start).String()
-	resp.Message = "Training complete"
+	resp.Message = "Training started"
 	resp.Success = true
 	return resp, nil
 }
 
-func (s *Server) PredictNetwork(r *http.Request) (*models.PredictResponse, int, error) {
+func (s *Server) PredictNetwork(m *servedModel, r *http.Request) (*models.PredictResponse, int, error) {
 	start := time.Now()
-	resp := &models.PredictResponse{}
-	resp.Operation = "predict"
-	// get the file from the request and
-	// save it as a temporary image file
-	_, h, err := r.FormFile("image")
+	// decode the image straight from the request,
+	// hashing it as it streams in
+	u, err := readUpload(r, maxImagePixels)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) || errors.Is(err, utils.ErrImageTooLarge) {
+		return nil, http.StatusRequestEntityTooLarge, err
+	}
+	if err == utils.ErrUnsupportedFormat || errors.Is(err, errUnsupportedMedia) {
+		return nil, http.StatusUnsupportedMediaType, err
+	}
 	if err != nil {
 		return nil, http.StatusBadRequest, err
 	}
-	// create file
-	fileName, err := makeFile(h, r)
+	p, err := prepare(u.image, u.checksum, u.values)
 	if err != nil {
 		return nil, http.StatusBadRequest, err
 	}
-	isCached, cachedResult, err := checkCache(fileName)
+	resp, status, err := s.predictPrepared(m, p, start)
+	if err == nil {
+		s.shadowPredict(m, p, resp)
+	}
+	return resp, status, err
+}
+
+// predictPrepared answers from the cache when it can,
+// otherwise it runs the network and caches the result
+func (s *Server) predictPrepared(m *servedModel, p *prediction, start time.Time) (*models.PredictResponse, int, error) {
+	resp := &models.PredictResponse{}
+	resp.Operation = "predict"
+	key := m.cacheNamespace() + p.key
+	isCached, cachedResult, err := checkCache(key)
 	if err != nil {
 		return nil, http.StatusInternalServerError, err
 	}
 	if isCached {
 		logrus.Info("Retrieved from cache")
 		resp.Prediction = cachedResult.Prediction
+		resp.Label = m.label(cachedResult.Prediction)
 		resp.Results = cachedResult.Results
 		resp.Accuracy = cachedResult.Accuracy
+		resp.Number = cachedResult.Number
+		resp.Digits = cachedResult.Digits
+		resp.Cached = true
+		if resp.Digits == nil {
+			// cached by /predict/batch, which does not segment
+			resp.Number, resp.Digits = s.PredictNumber(m, p.image, p.opts)
+		}
 		resp.Time = time.Since(start).String()
 	} else {
-		prediction, results, accuracy := s.Predict(fileName)
+		prediction, results, accuracy := s.Predict(m, p.image, p.opts)
 		resp.Prediction = prediction
+		resp.Label = m.label(prediction)
 		resp.Results = makeResultsMap(results)
 		resp.Accuracy = accuracy
+		resp.Number, resp.Digits = s.PredictNumber(m, p.image, p.opts)
 		resp.Time = time.Since(start).String()
 		logrus.Info("Saving to cache")
 		cacheValue, err := json.Marshal(resp)
 		if err != nil {
 			return nil, http.StatusInternalServerError, err
 		}
-		err = cache.Put(utils.GetSHA256Checksum(fileName), string(cacheValue))
+		err = cache.Put(key, string(cacheValue))
 		if err != nil {
 			return nil, http.StatusInternalServerError, err
 		}
 	}
+	resp.Model = m.id()
+	resp.Variant = m.variant
+	resp.Polarity = p.polarity.String()
+	resp.PolaritySource = p.source
+	if p.preview {
+		if resp.Preview, err = m.preview(p.image, p.opts); err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+	}
 	resp.Success = true
 	return resp, http.StatusOK, nil
 }
 
+// prediction is an image with everything
+// needed to run it through the network
+type prediction struct {
+	image    image.Image
+	opts     images.MNISTOptions
+	checksum string
+	key      string
+	polarity images.Polarity
+	source   string
+	preview  bool
+}
+
+// prepare resolves the preprocessing and the cache key of an image
+// from the "invert", "binarize" and "deskew" values of a request, and
+// whether to send the image the network received from "preview"
+func prepare(img image.Image, checksum string, values url.Values) (*prediction, error) {
+	opts, err := preprocessOptions(values)
+	if err != nil {
+		return nil, err
+	}
+	polarity, source, err := resolvePolarity(values.Get("invert"), img)
+	if err != nil {
+		return nil, err
+	}
+	opts.InkIsDark = polarity == images.DarkInk
+	preview := false
+	if v := values.Get("preview"); v != "" {
+		if preview, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("preview must be true or false: %v", err)
+		}
+	}
+	return &prediction{
+		image:    img,
+		opts:     opts,
+		checksum: checksum,
+		key:      cacheKey(checksum, opts),
+		polarity: polarity,
+		source:   source,
+		preview:  preview,
+	}, nil
+}
+
+// resolvePolarity reads the optional "invert" form value. "true" means the
+// upload is a light digit on a dark background, as MNIST is, "false" means
+// a dark digit on a light background, and "auto" or no value at all
+// detects it from the image.
+func resolvePolarity(invert string, img image.Image) (images.Polarity, string, error) {
+	if invert == "" || strings.EqualFold(invert, "auto") {
+		return images.DetectPolarity(img), "auto", nil
+	}
+	light, err := strconv.ParseBool(invert)
+	if err != nil {
+		return images.DarkInk, "", fmt.Errorf("invert must be auto, true or false: %v", err)
+	}
+	if light {
+		return images.LightInk, "override", nil
+	}
+	return images.DarkInk, "override", nil
+}
+
 func makeResultsMap(results []float64) map[string]float64 {
 	m := make(map[string]float64)
 	for i := 0; i < len(results); i++ {
@@ -184,40 +360,122 @@ func makeResultsMap(results []float64) map[string]float64 {
 	return m
 }
 
-func makeFile(h *multipart.FileHeader, r *http.Request) (string, error) {
-	name := uuid.New().String()
-	saveFile(h, name)
-	fileName := fmt.Sprintf("./tmp/%s_raw.png", name)
-	img := utils.GetImage(fmt.Sprintf("./tmp/%s_raw.png", name))
-	invert, err := strconv.ParseBool(r.FormValue("invert"))
-	if err != nil {
-		return "", err
+func (s *Server) Predict(m *servedModel, img image.Image, opts images.MNISTOptions) (int, []float64, float64) {
+	input := m.imageData(img, opts)
+	output := m.net.Predict(input)
+	return columnResults(output, 0)
+}
+
+// PredictNumber splits the image into characters and predicts all of
+// them in one pass through the network. Only models with the MNIST
+// preprocessing read whole numbers, for others the result is empty.
+func (s *Server) PredictNumber(m *servedModel, img image.Image, opts images.MNISTOptions) (string, []models.DigitPrediction) {
+	digits := []models.DigitPrediction{}
+	if m.preprocess != PreprocessMNIST {
+		return "", digits
 	}
-	if invert {
-		inverted := utils.InvertImage(img)
-		utils.Save(inverted, fmt.Sprintf("./tmp/%s_inverted.png", name))
-		fileName = fmt.Sprintf("./tmp/%s_inverted.png", name)
+	segments := images.SegmentDigits(img, opts)
+	if len(segments) == 0 {
+		return "", digits
 	}
-	return fileName, nil
+	inputs := make([][]float64, len(segments))
+	for i, segment := range segments {
+		inputs[i] = network.DataFromGray(segment.Image)
+	}
+	output := m.net.PredictBatch(inputs)
+	var number strings.Builder
+	for i, segment := range segments {
+		digit, _, confidence := columnResults(output, i)
+		number.WriteString(m.label(digit))
+		digits = append(digits, models.DigitPrediction{
+			Digit:      digit,
+			Label:      m.label(digit),
+			Confidence: confidence,
+			Box: models.Box{
+				X:      segment.Bounds.Min.X,
+				Y:      segment.Bounds.Min.Y,
+				Width:  segment.Bounds.Dx(),
+				Height: segment.Bounds.Dy(),
+			},
+		})
+	}
+	return number.String(), digits
 }
 
-func (s *Server) Predict(fileName string) (int, []float64, float64) {
-	input := network.DataFromImage(fileName)
-	output := s.network.Predict(input)
-	results := MatrixToSlice(output)
+// columnResults reads the best class, the rounded percentages of every
+// class and the confidence from one column of the network output
+func columnResults(output mat.Matrix, j int) (int, []float64, float64) {
+	r, _ := output.Dims()
+	results := make([]float64, r)
 	best := 0
 	highest := 0.0
-	for i := 0; i < s.network.Outputs; i++ {
-		if output.At(i, 0) > highest {
+	for i := 0; i < r; i++ {
+		v := output.At(i, j)
+		results[i] = float64(int(v*10000)) / 100
+		if v > highest {
 			best = i
-			highest = output.At(i, 0)
+			highest = v
 		}
 	}
 	return best, results, float64(int(highest*10000)) / 100
 }
 
-func checkCache(fileName string) (bool, *models.PredictResponse, error) {
-	checkSum := utils.GetSHA256Checksum(fileName)
+// imageData reads the image in the shape the model was trained on
+func (m *servedModel) imageData(img image.Image, opts images.MNISTOptions) []float64 {
+	return InputData(m.preprocess, m.net, img, opts)
+}
+
+// InputData reads an image as the inputs of a network, with the
+// preprocessing of its model. opts only apply to PreprocessMNIST.
+func InputData(preprocess string, net *network.Network, img image.Image, opts images.MNISTOptions) []float64 {
+	if preprocess == PreprocessRGB {
+		side := squareSide(net.Inputs / network.CifarChannels)
+		return network.TensorFromImage(img, side, side, network.CifarChannels).Flatten()
+	}
+	return network.MNISTData(img, opts)
+}
+
+// preview encodes the image the model feeds the network as a PNG data URL
+func (m *servedModel) preview(img image.Image, opts images.MNISTOptions) (string, error) {
+	var input image.Image
+	if m.preprocess == PreprocessRGB {
+		side := squareSide(m.net.Inputs / network.CifarChannels)
+		input = images.Resize(img, side, side)
+	} else {
+		input = images.PrepareMNIST(img, opts)
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, input); err != nil {
+		return "", err
+	}
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// preprocessOptions reads the optional "binarize" and "deskew"
+// form values that tune the MNIST preprocessing
+func preprocessOptions(values url.Values) (images.MNISTOptions, error) {
+	opts := images.DefaultMNISTOptions
+	var err error
+	if v := values.Get("binarize"); v != "" {
+		if opts.Binarize, err = strconv.ParseBool(v); err != nil {
+			return opts, err
+		}
+	}
+	if v := values.Get("deskew"); v != "" {
+		if opts.Deskew, err = strconv.ParseBool(v); err != nil {
+			return opts, err
+		}
+	}
+	return opts, nil
+}
+
+// cacheKey keeps results of the same file with different
+// preprocessing apart
+func cacheKey(checkSum string, opts images.MNISTOptions) string {
+	return fmt.Sprintf("%s:%t:%t:%t", checkSum, opts.InkIsDark, opts.Binarize, opts.Deskew)
+}
+
+func checkCache(checkSum string) (bool, *models.PredictResponse, error) {
 	logrus.Info("Checking cache for ", checkSum)
 	result, err := cache.Get(checkSum)
 	if err == redis.Nil {
@@ -244,50 +502,3 @@ func MatrixToSlice(m mat.Matrix) []float64 {
 	}
 	return s
 }
-
-func saveFile(h *multipart.FileHeader, name string) {
-	file, err := h.Open()
-	if err != nil {
-		return
-	}
-	defer file.Close()
-	out, err := os.Create(fmt.Sprintf("./tmp/%s_raw.%s", name, getExtension(h.Filename)))
-	if err != nil {
-		return
-	}
-	defer out.Close()
-	_, err = io.Copy(out, file)
-	if err != nil {
-		return
-	}
-}
-
-func sendErrorResponse(w http.ResponseWriter, status int, err error) {
-	response, err := json.Marshal(models.NewErrorResponse(status, err))
-	w.Header().Set("Content-Type", "application/json")
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	w.WriteHeader(status)
-	w.Write(response)
-}
-
-func getExtension(filename string) string {
-	return filename[len(filename)-3:]
-}
-
-func readServerConfig() (*ServerConfig, error) {
-	config := &ServerConfig{}
-	timeout, err := strconv.Atoi(os.Getenv("SERVER_TIMEOUT"))
-	if err != nil {
-		timeout = 30000
-	}
-	config.Timeout = timeout
-	addr := os.Getenv("SERVER_ADDR")
-	if addr == "" {
-		addr = ":8080"
-	}
-	config.Addr = addr
-	return config, nil
-}
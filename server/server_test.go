@@ -0,0 +1,1599 @@
+package server
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"neural-network/cache"
+	"neural-network/config"
+	"neural-network/images"
+	"neural-network/logger"
+	"neural-network/models"
+	"neural-network/network"
+	"neural-network/registry"
+	"neural-network/utils"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fehernandez12/sonate"
+	"gonum.org/v1/gonum/mat"
+)
+
+// testAdminKey is the admin API key of the test servers
+const testAdminKey = "test-admin-key-0123456789"
+
+func newTestServer() *Server {
+	cache.SetCacheRepository(cache.NewInMemoryCacheRepository())
+	c := testConfig()
+	authn, err := newAuthenticator(c.Auth)
+	if err != nil {
+		panic(err)
+	}
+	s := &Server{
+		config:  c,
+		logger:  logger.NewLogger(),
+		served:  newModelSet(),
+		jobs:    newJobManager(),
+		auth:    authn,
+		started: time.Now(),
+	}
+	s.served.set(untrainedModel(DatasetMNIST, DatasetMNIST, network.NewNetwork(784, 50, 10, 0.1)))
+	return s
+}
+
+func testConfig() *config.Config {
+	c := config.Default()
+	c.Network.Model = DatasetMNIST
+	c.Auth.Keys = []config.Key{{Name: "admin", Key: testAdminKey, Scopes: []string{"admin"}}}
+	c.Auth.RateLimit = config.RateLimit{}
+	return c
+}
+
+func multipartBody(data []byte, fields map[string]string) (*bytes.Buffer, string) {
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	for k, v := range fields {
+		mw.WriteField(k, v)
+	}
+	fw, _ := mw.CreateFormFile("image", "digit")
+	fw.Write(data)
+	mw.Close()
+	return body, mw.FormDataContentType()
+}
+
+func TestConcurrentPredictions(t *testing.T) {
+	s := newTestServer()
+	handler := s.router()
+
+	// every digit is predicted once without any concurrency
+	// to know what each request has to answer
+	files := make([][]byte, 10)
+	want := make([]map[string]float64, 10)
+	for i := range want {
+		data, err := os.ReadFile(fmt.Sprintf("../nums/%d.png", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[i] = data
+		img, _, err := utils.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts := images.DefaultMNISTOptions
+		opts.InkIsDark = images.DetectPolarity(img) == images.DarkInk
+		_, results, _ := s.Predict(s.model(), img, opts)
+		want[i] = makeResultsMap(results)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for n := 0; n < 100; n++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			digit := n % 10
+			body, contentType := multipartBody(files[digit], map[string]string{"invert": "auto"})
+			req := httptest.NewRequest(http.MethodPost, "/predict", body)
+			req.Header.Set("Content-Type", contentType)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				errs <- fmt.Errorf("request %d: status %d: %s", n, rec.Code, rec.Body.String())
+				return
+			}
+			var resp models.PredictResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				errs <- err
+				return
+			}
+			if !reflect.DeepEqual(resp.Results, want[digit]) {
+				errs <- fmt.Errorf("request %d: got %v, want %v", n, resp.Results, want[digit])
+			}
+		}(n)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if _, err := os.Stat("./tmp"); !os.IsNotExist(err) {
+		t.Errorf("predictions should not write to ./tmp")
+	}
+}
+
+func TestPredictRejectsUnknownFormat(t *testing.T) {
+	s := newTestServer()
+	body, contentType := multipartBody([]byte("not an image"), nil)
+	req := httptest.NewRequest(http.MethodPost, "/predict", body)
+	req.Header.Set("Content-Type", contentType)
+	rec := httptest.NewRecorder()
+	s.router().ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusUnsupportedMediaType)
+	}
+}
+
+func TestPredictBatchRejectsTooManyEntries(t *testing.T) {
+	s := newTestServer()
+	var body bytes.Buffer
+	zw := zip.NewWriter(&body)
+	for i := 0; i <= maxBatchItems; i++ {
+		fw, err := zw.Create(fmt.Sprintf("digit-%d.png", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte("not an image"))
+	}
+	zw.Close()
+	zipped := body.Bytes()
+	req := httptest.NewRequest(http.MethodPost, "/predict/batch", bytes.NewReader(zipped))
+	req.Header.Set("Content-Type", "application/zip")
+	req.Header.Set(APIKeyHeader, testAdminKey)
+	rec := httptest.NewRecorder()
+	s.router().ServeHTTP(rec, req)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("got status %d, want %d: %s", rec.Code, http.StatusRequestEntityTooLarge, rec.Body.String())
+	}
+
+	// the entries are read until the budget runs out, not all expanded first
+	budget := newBatchBudget(maxBatchItems, maxBatchDecoded)
+	if _, err := readZipBatch(zipped, budget); !errors.Is(err, errBatchTooLarge) {
+		t.Fatalf("got %v, want %v", err, errBatchTooLarge)
+	}
+	if budget.items != maxBatchItems {
+		t.Errorf("read %d entries, want %d", budget.items, maxBatchItems)
+	}
+	budget = newBatchBudget(maxBatchItems, 100)
+	if _, err := readZipBatch(zipped, budget); !errors.Is(err, errBatchTooLarge) {
+		t.Fatalf("got %v over the byte budget, want %v", err, errBatchTooLarge)
+	}
+	if budget.items != 9 {
+		t.Errorf("read %d entries of 12 bytes out of 100, want 9", budget.items)
+	}
+}
+
+// blankPNG encodes a white image of the given size
+func TestPredictBatchRejectsTooManyPixels(t *testing.T) {
+	s := newTestServer()
+	// a few kilobytes that decode to 25M pixels each, three are over the
+	// pixels of a batch
+	large := blankPNG(t, 5000, 5000)
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	for i := 0; i < 3; i++ {
+		fw, _ := mw.CreateFormFile("images", fmt.Sprintf("large-%d.png", i))
+		fw.Write(large)
+	}
+	mw.Close()
+	if body.Len() > 1<<20 {
+		t.Fatalf("the batch takes %d bytes, the test needs images small on disk", body.Len())
+	}
+	req := httptest.NewRequest(http.MethodPost, "/predict/batch", body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	rec := httptest.NewRecorder()
+	s.router().ServeHTTP(rec, req)
+	var resp models.ErrorResponse
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if rec.Code != http.StatusRequestEntityTooLarge || resp.Code != models.CodeTooLarge {
+		t.Errorf("got %d %s, want %d %s: %s", rec.Code, resp.Code,
+			http.StatusRequestEntityTooLarge, models.CodeTooLarge, rec.Body.String())
+	}
+}
+
+func blankPNG(t *testing.T, w, h int) []byte {
+	t.Helper()
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for i := range img.Pix {
+		img.Pix[i] = 255
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDetectRejectsLargeImages(t *testing.T) {
+	s := newTestServer()
+	body, contentType := multipartBody(blankPNG(t, 2100, 2100), nil)
+	req := httptest.NewRequest(http.MethodPost, "/detect", body)
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set(APIKeyHeader, testAdminKey)
+	rec := httptest.NewRecorder()
+	s.router().ServeHTTP(rec, req)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("got status %d, want %d: %s", rec.Code, http.StatusRequestEntityTooLarge, rec.Body.String())
+	}
+}
+
+// pngHeader is the start of a PNG of the given size, enough for its
+// header to be read but without any pixel
+func pngHeader(w, h uint32) []byte {
+	ihdr := make([]byte, 17)
+	copy(ihdr, "IHDR")
+	binary.BigEndian.PutUint32(ihdr[4:], w)
+	binary.BigEndian.PutUint32(ihdr[8:], h)
+	ihdr[12], ihdr[13] = 8, 0 // 8-bit grayscale
+	data := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0d")
+	data = append(data, ihdr...)
+	return binary.BigEndian.AppendUint32(data, crc32.ChecksumIEEE(ihdr))
+}
+
+func TestPredictRejectsHugeImages(t *testing.T) {
+	s := newTestServer()
+	handler := s.router()
+	huge := pngHeader(100000, 100000)
+
+	body, contentType := multipartBody(huge, nil)
+	req := httptest.NewRequest(http.MethodPost, "/predict", body)
+	req.Header.Set("Content-Type", contentType)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	var resp models.ErrorResponse
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if rec.Code != http.StatusRequestEntityTooLarge || resp.Code != models.CodeImageTooLarge {
+		t.Errorf("/predict: got %d %s, want %d %s", rec.Code, resp.Code, http.StatusRequestEntityTooLarge, models.CodeImageTooLarge)
+	}
+
+	pixels, _ := json.Marshal(models.PixelPredictRequest{Data: base64.StdEncoding.EncodeToString(huge)})
+	req = httptest.NewRequest(http.MethodPost, "/predict/pixels", bytes.NewReader(pixels))
+	req.Header.Set("Content-Type", "application/json")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	resp = models.ErrorResponse{}
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if rec.Code != http.StatusRequestEntityTooLarge || resp.Code != models.CodeImageTooLarge {
+		t.Errorf("/predict/pixels: got %d %s, want %d %s", rec.Code, resp.Code, http.StatusRequestEntityTooLarge, models.CodeImageTooLarge)
+	}
+
+	// in a batch, only the item of the huge image fails
+	digit, err := os.ReadFile("../nums/7.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var batch bytes.Buffer
+	mw := multipart.NewWriter(&batch)
+	for name, data := range map[string][]byte{"huge.png": huge, "7.png": digit} {
+		fw, _ := mw.CreateFormFile("images", name)
+		fw.Write(data)
+	}
+	mw.Close()
+	req = httptest.NewRequest(http.MethodPost, "/predict/batch", &batch)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	var batchResp models.BatchPredictResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &batchResp); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("/predict/batch: status %d: %s", rec.Code, rec.Body.String())
+	}
+	for _, item := range batchResp.Items {
+		if failed := item.Name == "huge.png"; item.Success == failed {
+			t.Errorf("/predict/batch: %s succeeded %v: %s", item.Name, item.Success, item.Error)
+		}
+		if item.Name == "huge.png" && !strings.Contains(item.Error, utils.ErrImageTooLarge.Error()) {
+			t.Errorf("/predict/batch: huge.png failed with %q", item.Error)
+		}
+	}
+}
+
+// headerCounter counts the status lines a handler writes
+type headerCounter struct {
+	*httptest.ResponseRecorder
+	headers int
+}
+
+func (c *headerCounter) WriteHeader(status int) {
+	c.headers++
+	c.ResponseRecorder.WriteHeader(status)
+}
+
+func TestErrorResponses(t *testing.T) {
+	s := newTestServer()
+	handler := s.router()
+	notImage, notImageType := multipartBody([]byte("not an image"), nil)
+	huge, hugeType := multipartBody(pngHeader(100000, 100000), nil)
+	noImage := &bytes.Buffer{}
+	mw := multipart.NewWriter(noImage)
+	mw.WriteField("invert", "auto")
+	mw.Close()
+	tests := []struct {
+		method, path, contentType string
+		body                      io.Reader
+		status                    int
+		code                      string
+	}{
+		{http.MethodPost, "/predict", mw.FormDataContentType(), noImage, http.StatusBadRequest, models.CodeMissingImage},
+		{http.MethodPost, "/predict", notImageType, notImage, http.StatusUnsupportedMediaType, models.CodeUnsupportedMedia},
+		{http.MethodPost, "/predict", hugeType, huge, http.StatusRequestEntityTooLarge, models.CodeImageTooLarge},
+		{http.MethodPost, "/predict", "text/plain", strings.NewReader("7"), http.StatusUnsupportedMediaType, models.CodeUnsupportedMedia},
+		{http.MethodPost, "/predict/pixels", "application/json", strings.NewReader("{"), http.StatusBadRequest, models.CodeInvalidJSON},
+		{http.MethodPost, "/train", "application/json", strings.NewReader(`{"epochs": -1}`), http.StatusUnprocessableEntity, models.CodeValidation},
+		{http.MethodPost, "/models/nope/predict", notImageType, strings.NewReader(""), http.StatusNotFound, models.CodeModelNotFound},
+		{http.MethodGet, "/train/jobs/nope", "", nil, http.StatusNotFound, models.CodeJobNotFound},
+		{http.MethodGet, "/predict", "", nil, http.StatusMethodNotAllowed, models.CodeMethodNotAllowed},
+		{http.MethodGet, "/nope", "", nil, http.StatusNotFound, models.CodeNotFound},
+	}
+	for i, tt := range tests {
+		name := tt.method + " " + tt.path
+		req := httptest.NewRequest(tt.method, tt.path, tt.body)
+		if tt.contentType != "" {
+			req.Header.Set("Content-Type", tt.contentType)
+		}
+		req.Header.Set(APIKeyHeader, testAdminKey)
+		// every other request brings its own ID
+		clientID := ""
+		if i%2 == 0 {
+			clientID = fmt.Sprintf("client-%d", i)
+			req.Header.Set(RequestIDHeader, clientID)
+		}
+		rec := &headerCounter{ResponseRecorder: httptest.NewRecorder()}
+		handler.ServeHTTP(rec, req)
+
+		if rec.headers != 1 {
+			t.Errorf("%s: the status was written %d times", name, rec.headers)
+		}
+		dec := json.NewDecoder(rec.Body)
+		var resp models.ErrorResponse
+		if err := dec.Decode(&resp); err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if dec.More() {
+			t.Errorf("%s: more than one response in the body", name)
+		}
+		if rec.Code != tt.status || resp.Status != tt.status || resp.Code != tt.code || resp.Success {
+			t.Errorf("%s: got %d %d %s, want %d %s", name, rec.Code, resp.Status, resp.Code, tt.status, tt.code)
+		}
+		id := rec.Header().Get(RequestIDHeader)
+		if id == "" || resp.RequestID != id || (clientID != "" && id != clientID) {
+			t.Errorf("%s: request ID %q in the header, %q in the body, sent %q", name, id, resp.RequestID, clientID)
+		}
+	}
+}
+
+// writeMnistCSV writes n random MNIST records
+func writeMnistCSV(path string, n int) error {
+	var buf bytes.Buffer
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&buf, "%d", i%10)
+		for p := 0; p < network.MnistInputs; p++ {
+			fmt.Fprintf(&buf, ",%d", (i*31+p*7)%256)
+		}
+		buf.WriteByte('\n')
+	}
+	return os.WriteFile(path, buf.Bytes(), 0644)
+}
+
+// mnistDatasets moves the test into a directory with MNIST training and
+// test sets of the given sizes, the datasets are read relative to the
+// working directory
+func mnistDatasets(t *testing.T, train, test int) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	if err := os.Mkdir(filepath.Join(dir, "mnist_dataset"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeMnistCSV(network.MnistTrainFile, train); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeMnistCSV(network.MnistTestFile, test); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConcurrentTrainAndPredict(t *testing.T) {
+	data, err := os.ReadFile("../nums/7.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer()
+	if s.registry, err = registry.New(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	served := s.model()
+	before := served.net.Clone()
+
+	mnistDatasets(t, 100, 20)
+
+	handler := s.router()
+	req := httptest.NewRequest(http.MethodPost, "/train", strings.NewReader(`{"epochs": 2}`))
+	req.Header.Set(APIKeyHeader, testAdminKey)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("train: status %d: %s", rec.Code, rec.Body.String())
+	}
+	var train models.TrainResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &train); err != nil {
+		t.Fatal(err)
+	}
+	j, err := s.jobs.get(train.JobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// predictions keep going while the network trains
+	// and while the trained one is swapped in
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for n := 0; n < 4; n++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-j.done:
+					return
+				default:
+				}
+				// a different image every time so the cache is not used
+				img := append(append([]byte{}, data...), byte(n), byte(i), byte(i>>8))
+				body, contentType := multipartBody(img, nil)
+				req := httptest.NewRequest(http.MethodPost, "/predict", body)
+				req.Header.Set("Content-Type", contentType)
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, req)
+				if rec.Code != http.StatusOK {
+					errs <- fmt.Errorf("status %d: %s", rec.Code, rec.Body.String())
+					return
+				}
+			}
+		}(n)
+	}
+	select {
+	case <-j.done:
+	case <-time.After(time.Minute):
+		t.Fatal("training did not finish")
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	if state := j.snapshot(); state.Status != JobSucceeded {
+		t.Fatalf("training %s: %s", state.Status, state.Error)
+	}
+	if !mat.Equal(served.net.HiddenWeights, before.HiddenWeights) || !mat.Equal(served.net.OutputWeights, before.OutputWeights) {
+		t.Error("training modified the network that was being served")
+	}
+	if m := s.model(); m.version == nil || m.version.Version != 1 {
+		t.Errorf("the trained network should be served as version 1, got %s", m.id())
+	}
+}
+
+func TestTrainedVersionDoesNotReplaceNewerActivation(t *testing.T) {
+	s := newTestServer()
+	var err error
+	if s.registry, err = registry.New(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	trainedFrom := s.model()
+	activated, err := s.registry.Create(models.ModelVersion{Name: DatasetMNIST, Dataset: DatasetMNIST}, network.NewNetwork(784, 20, 10, 0.1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	trained, err := s.registry.Create(models.ModelVersion{Name: DatasetMNIST, Dataset: DatasetMNIST}, network.NewNetwork(784, 20, 10, 0.1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// version 1 is activated while version 2 trains from the old model
+	if err := s.activate(activated, network.NewNetwork(784, 20, 10, 0.1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.activateOver(trainedFrom, trained, network.NewNetwork(784, 20, 10, 0.1)); !errors.Is(err, errModelChanged) {
+		t.Fatalf("got %v, want %v", err, errModelChanged)
+	}
+	if m := s.model(); m.version == nil || m.version.Version != activated.Version {
+		t.Errorf("version %d should still be served, got %s", activated.Version, m.id())
+	}
+	if m, err := s.registry.Get(DatasetMNIST); err != nil || m.ActiveVersion != activated.Version {
+		t.Errorf("version %d should still be active in the registry, got %v, %v", activated.Version, m, err)
+	}
+
+	// from the served model, the trained version is activated
+	if err := s.activateOver(s.model(), trained, network.NewNetwork(784, 20, 10, 0.1)); err != nil {
+		t.Fatal(err)
+	}
+	if m := s.model(); m.version == nil || m.version.Version != trained.Version {
+		t.Errorf("version %d should be served, got %s", trained.Version, m.id())
+	}
+}
+
+func TestUntrainableModelConflicts(t *testing.T) {
+	s := newTestServer()
+	s.served.set(untrainedModel("letters", "letters", network.NewNetwork(784, 20, 26, 0.1)))
+	handler := s.router()
+	for path, body := range map[string]string{"/models/letters/train": "{}", "/models/letters/evaluate": ""} {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set(APIKeyHeader, testAdminKey)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		var resp models.ErrorResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if rec.Code != http.StatusConflict || resp.Code != models.CodeNoTrainingData {
+			t.Errorf("%s: got %d %s, want %d %s", path, rec.Code, resp.Code, http.StatusConflict, models.CodeNoTrainingData)
+		}
+	}
+}
+
+// TestOpenAPIMatchesRouter fails when a route is served but not
+// documented, or documented but not served, or when the scope of a
+// route in the document is not the one the router asks for.
+func TestOpenAPIMatchesRouter(t *testing.T) {
+	s := newTestServer()
+	served := map[string]bool{}
+	err := s.routes().Walk(func(route *sonate.Route, router *sonate.Router, ancestors []*sonate.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			return err
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return err
+		}
+		for _, method := range methods {
+			served[method+" "+path] = true
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	s.router().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("openapi.json: status %d", rec.Code)
+	}
+	var doc struct {
+		Paths map[string]map[string]struct {
+			Scope string `json:"x-scope"`
+		} `json:"paths"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	documented := map[string]string{}
+	for path, item := range doc.Paths {
+		for method, op := range item {
+			documented[strings.ToUpper(method)+" "+path] = op.Scope
+		}
+	}
+	for route := range served {
+		if _, ok := documented[route]; !ok {
+			t.Errorf("%s is served but not in openapi.json", route)
+		}
+	}
+	for route := range documented {
+		if !served[route] {
+			t.Errorf("%s is in openapi.json but not served", route)
+		}
+	}
+
+	// every $ref of the document points to a component
+	refs := regexp.MustCompile(`"\$ref": "#/components/(\w+)/(\w+)"`).FindAllStringSubmatch(rec.Body.String(), -1)
+	var full struct {
+		Components map[string]map[string]json.RawMessage `json:"components"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &full); err != nil {
+		t.Fatal(err)
+	}
+	for _, ref := range refs {
+		if _, ok := full.Components[ref[1]][ref[2]]; !ok {
+			t.Errorf("openapi.json refers to the missing component %s/%s", ref[1], ref[2])
+		}
+	}
+
+	// without a key a route with a scope answers 401, and with
+	// the key of the scope below, 403
+	c := testConfig()
+	c.Auth.Anonymous = nil
+	c.Auth.Keys = []config.Key{
+		{Name: "predict", Key: "test-predict-key-0123456789", Scopes: []string{"predict"}},
+		{Name: "train", Key: "test-train-key-0123456789", Scopes: []string{"train"}},
+	}
+	if s.auth, err = newAuthenticator(c.Auth); err != nil {
+		t.Fatal(err)
+	}
+	below := map[string]string{"train": "test-predict-key-0123456789", "admin": "test-train-key-0123456789"}
+	params := strings.NewReplacer("{name}", "mnist", "{version}", "1", "{id}", "job")
+	handler := s.router()
+	for route, scope := range documented {
+		if scope == "" {
+			continue
+		}
+		method, path, _ := strings.Cut(route, " ")
+		req := httptest.NewRequest(method, params.Replace(path), nil)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s without a key: status %d, expected 401", route, rec.Code)
+		}
+		if key, ok := below[scope]; ok {
+			req := httptest.NewRequest(method, params.Replace(path), nil)
+			req.Header.Set(APIKeyHeader, key)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != http.StatusForbidden {
+				t.Errorf("%s with a key below %s: status %d, expected 403", route, scope, rec.Code)
+			}
+		}
+	}
+}
+
+func TestEvaluateUploadedCSV(t *testing.T) {
+	// hidden neuron k only looks at pixel k and output k only at hidden
+	// neuron k, so the network predicts the lit pixel of a record
+	hidden := mat.NewDense(10, network.MnistInputs, nil)
+	output := mat.NewDense(10, 10, nil)
+	for k := 0; k < 10; k++ {
+		hidden.Set(k, k, 10)
+		output.Set(k, k, 10)
+	}
+	s := newTestServer()
+	s.served.set(untrainedModel(DatasetMNIST, DatasetMNIST, &network.Network{
+		Inputs: network.MnistInputs, Hiddens: 10, Outputs: 10,
+		HiddenWeights: hidden, OutputWeights: output, LearningRate: 0.1,
+	}))
+	handler := s.router()
+
+	// 50 records, 5 of every label: the first 40 light the pixel of
+	// their label, the last 10 the pixel of the next label
+	var csv strings.Builder
+	for i := 0; i < 50; i++ {
+		label, lit := i%10, i%10
+		if i >= 40 {
+			lit = (label + 1) % 10
+		}
+		fmt.Fprint(&csv, label)
+		for p := 0; p < network.MnistInputs; p++ {
+			if p == lit {
+				csv.WriteString(",255")
+			} else {
+				csv.WriteString(",0")
+			}
+		}
+		csv.WriteString("\n")
+	}
+	req := httptest.NewRequest(http.MethodPost, "/evaluate", strings.NewReader(csv.String()))
+	req.Header.Set("Content-Type", "text/csv")
+	req.Header.Set(APIKeyHeader, testAdminKey)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp models.EvaluateResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	j, err := s.jobs.get(resp.JobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-j.done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the evaluation did not finish")
+	}
+	state := j.snapshot()
+	if state.Status != JobSucceeded || state.Evaluation == nil {
+		t.Fatalf("job %s: %s", state.Status, state.Error)
+	}
+
+	want := make([][]int, 10)
+	for label := range want {
+		want[label] = make([]int, 10)
+		want[label][label] = 4
+		want[label][(label+1)%10] = 1
+	}
+	got := state.Evaluation
+	if !reflect.DeepEqual(got.Confusion, want) {
+		t.Errorf("confusion matrix %v, want %v", got.Confusion, want)
+	}
+	if got.Samples != 50 || got.Correct != 40 || got.Accuracy != 80 || got.MacroF1 != 80 {
+		t.Errorf("got %d samples, %d correct, %.2f%%, macro F1 %.2f, want 50, 40, 80%%, 80",
+			got.Samples, got.Correct, got.Accuracy, got.MacroF1)
+	}
+	for _, c := range got.Classes {
+		if c.Support != 5 || c.Predicted != 5 || c.Precision != 80 || c.Recall != 80 || c.F1 != 80 {
+			t.Errorf("label %s: support %d, predicted %d, precision %.2f, recall %.2f, F1 %.2f, want 5, 5, 80, 80, 80",
+				c.Label, c.Support, c.Predicted, c.Precision, c.Recall, c.F1)
+		}
+	}
+}
+
+func TestEvaluateRejectsTooManyImages(t *testing.T) {
+	s := newTestServer()
+	var body bytes.Buffer
+	zw := zip.NewWriter(&body)
+	for i := 0; i <= maxEvaluationImages; i++ {
+		fw, err := zw.Create(fmt.Sprintf("%d/%d.png", i%10, i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte("not an image"))
+	}
+	zw.Close()
+	req := httptest.NewRequest(http.MethodPost, "/evaluate", &body)
+	req.Header.Set("Content-Type", "application/zip")
+	req.Header.Set(APIKeyHeader, testAdminKey)
+	rec := httptest.NewRecorder()
+	s.router().ServeHTTP(rec, req)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("got status %d, want %d: %s", rec.Code, http.StatusRequestEntityTooLarge, rec.Body.String())
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	s := newTestServer()
+	c := testConfig()
+	c.Auth.Anonymous = nil
+	c.Auth.Keys = append(c.Auth.Keys, config.Key{Name: "predict", Key: "test-predict-key-0123456789", Scopes: []string{"predict"}})
+	c.Auth.RateLimit.PerIP = config.Rate{Rate: 0.5, Burst: 1}
+	var err error
+	if s.auth, err = newAuthenticator(c.Auth); err != nil {
+		t.Fatal(err)
+	}
+	handler := s.router()
+	send := func(path, key, ip string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = ip + ":1234"
+		if key != "" {
+			req.Header.Set(APIKeyHeader, key)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for i, tc := range []struct {
+		name, path, key string
+		status          int
+		code            string
+	}{
+		{"no key", "/models", "", http.StatusUnauthorized, models.CodeMissingKey},
+		{"invalid key", "/models", "not-a-key", http.StatusUnauthorized, models.CodeInvalidKey},
+		{"key below the scope", "/train/jobs", "test-predict-key-0123456789", http.StatusForbidden, models.CodeForbidden},
+		{"key of the scope", "/train/jobs", testAdminKey, http.StatusOK, ""},
+	} {
+		// every case comes from its own address, the limit is by IP without a key
+		rec := send(tc.path, tc.key, fmt.Sprintf("192.0.2.%d", i+1))
+		if rec.Code != tc.status {
+			t.Errorf("%s: status %d, want %d: %s", tc.name, rec.Code, tc.status, rec.Body.String())
+			continue
+		}
+		if tc.status == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: 401 without WWW-Authenticate", tc.name)
+		}
+		if tc.code != "" {
+			var e models.ErrorResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &e); err != nil || e.Code != tc.code {
+				t.Errorf("%s: code %q, want %q", tc.name, e.Code, tc.code)
+			}
+		}
+	}
+
+	// a burst of 1 at half a request per second: the second request
+	// of an address waits 2 seconds, other addresses are not limited
+	if rec := send("/models", "", "198.51.100.1"); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("first request: status %d, want 401", rec.Code)
+	}
+	rec := send("/models", "", "198.51.100.1")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("second request: status %d, want 429", rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "2" {
+		t.Errorf("Retry-After %q, want 2", got)
+	}
+	var e models.ErrorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &e); err != nil || e.Code != models.CodeRateLimited {
+		t.Errorf("429 with code %q, want %q", e.Code, models.CodeRateLimited)
+	}
+	if rec := send("/models", "", "198.51.100.2"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("another address: status %d, want 401", rec.Code)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		trust     bool
+		hops      int
+		forwarded []string
+		want      string
+	}{
+		{"no proxy", false, 0, []string{"203.0.113.9"}, "10.0.0.1"},
+		{"one proxy", true, 0, []string{"203.0.113.9"}, "203.0.113.9"},
+		{"spoofed entry", true, 0, []string{"1.2.3.4, 203.0.113.9"}, "203.0.113.9"},
+		{"spoofed header", true, 0, []string{"1.2.3.4", "203.0.113.9"}, "203.0.113.9"},
+		{"two proxies", true, 2, []string{"1.2.3.4, 203.0.113.9, 10.0.0.2"}, "203.0.113.9"},
+		{"fewer entries than proxies", true, 3, []string{"203.0.113.9"}, "203.0.113.9"},
+		{"no header", true, 0, nil, "10.0.0.1"},
+	} {
+		a, err := newAuthenticator(config.Auth{TrustProxy: tc.trust, ProxyHops: tc.hops})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		for _, f := range tc.forwarded {
+			req.Header.Add("X-Forwarded-For", f)
+		}
+		if got := a.clientIP(req); got != tc.want {
+			t.Errorf("%s: client IP %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+// splitModels are two versions of the mnist model for a traffic split
+func splitModels() (*servedModel, *servedModel) {
+	baseline := untrainedModel(DatasetMNIST, DatasetMNIST, network.NewNetwork(784, 10, 10, 0.1))
+	candidate := untrainedModel(DatasetMNIST, DatasetMNIST, network.NewNetwork(784, 10, 10, 0.1))
+	baseline.version = &models.ModelVersion{Name: DatasetMNIST, Version: 1}
+	candidate.version = &models.ModelVersion{Name: DatasetMNIST, Version: 2}
+	return baseline, candidate
+}
+
+func TestSplitPick(t *testing.T) {
+	baseline, candidate := splitModels()
+	const clients = 20000
+	previous := make([]bool, clients)
+	for _, weight := range []float64{0, 10, 25, 50, 90, 100} {
+		sp := newSplit(baseline, candidate, weight)
+		share := 0
+		for i := 0; i < clients; i++ {
+			client := fmt.Sprintf("client-%d", i)
+			m := sp.pick(client)
+			if m != sp.pick(client) {
+				t.Fatalf("weight %g: %s got both variants", weight, client)
+			}
+			if m != sp.baseline && m != sp.candidate {
+				t.Fatalf("weight %g: %s got a model outside the split", weight, client)
+			}
+			got := m == sp.candidate
+			// a higher weight only moves clients to the candidate
+			if previous[i] && !got {
+				t.Fatalf("weight %g: %s went back to the baseline", weight, client)
+			}
+			previous[i] = got
+			if got {
+				share++
+			}
+		}
+		percent := float64(share) / clients * 100
+		if percent < weight-1 || percent > weight+1 {
+			t.Errorf("weight %g: %.2f%% of the clients got the candidate", weight, percent)
+		}
+	}
+
+	// requests without a client follow the weight too
+	sp := newSplit(baseline, candidate, 30)
+	share := 0
+	for i := 0; i < clients; i++ {
+		if sp.pick("") == sp.candidate {
+			share++
+		}
+	}
+	if percent := float64(share) / clients * 100; percent < 28 || percent > 32 {
+		t.Errorf("weight 30: %.2f%% of the anonymous requests got the candidate", percent)
+	}
+}
+
+func TestSplitRecord(t *testing.T) {
+	baseline, candidate := splitModels()
+	sp := newSplit(baseline, candidate, 50)
+	sp.record(VariantCandidate, 10*time.Millisecond, []answer{{"3", 95}, {"5", 100}})
+	sp.record(VariantCandidate, 30*time.Millisecond, []answer{{"7", 41.5}})
+	sp.record(VariantBaseline, 5*time.Millisecond, nil)
+
+	got := sp.snapshot()
+	if len(got.Variants) != 2 {
+		t.Fatalf("got %d variants, want 2", len(got.Variants))
+	}
+	base, cand := got.Variants[0], got.Variants[1]
+	if base.Variant != VariantBaseline || base.Model != sp.baseline.id() ||
+		cand.Variant != VariantCandidate || cand.Model != sp.candidate.id() {
+		t.Fatalf("variants %s %s and %s %s, want the baseline then the candidate",
+			base.Variant, base.Model, cand.Variant, cand.Model)
+	}
+	if base.Requests != 1 || base.Predictions != 0 || base.MeanLatency != "5ms" || base.MeanConfidence != 0 {
+		t.Errorf("baseline: %+v", base)
+	}
+	if cand.Requests != 2 || cand.Predictions != 3 || cand.MeanLatency != "20ms" || cand.MaxLatency != "30ms" {
+		t.Errorf("candidate: %+v", cand)
+	}
+	// (95 + 100 + 41.5) / 3, truncated to two decimals
+	if cand.MeanConfidence != 78.83 {
+		t.Errorf("candidate mean confidence %g, want 78.83", cand.MeanConfidence)
+	}
+	// 100% falls in the last bucket with the 90s
+	if want := [10]int{4: 1, 9: 2}; cand.Confidence != want {
+		t.Errorf("candidate confidence buckets %v, want %v", cand.Confidence, want)
+	}
+	if cand.Accuracy != nil {
+		t.Errorf("candidate accuracy %v without feedback", *cand.Accuracy)
+	}
+}
+
+// the bundled weights were trained on CSV records read one pixel off, and
+// regenerated for the pixels after the label: they must still read the
+// sample digits
+func TestBundledWeightsReadSampleDigits(t *testing.T) {
+	net, err := network.OpenNetwork("../data", 0.1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for digit := 0; digit < 10; digit++ {
+		data, err := os.ReadFile(fmt.Sprintf("../nums/%d.png", digit))
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, _, err := utils.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		output := net.Predict(InputData(PreprocessMNIST, net, img, images.DefaultMNISTOptions))
+		if got, _, _ := columnResults(output, 0); got != digit {
+			t.Errorf("%d.png read as %d", digit, got)
+		}
+	}
+}
+
+func TestSplitFeedbackNeedsKnownLabels(t *testing.T) {
+	s := newTestServer()
+	baseline, candidate := splitModels()
+	s.served.set(baseline)
+	sp, err := s.startSplit(baseline, candidate, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := s.router()
+	for _, tc := range []struct {
+		name            string
+		label, expected string
+		status          int
+	}{
+		{"correct", "7", "7", http.StatusOK},
+		{"wrong", "1", "7", http.StatusOK},
+		{"unknown label", "seven", "seven", http.StatusBadRequest},
+		{"unknown expected label", "7", "70", http.StatusBadRequest},
+	} {
+		body, _ := json.Marshal(models.FeedbackRequest{Model: sp.candidate.id(), Label: tc.label, Expected: tc.expected})
+		req := httptest.NewRequest(http.MethodPost, "/models/mnist/feedback", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tc.status {
+			t.Errorf("%s: status %d, want %d: %s", tc.name, rec.Code, tc.status, rec.Body.String())
+		}
+	}
+	// only the feedback with labels of the model counts
+	cand := sp.snapshot().Variants[1]
+	if cand.Feedback != 2 || cand.Correct != 1 {
+		t.Errorf("candidate got %d feedback, %d correct, want 2 and 1", cand.Feedback, cand.Correct)
+	}
+}
+
+func TestPromoteSplitOnlyPromotesTheRunningSplit(t *testing.T) {
+	s := newTestServer()
+	var err error
+	if s.registry, err = registry.New(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	versions := make([]*models.ModelVersion, 3)
+	for i := range versions {
+		v, err := s.registry.Create(models.ModelVersion{Name: DatasetMNIST, Dataset: DatasetMNIST}, network.NewNetwork(784, 20, 10, 0.1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		versions[i] = v
+	}
+	if err := s.activate(versions[0], network.NewNetwork(784, 20, 10, 0.1)); err != nil {
+		t.Fatal(err)
+	}
+	start := func(v *models.ModelVersion) *split {
+		t.Helper()
+		sp, err := s.startSplit(s.model(), newServedModel(network.NewNetwork(784, 20, 10, 0.1), v), 50)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sp
+	}
+	served := func(want int) {
+		t.Helper()
+		if m := s.model(); m.version == nil || m.version.Version != want {
+			t.Errorf("served %s, want version %d", m.id(), want)
+		}
+		if m, err := s.registry.Get(DatasetMNIST); err != nil || m.ActiveVersion != want {
+			t.Errorf("active version %v, %v, want %d", m, err, want)
+		}
+	}
+
+	// a split replaced by another one is not promoted
+	replaced := start(versions[1])
+	running := start(versions[2])
+	if err := s.promoteSplit(replaced); !errors.Is(err, errModelChanged) {
+		t.Fatalf("promoting a replaced split: got %v, want %v", err, errModelChanged)
+	}
+	served(versions[0].Version)
+
+	// nor is a split ended by an activation
+	if err := s.activate(versions[0], s.model().net); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.promoteSplit(running); !errors.Is(err, errModelChanged) {
+		t.Fatalf("promoting an ended split: got %v, want %v", err, errModelChanged)
+	}
+	served(versions[0].Version)
+
+	// the running split is, and it ends
+	running = start(versions[2])
+	req := httptest.NewRequest(http.MethodPost, "/models/mnist/split/promote", nil)
+	req.Header.Set(APIKeyHeader, testAdminKey)
+	rec := httptest.NewRecorder()
+	s.router().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("promote: status %d: %s", rec.Code, rec.Body.String())
+	}
+	served(versions[2].Version)
+	if s.served.split(DatasetMNIST) != nil {
+		t.Error("the split still runs after its candidate was promoted")
+	}
+	if err := s.promoteSplit(running); !errors.Is(err, errModelChanged) {
+		t.Errorf("promoting twice: got %v, want %v", err, errModelChanged)
+	}
+}
+
+func TestDeleteVersionInUseConflicts(t *testing.T) {
+	s := newTestServer()
+	var err error
+	if s.registry, err = registry.New(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		if _, err := s.registry.Create(models.ModelVersion{Name: DatasetMNIST, Dataset: DatasetMNIST}, network.NewNetwork(784, 20, 10, 0.1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	handler := s.router()
+	send := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		var data []byte
+		if body != nil {
+			data, _ = json.Marshal(body)
+		}
+		req := httptest.NewRequest(method, path, bytes.NewReader(data))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(APIKeyHeader, testAdminKey)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	// version 1 is served, 2 gets a share of the traffic and 3 shadows 1
+	for _, setup := range []struct {
+		method, path string
+		body         interface{}
+	}{
+		{http.MethodPost, "/models/mnist/versions/1/activate", nil},
+		{http.MethodPut, "/models/mnist/split", models.SplitRequest{Version: 2, Weight: 50}},
+		{http.MethodPut, "/models/mnist/shadow", models.ShadowRequest{Version: 3}},
+	} {
+		if rec := send(setup.method, setup.path, setup.body); rec.Code != http.StatusOK {
+			t.Fatalf("%s %s: status %d: %s", setup.method, setup.path, rec.Code, rec.Body.String())
+		}
+	}
+	for version, status := range map[int]int{
+		1: http.StatusConflict,
+		2: http.StatusConflict,
+		3: http.StatusConflict,
+		4: http.StatusOK,
+	} {
+		rec := send(http.MethodDelete, fmt.Sprintf("/models/mnist/versions/%d", version), nil)
+		if rec.Code != status {
+			t.Errorf("deleting v%d: status %d, want %d: %s", version, rec.Code, status, rec.Body.String())
+		}
+	}
+	for version := 1; version <= 3; version++ {
+		if _, err := s.registry.Version(DatasetMNIST, version); err != nil {
+			t.Errorf("v%d in use was deleted: %v", version, err)
+		}
+	}
+
+	// once the split and the shadow end, their versions can go
+	send(http.MethodDelete, "/models/mnist/split", nil)
+	send(http.MethodDelete, "/models/mnist/shadow", nil)
+	for _, version := range []int{2, 3} {
+		if rec := send(http.MethodDelete, fmt.Sprintf("/models/mnist/versions/%d", version), nil); rec.Code != http.StatusOK {
+			t.Errorf("deleting v%d after its use: status %d: %s", version, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+// startTraining starts a training job through the API
+func startTraining(t *testing.T, s *Server, body string) *job {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/train", strings.NewReader(body))
+	req.Header.Set(APIKeyHeader, testAdminKey)
+	rec := httptest.NewRecorder()
+	s.router().ServeHTTP(rec, req)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("train: status %d: %s", rec.Code, rec.Body.String())
+	}
+	var train models.TrainResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &train); err != nil {
+		t.Fatal(err)
+	}
+	j, err := s.jobs.get(train.JobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return j
+}
+
+func TestCancelTraining(t *testing.T) {
+	s := newTestServer()
+	var err error
+	if s.registry, err = registry.New(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	mnistDatasets(t, 1000, 20)
+	served := s.model()
+	before := served.net.Clone()
+
+	// far more epochs than the test waits for
+	j := startTraining(t, s, `{"epochs": 100}`)
+	events, stop := j.subscribe()
+	defer stop()
+	for event := range events {
+		if event.Type == EventStatus && event.Job.Status == JobRunning {
+			break
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodDelete, "/train/jobs/"+j.snapshot().ID, nil)
+	req.Header.Set(APIKeyHeader, testAdminKey)
+	rec := httptest.NewRecorder()
+	s.router().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("cancel: status %d: %s", rec.Code, rec.Body.String())
+	}
+	select {
+	case <-j.done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the cancelled job did not stop")
+	}
+	state := j.snapshot()
+	if state.Status != JobCancelled || state.FinishedAt == nil {
+		t.Fatalf("the job is %s, want %s", state.Status, JobCancelled)
+	}
+	if len(state.History) == 100 {
+		t.Error("the job ran every epoch")
+	}
+
+	// nothing was saved nor activated, and the served network is untouched
+	if m := s.model(); m != served {
+		t.Errorf("serving %s after a cancelled training", m.id())
+	}
+	if list, err := s.registry.List(); err != nil || len(list) != 0 {
+		t.Errorf("the registry holds %v, %v after a cancelled training", list, err)
+	}
+	if !mat.Equal(served.net.HiddenWeights, before.HiddenWeights) || !mat.Equal(served.net.OutputWeights, before.OutputWeights) {
+		t.Error("the cancelled training modified the served network")
+	}
+
+	// cancelling it again conflicts
+	rec = httptest.NewRecorder()
+	s.router().ServeHTTP(rec, req)
+	if rec.Code != http.StatusConflict {
+		t.Errorf("cancelling twice: status %d", rec.Code)
+	}
+}
+
+func TestJobEventStream(t *testing.T) {
+	s := newTestServer()
+	var err error
+	if s.registry, err = registry.New(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	// enough samples for a progress event before each epoch ends
+	mnistDatasets(t, 1000, 10)
+
+	j := startTraining(t, s, `{"epochs": 2}`)
+	id := j.snapshot().ID
+	req := httptest.NewRequest(http.MethodGet, "/train/jobs/"+id+"/events", nil)
+	req.Header.Set(APIKeyHeader, testAdminKey)
+	rec := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.router().ServeHTTP(rec, req)
+	}()
+	// the handler returns, closing the stream, once the job is over
+	select {
+	case <-done:
+	case <-time.After(time.Minute):
+		t.Fatal("the stream did not close")
+	}
+	if !j.finished() {
+		t.Error("the stream closed before the job finished")
+	}
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("content type %q", ct)
+	}
+
+	// every event is an event line and a data line, ended by a blank line
+	var events []models.JobEvent
+	var name string
+	var event *models.JobEvent
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, ":"):
+		case strings.HasPrefix(line, "event: "):
+			if name != "" {
+				t.Fatalf("event %q has no data", name)
+			}
+			name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			if name == "" || event != nil {
+				t.Fatalf("unexpected data line %q", line)
+			}
+			event = &models.JobEvent{}
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), event); err != nil {
+				t.Fatalf("data %q: %v", line, err)
+			}
+		case line == "":
+			if event == nil {
+				t.Fatalf("event %q has no data", name)
+			}
+			if event.Type != name || event.JobID != id {
+				t.Errorf("event %q carries %s of job %s", name, event.Type, event.JobID)
+			}
+			events = append(events, *event)
+			name, event = "", nil
+		default:
+			t.Fatalf("unexpected line %q", line)
+		}
+	}
+	if name != "" || event != nil {
+		t.Errorf("the stream ended inside event %q", name)
+	}
+
+	if len(events) == 0 || events[0].Type != EventStatus || events[0].Job == nil {
+		t.Fatalf("the stream does not start with the job status: %+v", events)
+	}
+	counts := map[string]int{}
+	for _, event := range events {
+		counts[event.Type]++
+		if event.Type == EventProgress && event.Progress == nil {
+			t.Error("a progress event without progress")
+		}
+	}
+	if counts[EventProgress] == 0 {
+		t.Errorf("no progress events: %v", counts)
+	}
+	if counts[EventEpoch] != 2 {
+		t.Errorf("%d epoch events, want 2", counts[EventEpoch])
+	}
+	last := events[len(events)-1]
+	if last.Type != EventStatus || last.Job == nil || last.Job.Status != JobSucceeded {
+		t.Errorf("the stream does not end with the final status: %+v", last)
+	}
+}
+
+// pixelsBody is a /predict/pixels request with n pixels: a bar down
+// the middle of a square image, or every pixel set to value
+func pixelsBody(n int, value float64) string {
+	pixels := make([]string, n)
+	side := squareSide(n)
+	for i := range pixels {
+		switch {
+		case value != 0:
+			pixels[i] = fmt.Sprint(value)
+		case side > 0 && i%side >= side/2-2 && i%side < side/2+2:
+			pixels[i] = "1"
+		default:
+			pixels[i] = "0"
+		}
+	}
+	return `{"pixels": [` + strings.Join(pixels, ",") + `]}`
+}
+
+func TestPredictPixels(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		code   string
+	}{
+		{"digit", pixelsBody(784, 0), http.StatusOK, ""},
+		{"byte scale", strings.Replace(pixelsBody(784, 0), "1", "255", -1), http.StatusOK, ""},
+		{"too few pixels", pixelsBody(783, 0), http.StatusBadRequest, models.CodeBadRequest},
+		{"too many pixels", pixelsBody(785, 0), http.StatusBadRequest, models.CodeBadRequest},
+		{"negative", pixelsBody(784, -0.5), http.StatusBadRequest, models.CodeBadRequest},
+		{"above a byte", pixelsBody(784, 256), http.StatusBadRequest, models.CodeBadRequest},
+		{"above one", `{"scale": "unit", "pixels": [2]}`, http.StatusBadRequest, models.CodeBadRequest},
+		{"unknown scale", `{"scale": "percent", "pixels": [0]}`, http.StatusBadRequest, models.CodeBadRequest},
+		{"no pixels", `{}`, http.StatusBadRequest, models.CodeBadRequest},
+		{"unknown field", `{"pixel": [0]}`, http.StatusBadRequest, models.CodeBadRequest},
+		{"not json", `pixels`, http.StatusBadRequest, models.CodeInvalidJSON},
+		{"too large", `{"data": "` + strings.Repeat("A", maxJSONSize) + `"}`, http.StatusRequestEntityTooLarge, models.CodeTooLarge},
+	}
+	s := newTestServer()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			s.router().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/predict/pixels", strings.NewReader(tt.body)))
+			if rec.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.status, rec.Body.String())
+			}
+			if tt.status != http.StatusOK {
+				var resp models.ErrorResponse
+				if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+					t.Fatal(err)
+				}
+				if resp.Code != tt.code {
+					t.Errorf("code %q, want %q", resp.Code, tt.code)
+				}
+				return
+			}
+			var resp models.PredictResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Label == "" || len(resp.Results) != 10 || resp.Model == "" {
+				t.Errorf("unexpected prediction: %+v", resp)
+			}
+		})
+	}
+}
+
+// predictDigit posts one of the sample digits to /predict
+func predictDigit(t *testing.T, s *Server, digit int) *models.PredictResponse {
+	t.Helper()
+	data, err := os.ReadFile(fmt.Sprintf("../nums/%d.png", digit))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, contentType := multipartBody(data, map[string]string{"invert": "auto"})
+	req := httptest.NewRequest(http.MethodPost, "/predict", body)
+	req.Header.Set("Content-Type", contentType)
+	rec := httptest.NewRecorder()
+	s.router().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("predict: status %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp models.PredictResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return &resp
+}
+
+// shadowSummary reads the shadow of the mnist model through the API
+func shadowSummary(t *testing.T, s *Server) *models.Shadow {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	s.router().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/models/mnist/shadow", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("shadow: status %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp models.ShadowResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp.Shadow
+}
+
+func TestShadowDoesNotChangeResponses(t *testing.T) {
+	s := newTestServer()
+	primary, candidate := splitModels()
+	s.served.set(primary)
+
+	// what the primary answers on its own
+	data, err := os.ReadFile("../nums/3.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, _, err := utils.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := images.DefaultMNISTOptions
+	opts.InkIsDark = images.DetectPolarity(img) == images.DarkInk
+	label, results, _ := s.Predict(primary, img, opts)
+
+	// the candidate answers another label for everything
+	other := (label + 1) % 10
+	for i := 0; i < candidate.net.Outputs; i++ {
+		for j := 0; j < candidate.net.Hiddens; j++ {
+			if i == other {
+				candidate.net.OutputWeights.Set(i, j, 1)
+			} else {
+				candidate.net.OutputWeights.Set(i, j, -1)
+			}
+		}
+	}
+	s.served.setShadow(newShadow(DatasetMNIST, candidate))
+
+	resp := predictDigit(t, s, 3)
+	if resp.Prediction != label || !reflect.DeepEqual(resp.Results, makeResultsMap(results)) || resp.Model != primary.id() {
+		t.Errorf("the shadow changed the response: %+v", resp)
+	}
+
+	// the comparison runs after the response
+	deadline := time.Now().Add(5 * time.Second)
+	summary := shadowSummary(t, s)
+	for summary.Compared == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		summary = shadowSummary(t, s)
+	}
+	if summary.Compared != 1 || summary.Agreed != 0 || summary.Dropped != 0 {
+		t.Fatalf("compared %d, agreed %d, dropped %d", summary.Compared, summary.Agreed, summary.Dropped)
+	}
+	if len(summary.Disagreements) != 1 {
+		t.Fatalf("%d disagreements, want 1", len(summary.Disagreements))
+	}
+	d := summary.Disagreements[0]
+	if d.Label != resp.Label || d.CandidateLabel != candidate.label(other) || d.Model != primary.id() {
+		t.Errorf("unexpected disagreement: %+v", d)
+	}
+}
+
+func TestShadowDropsWhenBusy(t *testing.T) {
+	s := newTestServer()
+	primary, candidate := splitModels()
+	s.served.set(primary)
+	sh := newShadow(DatasetMNIST, candidate)
+	s.served.setShadow(sh)
+
+	// every worker is busy
+	for i := 0; i < shadowWorkers; i++ {
+		sh.slots <- struct{}{}
+	}
+	first := predictDigit(t, s, 7)
+	second := predictDigit(t, s, 1)
+	summary := shadowSummary(t, s)
+	if summary.Dropped != 2 || summary.Compared != 0 {
+		t.Errorf("dropped %d, compared %d with every worker busy", summary.Dropped, summary.Compared)
+	}
+	if first.Model != primary.id() || second.Model != primary.id() {
+		t.Errorf("answered by %s and %s", first.Model, second.Model)
+	}
+
+	// once a worker is free predictions are shadowed again
+	<-sh.slots
+	predictDigit(t, s, 4)
+	deadline := time.Now().Add(5 * time.Second)
+	for summary.Compared == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		summary = shadowSummary(t, s)
+	}
+	if summary.Dropped != 2 || summary.Compared != 1 {
+		t.Errorf("dropped %d, compared %d with a worker free", summary.Dropped, summary.Compared)
+	}
+}
+
+// downCache is a cache that cannot be reached
+type downCache struct{}
+
+var errCacheDown = errors.New("connection refused")
+
+func (downCache) Get(string) (string, error) { return "", errCacheDown }
+func (downCache) Put(string, string) error   { return errCacheDown }
+func (downCache) Delete(string) error        { return errCacheDown }
+func (downCache) Ping() error                { return errCacheDown }
+
+func TestReadiness(t *testing.T) {
+	trained := func(s *Server) {
+		m, _ := splitModels()
+		s.served.set(m)
+	}
+	tests := []struct {
+		name   string
+		setup  func(s *Server)
+		status int
+		failed []string
+	}{
+		{"ready", trained, http.StatusOK, nil},
+		{"random weights", func(s *Server) {}, http.StatusServiceUnavailable, []string{"model"}},
+		{"no model loaded", func(s *Server) { s.served = newModelSet() }, http.StatusServiceUnavailable, []string{"model"}},
+		{"cache down", func(s *Server) {
+			trained(s)
+			cache.SetCacheRepository(downCache{})
+		}, http.StatusServiceUnavailable, []string{"cache"}},
+		{"no model and cache down", func(s *Server) {
+			s.served = newModelSet()
+			cache.SetCacheRepository(downCache{})
+		}, http.StatusServiceUnavailable, []string{"model", "cache"}},
+	}
+	defer cache.SetCacheRepository(cache.NewInMemoryCacheRepository())
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer()
+			tt.setup(s)
+			rec := httptest.NewRecorder()
+			s.router().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			if rec.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.status, rec.Body.String())
+			}
+			var resp models.HealthResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			var failed []string
+			for _, c := range resp.Checks {
+				if !c.OK {
+					failed = append(failed, c.Name)
+				}
+			}
+			if !reflect.DeepEqual(failed, tt.failed) {
+				t.Errorf("failed checks %v, want %v", failed, tt.failed)
+			}
+			if ready := tt.status == http.StatusOK; resp.Success != ready || (resp.Status == "ready") != ready {
+				t.Errorf("status %q, success %v", resp.Status, resp.Success)
+			}
+
+			// the process is alive either way
+			rec = httptest.NewRecorder()
+			s.router().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+			if rec.Code != http.StatusOK {
+				t.Errorf("healthz: status %d", rec.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,438 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"neural-network/models"
+	"neural-network/network"
+	"neural-network/registry"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/fehernandez12/sonate"
+	"github.com/sirupsen/logrus"
+)
+
+// how a model turns an image into its inputs
+const (
+	// PreprocessMNIST centers a light-on-dark 28 x 28 digit, as MNIST does
+	PreprocessMNIST = "mnist"
+	// PreprocessRGB scales the image to a square and keeps
+	// its color planes, as CIFAR-10 does
+	PreprocessRGB = "rgb"
+)
+
+var (
+	errModelNotServed = errors.New("model not served")
+	errNotTrainable   = errors.New("the server cannot train this model")
+)
+
+// servedModel is a network answering predictions, with the registry
+// version it was loaded from and how it reads its inputs. Activating a
+// version swaps the whole value, so a request keeps the model it started
+// with. Models answering for a traffic split know the split and
+// which side of it they are.
+type servedModel struct {
+	name       string
+	net        *network.Network
+	version    *models.ModelVersion
+	dataset    string
+	preprocess string
+	labels     []string
+	split      *split
+	variant    string
+}
+
+// newServedModel serves a registry version. Versions stored before models
+// had their own preprocessing and labels get the ones of their dataset.
+func newServedModel(net *network.Network, v *models.ModelVersion) *servedModel {
+	m := &servedModel{
+		name:       v.Name,
+		net:        net,
+		version:    v,
+		dataset:    v.Dataset,
+		preprocess: v.Preprocess,
+		labels:     v.Labels,
+	}
+	if m.preprocess == "" {
+		m.preprocess = DefaultPreprocess(m.dataset, net)
+	}
+	if len(m.labels) == 0 {
+		m.labels = DefaultLabels(m.dataset, net)
+	}
+	return m
+}
+
+// untrainedModel serves a network that is not in the registry yet
+func untrainedModel(name, dataset string, net *network.Network) *servedModel {
+	return &servedModel{
+		name:       name,
+		net:        net,
+		dataset:    dataset,
+		preprocess: DefaultPreprocess(dataset, net),
+		labels:     DefaultLabels(dataset, net),
+	}
+}
+
+// cacheNamespace keeps the cached predictions of different models apart
+func (m *servedModel) cacheNamespace() string {
+	if m.version == nil {
+		return m.name + "@untrained:"
+	}
+	return fmt.Sprintf("%s@v%d:", m.name, m.version.Version)
+}
+
+// id names the model and its version in responses
+func (m *servedModel) id() string {
+	return m.cacheNamespace()[:len(m.cacheNamespace())-1]
+}
+
+func (m *servedModel) label(class int) string {
+	if class < len(m.labels) {
+		return m.labels[class]
+	}
+	return strconv.Itoa(class)
+}
+
+func (m *servedModel) hasLabel(label string) bool {
+	for _, l := range m.labels {
+		if l == label {
+			return true
+		}
+	}
+	return false
+}
+
+// modelSet holds the models the server answers with, and the traffic
+// splits and shadow models running next to them, by name
+type modelSet struct {
+	mu      sync.RWMutex
+	models  map[string]*servedModel
+	splits  map[string]*split
+	shadows map[string]*shadow
+}
+
+func newModelSet() *modelSet {
+	return &modelSet{
+		models:  make(map[string]*servedModel),
+		splits:  make(map[string]*split),
+		shadows: make(map[string]*shadow),
+	}
+}
+
+func (ms *modelSet) get(name string) (*servedModel, bool) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	m, ok := ms.models[name]
+	return m, ok
+}
+
+// set serves a model, ending the split of the version it replaces,
+// and its shadow when the shadow is the version now served
+func (ms *modelSet) set(m *servedModel) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.serve(m)
+}
+
+// replace serves a model instead of old, unless old is not the served
+// model anymore. commit runs first under the lock, and the model is only
+// served when it succeeds.
+func (ms *modelSet) replace(old, m *servedModel, commit func() error) (bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.models[m.name] != old {
+		return false, nil
+	}
+	if err := commit(); err != nil {
+		return false, err
+	}
+	ms.serve(m)
+	return true, nil
+}
+
+// serve must be called with ms.mu held
+func (ms *modelSet) serve(m *servedModel) {
+	ms.models[m.name] = m
+	if sp, ok := ms.splits[m.name]; ok {
+		delete(ms.splits, m.name)
+		logrus.WithField("model", m.name).Infof("traffic split with %s ended", sp.candidate.id())
+	}
+	if sh, ok := ms.shadows[m.name]; ok && sh.candidate.id() == m.id() {
+		delete(ms.shadows, m.name)
+		logrus.WithField("model", m.name).Infof("stopped shadowing with %s", sh.candidate.id())
+	}
+}
+
+func (ms *modelSet) split(name string) *split {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	return ms.splits[name]
+}
+
+// setSplit starts a split, unless its baseline
+// is not the served model anymore
+func (ms *modelSet) setSplit(sp *split, baseline *servedModel) bool {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.models[sp.name] != baseline {
+		return false
+	}
+	ms.splits[sp.name] = sp
+	return true
+}
+
+// promote serves m, the candidate of a split, unless sp is not the split
+// running anymore: a version activated meanwhile ends it, and another
+// split replaces it. commit runs first under the lock, and the model is
+// only served when it succeeds.
+func (ms *modelSet) promote(sp *split, m *servedModel, commit func() error) (bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.splits[sp.name] != sp {
+		return false, nil
+	}
+	if err := commit(); err != nil {
+		return false, err
+	}
+	ms.serve(m)
+	return true, nil
+}
+
+func (ms *modelSet) endSplit(name string) *split {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	sp := ms.splits[name]
+	delete(ms.splits, name)
+	return sp
+}
+
+func (ms *modelSet) shadow(name string) *shadow {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	return ms.shadows[name]
+}
+
+func (ms *modelSet) setShadow(sh *shadow) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.shadows[sh.name] = sh
+}
+
+func (ms *modelSet) endShadow(name string) *shadow {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	sh := ms.shadows[name]
+	delete(ms.shadows, name)
+	return sh
+}
+
+// unlessServing runs fn under the lock, unless a version of the model is
+// served, in a split or in a shadow, so none of them can start meanwhile
+func (ms *modelSet) unlessServing(name string, version int, fn func() error) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	type use struct {
+		m    *servedModel
+		role string
+	}
+	uses := []use{{ms.models[name], "served"}}
+	if sp, ok := ms.splits[name]; ok {
+		uses = append(uses, use{sp.candidate, "the candidate of a traffic split"})
+	}
+	if sh, ok := ms.shadows[name]; ok {
+		uses = append(uses, use{sh.candidate, "the candidate of a shadow"})
+	}
+	for _, u := range uses {
+		if u.m != nil && u.m.version != nil && u.m.version.Version == version {
+			return fmt.Errorf("%w: %s v%d is %s", errVersionInUse, name, version, u.role)
+		}
+	}
+	return fn()
+}
+
+// list returns the served models ordered by name
+func (ms *modelSet) list() []*servedModel {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	list := make([]*servedModel, 0, len(ms.models))
+	for _, m := range ms.models {
+		list = append(list, m)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].name < list[j].name
+	})
+	return list
+}
+
+// model returns the default model, the one of the routes without a name
+func (s *Server) model() *servedModel {
+	m, _ := s.served.get(s.config.Network.Model)
+	return m
+}
+
+// routeModel returns the model named by the route, or the default one
+// for the routes that do not name a model. It ignores traffic splits,
+// see pickModel.
+func (s *Server) routeModel(r *http.Request) (*servedModel, error) {
+	name, ok := sonate.Vars(r)["name"]
+	if !ok {
+		return s.model(), nil
+	}
+	m, ok := s.served.get(name)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", errModelNotServed, name)
+	}
+	return m, nil
+}
+
+// loadModels serves the active version of every model in the registry.
+// The default model is always served: on the first start with a registry,
+// the weights saved in the data directory before there was one become its
+// first version, and without them it starts untrained.
+func (s *Server) loadModels() error {
+	name, dataset, dir := s.config.Network.Model, s.config.Network.Dataset, s.config.Network.DataDir
+	if _, err := s.registry.Active(name); errors.Is(err, registry.ErrNotFound) {
+		net := s.newNetwork(dataset)
+		if err := net.LoadFrom(dir); err != nil {
+			logrus.Warnf("model %s has no active version, serving an untrained network: %v", name, err)
+			s.served.set(untrainedModel(name, dataset, net))
+		} else {
+			m := untrainedModel(name, dataset, net)
+			v, err := s.registry.Create(models.ModelVersion{
+				Name:        name,
+				Dataset:     m.dataset,
+				Preprocess:  m.preprocess,
+				Labels:      m.labels,
+				Description: "imported from " + dir,
+			}, net)
+			if err != nil {
+				return err
+			}
+			if err := s.activate(v, net); err != nil {
+				return err
+			}
+		}
+	}
+	list, err := s.registry.List()
+	if err != nil {
+		return err
+	}
+	for _, entry := range list {
+		if entry.ActiveVersion == 0 {
+			continue
+		}
+		if m, ok := s.served.get(entry.Name); ok && m.version != nil && m.version.Version == entry.ActiveVersion {
+			continue
+		}
+		net, v, err := s.registry.Load(entry.Name, entry.ActiveVersion)
+		if err == nil {
+			err = checkModel(v, net)
+		}
+		if err != nil {
+			// a broken model must not keep the others from being served
+			if entry.Name == name {
+				return err
+			}
+			logrus.WithField("model", entry.Name).Errorf("cannot serve version %d: %v", entry.ActiveVersion, err)
+			continue
+		}
+		s.served.set(newServedModel(net, v))
+		logrus.WithField("model", entry.Name).Infof("serving version %d", v.Version)
+	}
+	return nil
+}
+
+// activate makes a version active in the registry and swaps it in.
+// Served models are never modified once published, so the network
+// must not be trained any further and the version is copied.
+func (s *Server) activate(v *models.ModelVersion, net *network.Network) error {
+	if err := s.registry.Activate(v.Name, v.Version); err != nil {
+		return err
+	}
+	active := *v
+	active.Active = true
+	s.served.set(newServedModel(net, &active))
+	logrus.WithField("model", v.Name).Infof("serving version %d", v.Version)
+	return nil
+}
+
+// activateOver activates a version like activate, unless the served
+// model is not old anymore, as when another version was activated while
+// this one was trained from old
+func (s *Server) activateOver(old *servedModel, v *models.ModelVersion, net *network.Network) error {
+	active := *v
+	active.Active = true
+	ok, err := s.served.replace(old, newServedModel(net, &active), func() error {
+		return s.registry.Activate(v.Name, v.Version)
+	})
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errModelChanged
+	}
+	logrus.WithField("model", v.Name).Infof("serving version %d", v.Version)
+	return nil
+}
+
+// checkModel makes sure the server can prepare the inputs of a version
+// and name its outputs
+func checkModel(v *models.ModelVersion, net *network.Network) error {
+	m := newServedModel(net, v)
+	switch m.preprocess {
+	case PreprocessMNIST:
+		if net.Inputs != network.MnistInputs {
+			return fmt.Errorf("%s preprocessing makes %d inputs, the model has %d", m.preprocess, network.MnistInputs, net.Inputs)
+		}
+	case PreprocessRGB:
+		if net.Inputs%network.CifarChannels != 0 || squareSide(net.Inputs/network.CifarChannels) == 0 {
+			return fmt.Errorf("%s preprocessing needs a square RGB image, the model has %d inputs", m.preprocess, net.Inputs)
+		}
+	default:
+		return fmt.Errorf("unknown preprocessing: %s", m.preprocess)
+	}
+	if len(m.labels) != net.Outputs {
+		return fmt.Errorf("the model has %d outputs and %d labels", net.Outputs, len(m.labels))
+	}
+	switch m.dataset {
+	case DatasetMNIST:
+		if net.Inputs != network.MnistInputs {
+			return fmt.Errorf("a %s model needs %d inputs, this one has %d", m.dataset, network.MnistInputs, net.Inputs)
+		}
+	case DatasetCIFAR10:
+		if net.Inputs != network.CifarInputs {
+			return fmt.Errorf("a %s model needs %d inputs, this one has %d", m.dataset, network.CifarInputs, net.Inputs)
+		}
+	}
+	return nil
+}
+
+// trainable reports whether the server has training data for the dataset
+func trainable(dataset string) bool {
+	return dataset == DatasetMNIST || dataset == DatasetCIFAR10
+}
+
+// DefaultPreprocess is the preprocessing of a model that does not say,
+// from its dataset or else the inputs of its network
+func DefaultPreprocess(dataset string, net *network.Network) string {
+	if dataset == DatasetCIFAR10 || (dataset != DatasetMNIST && net.Inputs != network.MnistInputs) {
+		return PreprocessRGB
+	}
+	return PreprocessMNIST
+}
+
+// DefaultLabels names the outputs of a model that does not,
+// the CIFAR-10 classes or the number of each output
+func DefaultLabels(dataset string, net *network.Network) []string {
+	if dataset == DatasetCIFAR10 {
+		return network.CifarLabels
+	}
+	labels := make([]string, net.Outputs)
+	for i := range labels {
+		labels[i] = strconv.Itoa(i)
+	}
+	return labels
+}
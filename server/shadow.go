@@ -0,0 +1,207 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"neural-network/models"
+	"sync"
+	"time"
+
+	"github.com/fehernandez12/sonate"
+	"github.com/sirupsen/logrus"
+)
+
+// shadowWorkers is how many predictions a shadow model runs at once.
+// Predictions arriving while they are all busy are not shadowed.
+const shadowWorkers = 4
+
+// how many disagreements a shadow keeps for its summary
+const maxDisagreements = 50
+
+var errNoShadow = errors.New("no shadow model is running for this model")
+
+// shadow runs the /predict requests of a model through a candidate
+// version too, without changing the responses, and compares the answers
+type shadow struct {
+	name      string
+	candidate *servedModel
+	started   time.Time
+	slots     chan struct{}
+
+	mu            sync.Mutex
+	compared      int
+	agreed        int
+	dropped       int
+	confusion     map[string]map[string]int
+	disagreements []models.ShadowDisagreement
+}
+
+func newShadow(name string, candidate *servedModel) *shadow {
+	return &shadow{
+		name:      name,
+		candidate: candidate,
+		started:   time.Now(),
+		slots:     make(chan struct{}, shadowWorkers),
+		confusion: make(map[string]map[string]int),
+	}
+}
+
+// shadowPredict runs a prediction through the shadow model of m,
+// if it has one, once the response is known
+func (s *Server) shadowPredict(m *servedModel, p *prediction, resp *models.PredictResponse) {
+	sh := s.served.shadow(m.name)
+	if sh == nil {
+		return
+	}
+	select {
+	case sh.slots <- struct{}{}:
+	default:
+		sh.mu.Lock()
+		sh.dropped++
+		sh.mu.Unlock()
+		return
+	}
+	go func() {
+		defer func() { <-sh.slots }()
+		prediction, results, _ := s.Predict(sh.candidate, p.image, p.opts)
+		sh.compare(p.checksum, resp, sh.candidate.label(prediction), makeResultsMap(results))
+	}()
+}
+
+// compare records the answer of the shadow to a prediction
+func (sh *shadow) compare(input string, resp *models.PredictResponse, label string, results map[string]float64) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	sh.compared++
+	if sh.confusion[resp.Label] == nil {
+		sh.confusion[resp.Label] = make(map[string]int)
+	}
+	sh.confusion[resp.Label][label]++
+	if label == resp.Label {
+		sh.agreed++
+		return
+	}
+	d := models.ShadowDisagreement{
+		Input:            input,
+		Time:             time.Now(),
+		Model:            resp.Model,
+		Label:            resp.Label,
+		Results:          resp.Results,
+		CandidateLabel:   label,
+		CandidateResults: results,
+	}
+	logrus.WithFields(logrus.Fields{
+		"model":             d.Model,
+		"candidate":         sh.candidate.id(),
+		"input":             d.Input,
+		"label":             d.Label,
+		"results":           d.Results,
+		"candidate_label":   d.CandidateLabel,
+		"candidate_results": d.CandidateResults,
+	}).Info("shadow model disagrees")
+	sh.disagreements = append(sh.disagreements, d)
+	if len(sh.disagreements) > maxDisagreements {
+		sh.disagreements = sh.disagreements[1:]
+	}
+}
+
+// summary reports the comparisons so far, latest disagreements first
+func (sh *shadow) summary() *models.Shadow {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	summary := &models.Shadow{
+		Name:          sh.name,
+		Candidate:     sh.candidate.id(),
+		StartedAt:     sh.started,
+		Compared:      sh.compared,
+		Agreed:        sh.agreed,
+		Dropped:       sh.dropped,
+		Confusion:     make(map[string]map[string]int, len(sh.confusion)),
+		Disagreements: make([]models.ShadowDisagreement, 0, len(sh.disagreements)),
+	}
+	if sh.compared > 0 {
+		rate := float64(sh.agreed) / float64(sh.compared) * 100
+		summary.AgreementRate = &rate
+	}
+	for label, row := range sh.confusion {
+		summary.Confusion[label] = make(map[string]int, len(row))
+		for candidate, n := range row {
+			summary.Confusion[label][candidate] = n
+		}
+	}
+	for i := len(sh.disagreements) - 1; i >= 0; i-- {
+		summary.Disagreements = append(summary.Disagreements, sh.disagreements[i])
+	}
+	return summary
+}
+
+func (s *Server) shadowRoute(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	sh := s.served.shadow(sonate.Vars(r)["name"])
+	if sh == nil {
+		s.handleError(w, r, http.StatusNotFound, errNoShadow)
+		return
+	}
+	resp := &models.ShadowResponse{Shadow: sh.summary()}
+	resp.Operation = "shadow"
+	resp.Success = true
+	resp.Time = time.Since(start).String()
+	s.sendResponse(w, r, http.StatusOK, resp, start)
+}
+
+// startShadowRoute shadows a model with another of its versions,
+// replacing the shadow already running
+func (s *Server) startShadowRoute(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	m, err := s.routeModel(r)
+	if err != nil {
+		s.handleError(w, r, http.StatusNotFound, err)
+		return
+	}
+	var req models.ShadowRequest
+	if !s.decodeJSON(w, r, &req) {
+		return
+	}
+	invalid := &validationError{}
+	invalid.check(m.version == nil || m.version.Version != req.Version, "version", "%d is already the active version", req.Version)
+	if err := invalid.err(); err != nil {
+		s.handleError(w, r, http.StatusUnprocessableEntity, err)
+		return
+	}
+	net, v, err := s.registry.Load(m.name, req.Version)
+	if err != nil {
+		s.handleError(w, r, registryStatus(err), err)
+		return
+	}
+	if err := checkModel(v, net); err != nil {
+		s.handleError(w, r, http.StatusConflict, err)
+		return
+	}
+	sh := newShadow(m.name, newServedModel(net, v))
+	s.served.setShadow(sh)
+	logrus.WithField("model", m.name).Infof("shadowing with %s", sh.candidate.id())
+	resp := &models.ShadowResponse{Shadow: sh.summary()}
+	resp.Operation = "shadow_start"
+	resp.Message = fmt.Sprintf("Shadowing %s with %s", m.name, sh.candidate.id())
+	resp.Success = true
+	resp.Time = time.Since(start).String()
+	s.sendResponse(w, r, http.StatusOK, resp, start)
+}
+
+// endShadowRoute stops the shadow model and returns its final summary
+func (s *Server) endShadowRoute(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	sh := s.served.endShadow(sonate.Vars(r)["name"])
+	if sh == nil {
+		s.handleError(w, r, http.StatusNotFound, errNoShadow)
+		return
+	}
+	logrus.WithField("model", sh.name).Infof("stopped shadowing with %s", sh.candidate.id())
+	resp := &models.ShadowResponse{Shadow: sh.summary()}
+	resp.Operation = "shadow_end"
+	resp.Message = fmt.Sprintf("Stopped shadowing %s", sh.name)
+	resp.Success = true
+	resp.Time = time.Since(start).String()
+	s.sendResponse(w, r, http.StatusOK, resp, start)
+}
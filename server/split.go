@@ -0,0 +1,384 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"neural-network/models"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fehernandez12/sonate"
+	"github.com/sirupsen/logrus"
+)
+
+// ClientHeader identifies a client, so a traffic split
+// keeps sending it to the same variant
+const ClientHeader = "X-Client-ID"
+
+// sides of a traffic split
+const (
+	VariantBaseline  = "baseline"
+	VariantCandidate = "candidate"
+)
+
+var (
+	errNoSplit      = errors.New("no traffic split is running for this model")
+	errModelChanged = errors.New("the active version changed, try again")
+)
+
+// split sends a share of the traffic of a model to a candidate version
+// and keeps track of how both versions answer
+type split struct {
+	name      string
+	weight    float64
+	started   time.Time
+	baseline  *servedModel
+	candidate *servedModel
+
+	mu    sync.Mutex
+	stats map[string]*variantStats
+}
+
+type variantStats struct {
+	requests    int
+	predictions int
+	latency     time.Duration
+	maxLatency  time.Duration
+	confidence  float64
+	buckets     [10]int
+	feedback    int
+	correct     int
+}
+
+// newSplit sends weight percent of the traffic to the candidate
+func newSplit(baseline, candidate *servedModel, weight float64) *split {
+	sp := &split{
+		name:    baseline.name,
+		weight:  weight,
+		started: time.Now(),
+		stats: map[string]*variantStats{
+			VariantBaseline:  {},
+			VariantCandidate: {},
+		},
+	}
+	sp.baseline = baseline.inSplit(sp, VariantBaseline)
+	sp.candidate = candidate.inSplit(sp, VariantCandidate)
+	return sp
+}
+
+// inSplit copies the model as one side of a split
+func (m *servedModel) inSplit(sp *split, variant string) *servedModel {
+	c := *m
+	c.split, c.variant = sp, variant
+	return &c
+}
+
+// pick chooses the variant of a request. A client is hashed to a fixed
+// bucket, so it always gets the same variant, and raising the weight
+// only moves clients from the baseline to the candidate. Requests
+// without a client are spread at random.
+func (sp *split) pick(client string) *servedModel {
+	var bucket uint64
+	if client == "" {
+		bucket = uint64(rand.Int63n(10000))
+	} else {
+		h := fnv.New64a()
+		h.Write([]byte(sp.name + ":" + client))
+		bucket = h.Sum64() % 10000
+	}
+	if float64(bucket) < sp.weight*100 {
+		return sp.candidate
+	}
+	return sp.baseline
+}
+
+// record adds a request answered by one of the variants
+func (sp *split) record(variant string, latency time.Duration, answers []answer) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	st := sp.stats[variant]
+	st.requests++
+	st.latency += latency
+	if latency > st.maxLatency {
+		st.maxLatency = latency
+	}
+	for _, a := range answers {
+		st.predictions++
+		st.confidence += a.confidence
+		bucket := int(a.confidence / 10)
+		if bucket > 9 {
+			bucket = 9
+		}
+		if bucket < 0 {
+			bucket = 0
+		}
+		st.buckets[bucket]++
+	}
+}
+
+// feedback records whether a prediction of the model with the given id
+// had the expected label, and returns the variant that made it. Both
+// labels must be ones the model can answer.
+func (sp *split) feedback(id, label, expected string) (*servedModel, bool, error) {
+	var m *servedModel
+	switch id {
+	case sp.baseline.id():
+		m = sp.baseline
+	case sp.candidate.id():
+		m = sp.candidate
+	default:
+		return nil, false, fmt.Errorf("%s is not part of the traffic split of %s", id, sp.name)
+	}
+	if err := checkLabels(m, label, expected); err != nil {
+		return nil, false, err
+	}
+	correct := label == expected
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	st := sp.stats[m.variant]
+	st.feedback++
+	if correct {
+		st.correct++
+	}
+	return m, correct, nil
+}
+
+// snapshot reports the split and the stats of both variants so far
+func (sp *split) snapshot() *models.Split {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	s := &models.Split{
+		Name:      sp.name,
+		Weight:    sp.weight,
+		Header:    ClientHeader,
+		StartedAt: sp.started,
+	}
+	for _, m := range []*servedModel{sp.baseline, sp.candidate} {
+		st := sp.stats[m.variant]
+		vs := models.VariantStats{
+			Variant:     m.variant,
+			Model:       m.id(),
+			Requests:    st.requests,
+			Predictions: st.predictions,
+			MaxLatency:  st.maxLatency.String(),
+			Confidence:  st.buckets,
+			Feedback:    st.feedback,
+			Correct:     st.correct,
+		}
+		vs.MeanLatency = time.Duration(0).String()
+		if st.requests > 0 {
+			vs.MeanLatency = (st.latency / time.Duration(st.requests)).String()
+		}
+		if st.predictions > 0 {
+			vs.MeanConfidence = float64(int(st.confidence/float64(st.predictions)*100)) / 100
+		}
+		if st.feedback > 0 {
+			accuracy := float64(st.correct) / float64(st.feedback) * 100
+			vs.Accuracy = &accuracy
+		}
+		s.Variants = append(s.Variants, vs)
+	}
+	return s
+}
+
+// startSplit splits the traffic of the baseline, which must still be
+// the active version of its model
+func (s *Server) startSplit(baseline, candidate *servedModel, weight float64) (*split, error) {
+	sp := newSplit(baseline, candidate, weight)
+	if !s.served.setSplit(sp, baseline) {
+		return nil, errModelChanged
+	}
+	logrus.WithField("model", sp.name).Infof("sending %g%% of the traffic to %s", weight, candidate.id())
+	return sp, nil
+}
+
+// promoteSplit activates the candidate of a split, which ends it, unless
+// the split was ended or replaced meanwhile
+func (s *Server) promoteSplit(sp *split) error {
+	v := *sp.candidate.version
+	v.Active = true
+	ok, err := s.served.promote(sp, newServedModel(sp.candidate.net, &v), func() error {
+		return s.registry.Activate(v.Name, v.Version)
+	})
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errModelChanged
+	}
+	logrus.WithField("model", v.Name).Infof("serving version %d", v.Version)
+	return nil
+}
+
+// pickModel returns the model that answers a prediction: the one of
+// routeModel, or one of the variants when its traffic is split
+func (s *Server) pickModel(r *http.Request) (*servedModel, error) {
+	m, err := s.routeModel(r)
+	if err != nil {
+		return nil, err
+	}
+	if sp := s.served.split(m.name); sp != nil {
+		return sp.pick(r.Header.Get(ClientHeader)), nil
+	}
+	return m, nil
+}
+
+func (s *Server) splitRoute(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	sp := s.served.split(sonate.Vars(r)["name"])
+	if sp == nil {
+		s.handleError(w, r, http.StatusNotFound, errNoSplit)
+		return
+	}
+	resp := &models.SplitResponse{Split: sp.snapshot()}
+	resp.Operation = "split"
+	resp.Success = true
+	resp.Time = time.Since(start).String()
+	s.sendResponse(w, r, http.StatusOK, resp, start)
+}
+
+// startSplitRoute starts sending a share of the traffic of a model to
+// another of its versions, replacing the split already running
+func (s *Server) startSplitRoute(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	baseline, err := s.routeModel(r)
+	if err != nil {
+		s.handleError(w, r, http.StatusNotFound, err)
+		return
+	}
+	var req models.SplitRequest
+	if !s.decodeJSON(w, r, &req) {
+		return
+	}
+	invalid := &validationError{}
+	invalid.check(req.Weight > 0 && req.Weight <= 100, "weight", "must be a percentage above 0, got %g", req.Weight)
+	invalid.check(baseline.version == nil || baseline.version.Version != req.Version, "version", "%d is already the active version", req.Version)
+	if err := invalid.err(); err != nil {
+		s.handleError(w, r, http.StatusUnprocessableEntity, err)
+		return
+	}
+	net, v, err := s.registry.Load(baseline.name, req.Version)
+	if err != nil {
+		s.handleError(w, r, registryStatus(err), err)
+		return
+	}
+	if err := checkModel(v, net); err != nil {
+		s.handleError(w, r, http.StatusConflict, err)
+		return
+	}
+	sp, err := s.startSplit(baseline, newServedModel(net, v), req.Weight)
+	if err != nil {
+		s.handleError(w, r, http.StatusConflict, err)
+		return
+	}
+	resp := &models.SplitResponse{Split: sp.snapshot()}
+	resp.Operation = "split_start"
+	resp.Message = fmt.Sprintf("Sending %g%% of the traffic to %s", req.Weight, sp.candidate.id())
+	resp.Success = true
+	resp.Time = time.Since(start).String()
+	s.sendResponse(w, r, http.StatusOK, resp, start)
+}
+
+// endSplitRoute sends all the traffic back to the baseline
+func (s *Server) endSplitRoute(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	sp := s.served.endSplit(sonate.Vars(r)["name"])
+	if sp == nil {
+		s.handleError(w, r, http.StatusNotFound, errNoSplit)
+		return
+	}
+	logrus.WithField("model", sp.name).Infof("traffic split with %s ended", sp.candidate.id())
+	resp := &models.SplitResponse{Split: sp.snapshot()}
+	resp.Operation = "split_end"
+	resp.Message = fmt.Sprintf("All the traffic goes to %s", sp.baseline.id())
+	resp.Success = true
+	resp.Time = time.Since(start).String()
+	s.sendResponse(w, r, http.StatusOK, resp, start)
+}
+
+// promoteSplitRoute makes the candidate the active version,
+// which ends the split
+func (s *Server) promoteSplitRoute(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	sp := s.served.split(sonate.Vars(r)["name"])
+	if sp == nil {
+		s.handleError(w, r, http.StatusNotFound, errNoSplit)
+		return
+	}
+	if err := s.promoteSplit(sp); errors.Is(err, errModelChanged) {
+		s.handleError(w, r, http.StatusConflict, err)
+		return
+	} else if err != nil {
+		s.handleError(w, r, registryStatus(err), err)
+		return
+	}
+	resp := &models.SplitResponse{Split: sp.snapshot()}
+	resp.Operation = "split_promote"
+	resp.Message = fmt.Sprintf("Now serving %s", sp.candidate.id())
+	resp.Success = true
+	resp.Time = time.Since(start).String()
+	s.sendResponse(w, r, http.StatusOK, resp, start)
+}
+
+// feedbackRoute records the label a prediction should have had. With a
+// traffic split running it counts for the variant that answered,
+// otherwise the prediction must come from the served version.
+func (s *Server) feedbackRoute(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	served, err := s.routeModel(r)
+	if err != nil {
+		s.handleError(w, r, http.StatusNotFound, err)
+		return
+	}
+	var req models.FeedbackRequest
+	if !s.decodeJSON(w, r, &req) {
+		return
+	}
+	invalid := &validationError{}
+	invalid.check(req.Model != "", "model", "is required")
+	invalid.check(req.Label != "", "label", "is required")
+	invalid.check(req.Expected != "", "expected", "is required")
+	if err := invalid.err(); err != nil {
+		s.handleError(w, r, http.StatusUnprocessableEntity, err)
+		return
+	}
+	m, correct, err := s.feedback(served, req)
+	if err != nil {
+		s.handleError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	feedbackTotal.Inc(m.name, m.versionLabel(), strconv.FormatBool(correct))
+	resp := &models.FeedbackResponse{Variant: m.variant, Correct: correct}
+	resp.Operation = "feedback"
+	resp.Success = true
+	resp.Time = time.Since(start).String()
+	s.sendResponse(w, r, http.StatusOK, resp, start)
+}
+
+// feedback checks the feedback against the model that made the prediction
+func (s *Server) feedback(served *servedModel, req models.FeedbackRequest) (*servedModel, bool, error) {
+	if sp := s.served.split(served.name); sp != nil {
+		return sp.feedback(req.Model, req.Label, req.Expected)
+	}
+	if req.Model != served.id() {
+		return nil, false, fmt.Errorf("%s is not the version of %s being served", req.Model, served.name)
+	}
+	if err := checkLabels(served, req.Label, req.Expected); err != nil {
+		return nil, false, err
+	}
+	return served, req.Label == req.Expected, nil
+}
+
+// checkLabels makes sure the model can answer the labels of a feedback
+func checkLabels(m *servedModel, labels ...string) error {
+	for _, label := range labels {
+		if !m.hasLabel(label) {
+			return fmt.Errorf("%s has no label %q", m.id(), label)
+		}
+	}
+	return nil
+}
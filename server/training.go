@@ -0,0 +1,130 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"neural-network/models"
+	"neural-network/network"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// JobKindTrain is the kind of the jobs started by POST /train
+const JobKindTrain = "train"
+
+// runTraining trains a copy of the network in the background, scores the
+// result against the test set when there is one and stores it in the
+// registry as the new active version, unless another version was
+// activated while it trained. The served network is never
+// modified: requests keep using it until the trained copy is swapped in
+// as a whole. With a canary percentage, the new version only gets that
+// share of the traffic. Progress is published to the job after every
+// batch and every epoch.
+func (s *Server) runTraining(ctx context.Context, j *job, m *servedModel, epochs int, canary float64) error {
+	net := m.net.Clone()
+	start := time.Now()
+	epochStart := start
+	// validation runs between epochs and
+	// must not count against the throughput
+	var validating time.Duration
+	samples := 0
+	progress := func(p network.Progress) {
+		samples = (p.Epoch-1)*p.EpochSize + p.Samples
+		jp := models.JobProgress{
+			Epoch:     p.Epoch,
+			Epochs:    p.Epochs,
+			Samples:   p.Samples,
+			EpochSize: p.EpochSize,
+			Percent:   p.Done() * 100,
+			Loss:      p.Loss,
+		}
+		if elapsed := time.Since(start) - validating; elapsed > 0 {
+			jp.Throughput = float64(samples) / elapsed.Seconds()
+		}
+		if remaining := p.Epochs*p.EpochSize - samples; jp.Throughput > 0 && remaining > 0 {
+			jp.ETA = time.Duration(float64(remaining) / jp.Throughput * float64(time.Second)).Round(time.Second).String()
+		}
+		if !p.EpochDone {
+			j.update(func(state *models.Job) {
+				state.Progress = jp
+			})
+			j.publish(models.JobEvent{Type: EventProgress, Progress: &jp})
+			return
+		}
+		em := models.EpochMetrics{
+			Epoch:    p.Epoch,
+			Loss:     p.Loss,
+			Duration: time.Since(epochStart).String(),
+		}
+		validationStart := time.Now()
+		if score, total, err := score(m.dataset, net); err == nil && total > 0 {
+			accuracy := float64(score) / float64(total) * 100
+			em.ValidationSamples = total
+			em.ValidationAccuracy = &accuracy
+		}
+		validating += time.Since(validationStart)
+		epochStart = time.Now()
+		j.update(func(state *models.Job) {
+			state.Progress = jp
+			state.History = append(state.History, em)
+		})
+		j.publish(models.JobEvent{Type: EventEpoch, Progress: &jp, Epoch: &em})
+	}
+	if err := train(ctx, m.dataset, net, epochs, progress); err != nil {
+		logrus.WithField("job", j.state.ID).Errorf("training stopped: %v", err)
+		return err
+	}
+	metrics := &models.TrainMetrics{
+		Epochs:   epochs,
+		Samples:  samples,
+		Duration: time.Since(start).String(),
+	}
+	// the last epoch was already checked against the test set
+	state := j.snapshot()
+	if n := len(state.History); n > 0 && state.History[n-1].ValidationAccuracy != nil {
+		metrics.TestSamples = state.History[n-1].ValidationSamples
+		metrics.TestAccuracy = state.History[n-1].ValidationAccuracy
+	}
+	version, err := s.registry.Create(models.ModelVersion{
+		Name:        m.name,
+		Dataset:     m.dataset,
+		Preprocess:  m.preprocess,
+		Labels:      m.labels,
+		Description: fmt.Sprintf("trained for %d epochs by job %s", epochs, state.ID),
+		Accuracy:    metrics.TestAccuracy,
+	}, net)
+	if err != nil {
+		return err
+	}
+	metrics.Version = version.Version
+	j.update(func(state *models.Job) {
+		state.Metrics = metrics
+	})
+	// the version is only served if the model it was trained from still
+	// is, another version activated meanwhile is not replaced
+	if canary > 0 {
+		_, err = s.startSplit(m, newServedModel(net, version), canary)
+	} else {
+		err = s.activateOver(m, version, net)
+	}
+	if err != nil {
+		return fmt.Errorf("%s v%d was saved but is not served: %w", m.name, version.Version, err)
+	}
+	return nil
+}
+
+func train(ctx context.Context, dataset string, net *network.Network, epochs int, progress network.ProgressFunc) error {
+	if dataset == DatasetCIFAR10 {
+		return net.CifarTrainContext(ctx, network.CifarTrainFiles, epochs, progress)
+	}
+	return net.MnistTrainContext(ctx, network.MnistTrainFile, epochs, progress)
+}
+
+// score checks the network against the test set of the dataset
+func score(dataset string, net *network.Network) (int, int, error) {
+	if dataset == DatasetCIFAR10 {
+		return net.CifarScore(network.CifarTestFile)
+	}
+	return net.MnistScore(network.MnistTestFile)
+}
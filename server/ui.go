@@ -0,0 +1,20 @@
+package server
+
+import (
+	_ "embed"
+	"net/http"
+	"time"
+)
+
+//go:embed ui.html
+var uiPage []byte
+
+// uiRoute serves a page to draw or upload a digit, see what the network
+// made of it and tell which label was right, all through the API
+func (s *Server) uiRoute(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(uiPage)
+	s.logger.Info(http.StatusOK, r.URL.Path, start)
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"net/http"
+	"net/url"
+	"neural-network/utils"
+)
+
+// maxUploadSize bounds the whole multipart body of a prediction
+const maxUploadSize = 10 << 20
+
+// form values are short flags, anything longer is a client error
+const maxFieldSize = 1 << 10
+
+// maxImagePixels bounds the decoded size of an uploaded image,
+// a small file can hold a huge image
+const maxImagePixels = 32 << 20
+
+var errMissingImage = errors.New("missing image field")
+
+// upload is an image read straight from a multipart request,
+// together with the other form values that came with it
+type upload struct {
+	image    image.Image
+	format   utils.Format
+	checksum string
+	values   url.Values
+}
+
+// readUpload decodes the "image" part of a multipart request while it
+// streams in, hashing the raw bytes on the way, so nothing is written to
+// disk. Images of more than maxPixels pixels are rejected before they are
+// decoded. Query parameters are accepted as form values too.
+func readUpload(r *http.Request, maxPixels int) (*upload, error) {
+	mr, err := r.MultipartReader()
+	if err == http.ErrNotMultipart {
+		return nil, fmt.Errorf("%w: images are sent as multipart/form-data", errUnsupportedMedia)
+	}
+	if err != nil {
+		return nil, err
+	}
+	u := &upload{values: url.Values{}}
+	for k, v := range r.URL.Query() {
+		u.values[k] = v
+	}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if part.FormName() == "image" && u.image == nil {
+			err = u.readImage(part, maxPixels)
+		} else if part.FileName() == "" {
+			err = u.readValue(part.FormName(), part)
+		}
+		part.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if u.image == nil {
+		return nil, errMissingImage
+	}
+	return u, nil
+}
+
+func (u *upload) readImage(part io.Reader, maxPixels int) error {
+	hash := sha256.New()
+	tee := io.TeeReader(part, hash)
+	img, format, err := utils.DecodeLimited(tee, maxPixels)
+	if err != nil {
+		return err
+	}
+	// decoders may stop before the end of the file,
+	// the checksum has to cover all of it
+	if _, err := io.Copy(hash, part); err != nil {
+		return err
+	}
+	u.image = img
+	u.format = format
+	u.checksum = hex.EncodeToString(hash.Sum(nil))
+	return nil
+}
+
+func (u *upload) readValue(name string, part io.Reader) error {
+	value, err := io.ReadAll(io.LimitReader(part, maxFieldSize+1))
+	if err != nil {
+		return err
+	}
+	if len(value) > maxFieldSize {
+		return errors.New("form value too long: " + name)
+	}
+	u.values.Add(name, string(value))
+	return nil
+}
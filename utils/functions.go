@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/sha256"
 	"encoding/base64"
@@ -23,6 +24,7 @@ import (
 
 	"golang.org/x/image/bmp"
 	"golang.org/x/image/tiff"
+	"golang.org/x/image/webp"
 )
 
 var maxProcs int64
@@ -56,8 +58,22 @@ const (
 	GIF
 	TIFF
 	BMP
+	WEBP
 )
 
+var formatNames = map[Format]string{
+	JPEG: "JPEG",
+	PNG:  "PNG",
+	GIF:  "GIF",
+	TIFF: "TIFF",
+	BMP:  "BMP",
+	WEBP: "WEBP",
+}
+
+func (f Format) String() string {
+	return formatNames[f]
+}
+
 var formatExts = map[string]Format{
 	"jpg":  JPEG,
 	"jpeg": JPEG,
@@ -66,8 +82,39 @@ var formatExts = map[string]Format{
 	"tif":  TIFF,
 	"tiff": TIFF,
 	"bmp":  BMP,
+	"webp": WEBP,
+}
+
+// ErrUnsupportedFormat is returned when the content of a file
+// does not match any of the supported image formats.
+var ErrUnsupportedFormat = errors.New("unsupported image format")
+
+// ErrImageTooLarge is returned by DecodeLimited when the header of an
+// image announces more pixels than allowed.
+var ErrImageTooLarge = errors.New("image too large")
+
+// file signatures used to sniff the format of the content
+var formatMagic = []struct {
+	format Format
+	match  func([]byte) bool
+}{
+	{JPEG, func(b []byte) bool { return bytes.HasPrefix(b, []byte("\xff\xd8\xff")) }},
+	{PNG, func(b []byte) bool { return bytes.HasPrefix(b, []byte("\x89PNG\r\n\x1a\n")) }},
+	{GIF, func(b []byte) bool {
+		return bytes.HasPrefix(b, []byte("GIF87a")) || bytes.HasPrefix(b, []byte("GIF89a"))
+	}},
+	{TIFF, func(b []byte) bool {
+		return bytes.HasPrefix(b, []byte("II*\x00")) || bytes.HasPrefix(b, []byte("MM\x00*"))
+	}},
+	{BMP, func(b []byte) bool { return bytes.HasPrefix(b, []byte("BM")) }},
+	{WEBP, func(b []byte) bool {
+		return len(b) >= 12 && bytes.Equal(b[0:4], []byte("RIFF")) && bytes.Equal(b[8:12], []byte("WEBP"))
+	}},
 }
 
+// the longest signature we need to look at
+const sniffLen = 12
+
 type fileSystem interface {
 	Create(string) (io.WriteCloser, error)
 	Open(string) (io.ReadCloser, error)
@@ -130,13 +177,7 @@ func PrintImage(img image.Image, invert bool, file string) {
 
 // get the file as an image
 func GetImage(filePath string) image.Image {
-	imgFile, err := os.Open(filePath)
-	if err != nil {
-		fmt.Println("Cannot read file:", err)
-		return nil
-	}
-	defer imgFile.Close()
-	img, _, err := image.Decode(imgFile)
+	img, _, err := Open(filePath)
 	if err != nil {
 		fmt.Println("Cannot decode file:", err)
 		return nil
@@ -144,6 +185,107 @@ func GetImage(filePath string) image.Image {
 	return img
 }
 
+// Open reads an image file, detecting the format from its content.
+func Open(filePath string) (image.Image, Format, error) {
+	file, err := fs.Open(filePath)
+	if err != nil {
+		return nil, -1, err
+	}
+	defer file.Close()
+	return Decode(file)
+}
+
+// FormatFromContent detects the image format from the first bytes of a file.
+func FormatFromContent(header []byte) (Format, error) {
+	for _, m := range formatMagic {
+		if m.match(header) {
+			return m.format, nil
+		}
+	}
+	return -1, ErrUnsupportedFormat
+}
+
+// Decode reads an image from r, detecting the format (JPEG, PNG, GIF,
+// TIFF, BMP or WEBP) from the content instead of trusting a filename.
+func Decode(r io.Reader) (image.Image, Format, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(sniffLen)
+	if err != nil && err != io.EOF {
+		return nil, -1, err
+	}
+	format, err := FormatFromContent(header)
+	if err != nil {
+		return nil, -1, err
+	}
+	var img image.Image
+	switch format {
+	case JPEG:
+		img, err = jpeg.Decode(br)
+	case PNG:
+		img, err = png.Decode(br)
+	case GIF:
+		img, err = gif.Decode(br)
+	case TIFF:
+		img, err = tiff.Decode(br)
+	case BMP:
+		img, err = bmp.Decode(br)
+	case WEBP:
+		img, err = webp.Decode(br)
+	}
+	if err != nil {
+		return nil, format, fmt.Errorf("cannot decode %v image: %w", format, err)
+	}
+	return img, format, nil
+}
+
+// DecodeConfig reads the format and the dimensions of an image
+// from its header, detecting the format like Decode.
+func DecodeConfig(r io.Reader) (image.Config, Format, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(sniffLen)
+	if err != nil && err != io.EOF {
+		return image.Config{}, -1, err
+	}
+	format, err := FormatFromContent(header)
+	if err != nil {
+		return image.Config{}, -1, err
+	}
+	var config image.Config
+	switch format {
+	case JPEG:
+		config, err = jpeg.DecodeConfig(br)
+	case PNG:
+		config, err = png.DecodeConfig(br)
+	case GIF:
+		config, err = gif.DecodeConfig(br)
+	case TIFF:
+		config, err = tiff.DecodeConfig(br)
+	case BMP:
+		config, err = bmp.DecodeConfig(br)
+	case WEBP:
+		config, err = webp.DecodeConfig(br)
+	}
+	if err != nil {
+		return config, format, fmt.Errorf("cannot decode %v image: %w", format, err)
+	}
+	return config, format, nil
+}
+
+// DecodeLimited decodes an image like Decode, once its header shows it
+// has at most maxPixels pixels. Larger images fail with ErrImageTooLarge
+// before any of their pixels are decoded.
+func DecodeLimited(r io.Reader, maxPixels int) (image.Image, Format, error) {
+	var header bytes.Buffer
+	config, format, err := DecodeConfig(io.TeeReader(r, &header))
+	if err != nil {
+		return nil, format, err
+	}
+	if int64(config.Width)*int64(config.Height) > int64(maxPixels) {
+		return nil, format, fmt.Errorf("%w: %dx%d, at most %d pixels", ErrImageTooLarge, config.Width, config.Height, maxPixels)
+	}
+	return Decode(io.MultiReader(&header, r))
+}
+
 // GetSHA256Checksum gets the checksum of an uploaded file.
 // This is used to check if the file has been uploaded before
 // and retrieve its result from cache. It is also used to
@@ -166,7 +308,7 @@ func InvertImage(img image.Image) *image.NRGBA {
 }
 
 // FormatFromExtension parses image format from filename extension:
-// "jpg" (or "jpeg"), "png", "gif", "tif" (or "tiff") and "bmp" are supported.
+// "jpg" (or "jpeg"), "png", "gif", "tif" (or "tiff"), "bmp" and "webp" are supported.
 func FormatFromExtension(ext string) (Format, error) {
 	if f, ok := formatExts[strings.ToLower(strings.TrimPrefix(ext, "."))]; ok {
 		return f, nil
@@ -216,6 +358,9 @@ func Encode(w io.Writer, img image.Image, format Format, opts ...EncodeOption) e
 
 	case BMP:
 		return bmp.Encode(w, img)
+
+	case WEBP:
+		return errors.New("WEBP encoding is not supported")
 	}
 
 	return errors.New("unknown image format")